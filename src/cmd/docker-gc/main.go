@@ -4,8 +4,13 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"pkg/api"
 	"pkg/gc"
+	"pkg/helpers"
+	"pkg/notify"
 	"pkg/statsd"
+	"pkg/systemd"
+	"strings"
 	"time"
 
 	logrus_bugsnag "github.com/Shopify/logrus-bugsnag"
@@ -16,46 +21,169 @@ import (
 var (
 	command                   string
 	intervalForContinuousMode time.Duration
+	adaptiveInterval          gc.AdaptiveInterval
+	schedules                 []gc.Schedule
+	missedRuns                string
+	lockPath                  string
+	apiAddress                string
+	healthStaleAfter          time.Duration
+	healthcheckEndpoint       string
+	lockContention            string
+	runTimeout                time.Duration
+	maxReconnectBackoff       time.Duration
 	bugsnagKey                string
 	statsdAddr                string
 	statsdNamespace           string
+	statsdTags                []string
+	explainID                 string
+	output                    string
+	sortBy                    string
+	filters                   []string
+	reportPath                string
+	tagStatePath              string
+	webhook                   notify.Webhook
 	gcPolicy                  gc.GCPolicy
 )
 
 var (
-	commandFlag                   = flag.String("command", "ttl", "What to clean (images|containers|all|emergency|continous")
+	commandFlag                   = flag.String("command", "ttl", "What to clean (images|dangling|containers|all|emergency|continous), explain or list")
 	imagesTtlFlag                 = flag.Duration("images_ttl", 10*time.Hour, "How old images are kept")
+	danglingImagesTtlFlag         = flag.Duration("dangling_images_ttl", 0, "How old untagged images are kept, unset uses images_ttl")
+	tagGCFlag                     = flag.Bool("tag_gc", false, "Untag stale tags of images individually and remove images only when all of their tags are stale")
+	protectedTagsFlag             = flag.String("protected_tags", "", "Comma separated tag patterns never considered stale with tag_gc, eg. *:production")
+	tagStatePathFlag              = flag.String("tag_state_path", "", "Path to keep the first seen times of tags in for tag_gc, kept in memory if unset")
 	containersTtlFlag             = flag.Duration("containers_ttl", 1*time.Minute, "How old containers are kept")
+	createdContainersTtlFlag      = flag.Duration("created_containers_ttl", 0, "How old containers created but never started are kept, unset keeps them forever")
+	containerRulesFlag            = flag.String("container_rules", "", "Semicolon separated container TTL rules, first match wins, eg. exit=nonzero,ttl=24h;name=ci-*,ttl=0s,volumes=true")
 	intervalForContinuousModeFlag = flag.Duration("interval", 60*time.Second, "How often we run checks in interval mode")
 	bugsnagKeyFlag                = flag.String("bugsnag_key", "", "Bugsnag key")
 	statsdAddrFlag                = flag.String("statsd_address", "127.0.0.1:8125", "Statsd address to emit metrics to")
 	statsdNamespaceFlag           = flag.String("statsd_namespace", "borg.dockergc.", "Namespace for statsd metrics")
-	highDiskSpaceThresholdFlag    = flag.Int("high_disk_space_threshold", 85, "High disk space threshold for GC in percentage")
-	lowDiskSpaceThresholdFlag     = flag.Int("low_disk_space_threshold", 50, "Low disk space threshold for GC in percentage")
+	statsdTagsFlag                = flag.String("statsd_tags", "", "Comma separated tags added to every statsd metric, eg. env:prod,role:ci")
+	statsdMaxRepositoriesFlag     = flag.Int("statsd_max_repositories", gc.StatsdRepositoryLimit, "How many distinct repositories image deletion metrics are tagged with, the rest are tagged as other")
+	highDiskSpaceThresholdFlag    = flag.String("high_disk_space_threshold", "85", "High disk space threshold for GC in percentage, eg. 85.5, or free space, eg. 20GiB free")
+	lowDiskSpaceThresholdFlag     = flag.String("low_disk_space_threshold", "50", "Low disk space threshold for GC in percentage, eg. 50.5, or free space, eg. 40GiB free")
+	highInodeThresholdFlag        = flag.Float64("high_inode_threshold", 0, "High inode usage threshold for GC in percentage, unset uses the disk space thresholds")
+	lowInodeThresholdFlag         = flag.Float64("low_inode_threshold", 0, "Low inode usage threshold for GC in percentage, required with high_inode_threshold")
+	filesystemsFlag               = flag.String("filesystems", "", "Comma separated filesystems monitored in diskspace mode as path:resources:high:low, resources joined with + (images|containers|logs|buildcache), eg. /var/lib/docker/containers:logs:90:80")
+	discoverFilesystemsFlag       = flag.Bool("discover_filesystems", false, "Monitor each filesystem Docker stores data on in diskspace mode, cleaning only what is stored on the full one")
+	minIntervalFlag               = flag.Duration("min_interval", 0, "Shortest interval in diskspace mode reached at the high threshold, set with max_interval to adapt the interval to disk usage")
+	maxIntervalFlag               = flag.Duration("max_interval", 0, "Longest interval in diskspace mode used at or below the low threshold")
+	intervalJitterFlag            = flag.Float64("interval_jitter", 0.1, "Fraction of the adaptive interval randomly added or removed")
+	apiAddressFlag                = flag.String("api_address", "", "Serve the control API of continuous modes on unix:///path or a localhost address, eg. 127.0.0.1:8981")
+	healthStaleAfterFlag          = flag.Duration("health_stale_after", 0, "The daemon is unhealthy when it hasn't swept successfully for this long, unset is 3 intervals and disabled with schedules")
+	healthcheckEndpointFlag       = flag.String("healthcheck_endpoint", "/healthz", "Endpoint of the control API the healthcheck command checks (/healthz|/readyz)")
+	lockPathFlag                  = flag.String("lock_file", "", "Lock file every sweep holds so that docker-gc processes on the same host don't delete at the same time, eg. /var/run/docker-gc.lock")
+	lockContentionFlag            = flag.String("lock_contention", gc.WaitForLock, "What one-time commands do when another docker-gc process is sweeping, wait or preempt its sweep")
+	missedRunsFlag                = flag.String("missed_runs", gc.SkipMissedRuns, "What to do with runs due while a sweep is still running in continuous modes, skip or queue")
+	maxReconnectBackoffFlag       = flag.Duration("max_reconnect_backoff", time.Minute, "Longest wait between attempts to reach the Docker daemon at startup of continuous modes")
+	runTimeoutFlag                = flag.Duration("run_timeout", 0, "Report a sweep running longer than this in continuous modes as timed out, the next runs still wait for it, unset never reports")
+	schedulesFlag                 = flag.String("schedules", "", "Semicolon separated resources=cron expression schedules of TTL mode, eg. images=0 2 * * *, resources without one run every interval")
+	maintenanceWindowsFlag        = flag.String("maintenance_windows", "", "Semicolon separated allow|deny resources days start-end windows for deletions in TTL mode, eg. deny images mon-fri 09:00-18:00")
+	timezoneFlag                  = flag.String("timezone", "Local", "Time zone of schedules and maintenance windows, eg. Europe/Helsinki")
+	predictionHorizonFlag         = flag.Duration("prediction_horizon", 0, "Start diskspace cleanup early when the high threshold is projected to be reached within this, unset disables prediction")
+	predictionWindowFlag          = flag.Duration("prediction_window", gc.DefaultPredictionWindow, "How far back disk usage samples are used to estimate the fill rate")
+	fallbackImagesTtlFlag         = flag.Duration("fallback_images_ttl", 0, "How old images are kept when diskspace mode can't reach low threshold, unset disables fallback")
+	fallbackContainersTtlFlag     = flag.Duration("fallback_containers_ttl", 0, "How old containers are kept when diskspace mode can't reach low threshold, unset disables fallback")
+	buildCacheTtlFlag             = flag.Duration("build_cache_ttl", 0, "How long unused build cache is kept, unset disables build cache pruning unless build_cache_keep_storage is set")
+	buildCacheKeepStorageFlag     = flag.String("build_cache_keep_storage", "", "Build cache is pruned down to at most this size, eg. 20GiB")
+	maxLogSizeFlag                = flag.String("max_log_size", "", "Container logs larger than this are truncated in diskspace mode, eg. 500MiB, unset disables log cleanup")
+	logKeepTailFlag               = flag.String("log_keep_tail", "1MiB", "How much of the end of a truncated container log is kept in it")
+	rotateLogsFlag                = flag.Bool("rotate_logs", false, "Save truncated container logs whole gzipped next to the log and empty them instead of keeping their tail")
+	maxDeletionsFlag              = flag.Int("max_deletions", 0, "Most images and containers deleted in a single run, the rest are left for the next run, unset is no cap")
+	maxRotatedLogsFlag            = flag.Int("max_rotated_logs", gc.DefaultMaxRotatedLogs, "How many rotated logs are kept next to each container log, the oldest are removed")
+	idFlag                        = flag.String("id", "", "Image or container ID, tag or name to explain")
+	outputFlag                    = flag.String("output", "table", "Output format for explain and list (table|json|csv)")
+	sortFlag                      = flag.String("sort", "created", "Field to sort list by (created|size|id|type)")
+	filterFlag                    = flag.String("filter", "", "Comma separated filters for list (images|containers|candidates|in-use)")
+	reportPathFlag                = flag.String("report_path", "", "Path to write a JSON report of each cleanup run to")
+	webhookURLFlag                = flag.String("webhook_url", "", "URL to POST notifications to")
+	webhookHeadersFlag            = flag.String("webhook_headers", "", "Comma separated headers for webhook requests, eg. Authorization:Bearer xyz")
+	webhookTemplateFlag           = flag.String("webhook_template", notify.DefaultTemplate, "Go template for webhook request body")
+	webhookTimeoutFlag            = flag.Duration("webhook_timeout", 5*time.Second, "Timeout for a single webhook request")
+	webhookRetriesFlag            = flag.Int("webhook_retries", 3, "How many times failed webhook requests are retried")
+	webhookEventsFlag             = flag.String("webhook_events", "", "Comma separated events to notify about (high_threshold_reached|low_threshold_not_reached|run_failed|deletion_cap_reached), all by default")
 )
 
 const usageMessage = `Usage of 'docker-gc':
-  docker-gc -command=containers|images|all|emergency [-images_ttl=<DURATION>) [-containers_ttl=<DURATION>]
+  docker-gc -command=containers|images|all|emergency [-images_ttl=<DURATION>) [-dangling_images_ttl=<DURATION>] [-containers_ttl=<DURATION>] [-created_containers_ttl=<DURATION>] [-container_rules=<RULES>]
+  -command=dangling cleans only untagged images respecting dangling_images_ttl
   -command=all cleans all images and containes respecting keep_last values
   -command=emergency same as all, but with 0second keep_last values
   OR
-  docker-gc -command=ttl [-interval=<INTERVAL_IN_SECONDS>] [-images_ttl=<DURATION>] [-containers_ttl=<DURATION>] for continuous cleanup based on image/container TTL
+  docker-gc -command=ttl [-interval=<INTERVAL_IN_SECONDS>] [-missed_runs=skip|queue] [-run_timeout=<DURATION>] [-max_reconnect_backoff=<DURATION>] [-schedules=<RESOURCES=CRON;...>] [-maintenance_windows=<ALLOW|DENY RESOURCES DAYS START-END;...>] [-timezone=<ZONE>] [-images_ttl=<DURATION>] [-containers_ttl=<DURATION>] [-build_cache_ttl=<DURATION>] [-build_cache_keep_storage=<BYTES>] [-max_deletions=<COUNT>] for continuous cleanup based on image/container TTL
   OR
-  docker-gc -command=diskspace [-interval=<INTERVAL_IN_SECONDS>] [-high_disk_space_threshold=<PERCENTAGE>] [-low_disk_space_threshold=<PERCENTAGE>] [-containers_ttl=<DURATION>] for continuous cleanup based on used disk space
+  docker-gc -command=diskspace [-interval=<INTERVAL_IN_SECONDS>] [-missed_runs=skip|queue] [-run_timeout=<DURATION>] [-max_reconnect_backoff=<DURATION>] [-high_disk_space_threshold=<PERCENTAGE|BYTES free>] [-low_disk_space_threshold=<PERCENTAGE|BYTES free>] [-high_inode_threshold=<PERCENTAGE> -low_inode_threshold=<PERCENTAGE>] [-containers_ttl=<DURATION>] [-build_cache_ttl=<DURATION>] [-build_cache_keep_storage=<BYTES>] [-fallback_images_ttl=<DURATION>] [-fallback_containers_ttl=<DURATION>] [-max_deletions=<COUNT>] [-max_log_size=<BYTES>] [-log_keep_tail=<BYTES>] [-rotate_logs] [-max_rotated_logs=<COUNT>] [-discover_filesystems] [-filesystems=<PATH:RESOURCES:HIGH:LOW,...>] [-prediction_horizon=<DURATION>] [-prediction_window=<DURATION>] [-min_interval=<DURATION> -max_interval=<DURATION>] [-interval_jitter=<FRACTION>] for continuous cleanup based on used disk space
+  OR
+  docker-gc -command=healthcheck -api_address=<unix:///PATH|127.0.0.1:PORT> [-healthcheck_endpoint=/healthz|/readyz] to check a running daemon, eg. as HEALTHCHECK of its container
+  OR
+  docker-gc -command=explain -id=<ID|TAG|NAME> [-output=table|json] [-images_ttl=<DURATION>] [-containers_ttl=<DURATION>] to show why an image or container is kept or deleted
+  OR
+  docker-gc -command=list [-output=table|json|csv] [-sort=created|size|id|type] [-filter=images,containers,candidates,in-use] [-images_ttl=<DURATION>] [-containers_ttl=<DURATION>] to list images and containers and whether they would be collected
 
   You can also specify -bugsnag-key="key" to use bugsnag integration
-  and [-statsd_address=<127.0.0.1:815>] and [statsd_namespace=<docker.gc.wtf>] for statsd integration
+  and [-statsd_address=<127.0.0.1:815>] and [statsd_namespace=<docker.gc.wtf>] [-statsd_tags=<TAG,...>] [-statsd_max_repositories=<COUNT>] for statsd integration
+  and [-report_path=<PATH>] to write a JSON report of every cleanup run
+  and [-api_address=<unix:///PATH|127.0.0.1:PORT>] [-health_stale_after=<DURATION>] to serve the control API in continuous modes
+  and [-lock_file=<PATH>] [-lock_contention=wait|preempt] to run one sweep at a time on the host
+  and [-tag_gc] [-protected_tags=<PATTERN,...>] [-tag_state_path=<PATH>] to age and untag image tags individually
+  and [-webhook_url=<URL>] [-webhook_headers=<KEY:VALUE,...>] [-webhook_template=<TEMPLATE>] [-webhook_events=<EVENT,...>] for webhook notifications
 `
 
 func main() {
 	parseFlags()
+	if command == "healthcheck" {
+		healthcheck()
+	}
 	initBugSnag(bugsnagKey)
-	statsd.Configure(statsdAddr, statsdNamespace)
-	gc.StartDockerClientDefault()
+	statsd.Configure(statsdAddr, statsdNamespace, statsdTags...)
+	if reportPath != "" {
+		gc.AddReportHook(gc.ReportFile(reportPath))
+	}
+	if webhook.URL != "" {
+		if err := notify.Configure(webhook); err != nil {
+			log.WithField("error", err).Error("Configuring webhook failed")
+			os.Exit(2)
+		}
+	}
+	if gcPolicy.TagGC && tagStatePath != "" {
+		if err := gc.LoadTagState(tagStatePath); err != nil {
+			log.WithField("error", err).Error("Loading tag state failed")
+			os.Exit(2)
+		}
+	} else if gcPolicy.TagGC {
+		log.Warn("No tag_state_path set, tag first seen times are lost on restart and every tag waits a full images_ttl again")
+	}
+	if err := gc.ConfigureSweepLock(lockPath, lockContention); err != nil {
+		log.WithField("error", err).Error("Configuring sweep lock failed")
+		os.Exit(2)
+	}
+	switch command {
+	case "ttl":
+		gc.ConnectDockerClient(gc.DockerEndpoint, gc.DatePolicy, maxReconnectBackoff)
+	case "diskspace":
+		gc.ConnectDockerClient(gc.DockerEndpoint, gc.DiskPolicy, maxReconnectBackoff)
+	default:
+		gc.StartDockerClientDefault()
+	}
+	systemd.Ready()
+	gc.AddReportHook(func(report gc.Report) { systemd.Status(report.Summary()) })
+
+	switch command {
+	case "images", "dangling", "containers", "all", "emergency":
+		unlock := gc.LockSweep(command)
+		defer unlock()
+	}
 
 	switch command {
 	case "images":
 		gc.CleanImages(gcPolicy.TtlImages)
+	case "dangling":
+		ttl := gcPolicy.TtlImages
+		if gcPolicy.TtlDanglingImages != nil {
+			ttl = *gcPolicy.TtlDanglingImages
+		}
+		gc.CleanDanglingImages(ttl)
 	case "containers":
 		gc.CleanContainers(gcPolicy.TtlContainers)
 	case "all":
@@ -63,13 +191,50 @@ func main() {
 	case "emergency":
 		emergencyPolicy := gc.GCPolicy{TtlContainers: 0, TtlImages: 0}
 		gc.CleanAll(gc.DatePolicy, emergencyPolicy)
+	case "explain":
+		explanation, err := gc.Explain(explainID, gcPolicy)
+		if err != nil {
+			log.WithField("error", err).Error("Explaining " + explainID + " failed")
+			os.Exit(1)
+		}
+		if err := gc.WriteExplanation(os.Stdout, explanation, output); err != nil {
+			log.WithField("error", err).Error("Writing explanation failed")
+			os.Exit(1)
+		}
+	case "list":
+		entries, err := gc.Inventory(gcPolicy)
+		if err == nil {
+			entries, err = gc.FilterInventory(entries, filters)
+		}
+		if err == nil {
+			err = gc.SortInventory(entries, sortBy)
+		}
+		if err == nil {
+			err = gc.WriteInventory(os.Stdout, entries, output)
+		}
+		if err != nil {
+			log.WithField("error", err).Error("Listing images and containers failed")
+			os.Exit(1)
+		}
 	case "ttl":
+		scheduler := newScheduler()
+		startAPI(scheduler, gc.DatePolicy)
 		interval := uint64(intervalForContinuousMode.Seconds())
-		gc.TtlGC(interval, gcPolicy)
+		if len(schedules) > 0 {
+			gc.ScheduledTtlGC(scheduler, interval, schedules, gcPolicy)
+			select {}
+		}
+		gc.TtlGC(scheduler, interval, gcPolicy)
 		select {}
 	case "diskspace":
+		scheduler := newScheduler()
+		startAPI(scheduler, gc.DiskPolicy)
+		if adaptiveInterval.Max > 0 {
+			gc.AdaptiveDiskSpaceGC(scheduler, adaptiveInterval, gcPolicy)
+			select {}
+		}
 		interval := uint64(intervalForContinuousMode.Seconds())
-		gc.DiskSpaceGC(interval, gcPolicy)
+		gc.DiskSpaceGC(scheduler, interval, gcPolicy)
 		select {}
 	default:
 		log.Error(command + " is not valid command")
@@ -78,6 +243,65 @@ func main() {
 	}
 }
 
+// newScheduler returns the scheduler of the continuous modes
+func newScheduler() *gc.Scheduler {
+	scheduler, err := gc.NewScheduler(missedRuns, runTimeout)
+	if err != nil {
+		log.WithField("error", err).Error("Scheduler not valid")
+		Usage()
+	}
+	if timeout := systemd.WatchdogTimeout(); timeout > 0 {
+		scheduler.Watchdog(timeout, systemd.Watchdog)
+	}
+	return scheduler
+}
+
+// startAPI serves the control API of the continuous mode when it's enabled
+func startAPI(scheduler *gc.Scheduler, mode string) {
+	if apiAddress == "" {
+		return
+	}
+	listener, err := api.Listen(apiAddress)
+	if err != nil {
+		log.WithField("error", err).Error("Listening for control API failed")
+		os.Exit(1)
+	}
+	server := api.New(scheduler, mode, gcPolicy)
+	server.StaleAfter = staleAfter()
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			log.WithField("error", err).Error("Serving control API failed")
+		}
+	}()
+}
+
+// staleAfter is how long the daemon may go without a successful sweep before
+// it's unhealthy, by default three of its intervals
+func staleAfter() time.Duration {
+	switch {
+	case healthStaleAfter > 0:
+		return healthStaleAfter
+	case len(schedules) > 0:
+		// Scheduled runs may be days apart
+		return 0
+	case adaptiveInterval.Max > 0:
+		return 3 * adaptiveInterval.Max
+	}
+	return 3 * intervalForContinuousMode
+}
+
+// healthcheck checks the control API of the running daemon and exits with
+// the status of its health
+func healthcheck() {
+	body, err := api.Check(apiAddress, healthcheckEndpoint, 5*time.Second)
+	fmt.Fprint(os.Stdout, body)
+	if err != nil {
+		log.WithField("error", err).Error("Healthcheck failed")
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
 // Usage is a replacement usage function for the flags package.
 func Usage() {
 	fmt.Fprintln(os.Stderr, usageMessage)
@@ -92,20 +316,232 @@ func parseFlags() {
 
 	command = *commandFlag
 	intervalForContinuousMode = *intervalForContinuousModeFlag
+	missedRuns = *missedRunsFlag
+	lockPath = *lockPathFlag
+	apiAddress = *apiAddressFlag
+	healthStaleAfter = *healthStaleAfterFlag
+	healthcheckEndpoint = *healthcheckEndpointFlag
+	if command == "healthcheck" && (apiAddress == "" || healthcheckEndpoint != "/healthz" && healthcheckEndpoint != "/readyz") {
+		log.WithFields(log.Fields{"apiAddress": apiAddress, "endpoint": healthcheckEndpoint}).Error("Healthcheck needs api_address of the daemon and endpoint /healthz or /readyz")
+		flag.Usage()
+		os.Exit(2)
+	}
+	lockContention = *lockContentionFlag
+	runTimeout = *runTimeoutFlag
+	maxReconnectBackoff = *maxReconnectBackoffFlag
+	if maxReconnectBackoff <= 0 {
+		log.WithField("maxReconnectBackoff", maxReconnectBackoff).Error("Max reconnect backoff must be positive")
+		flag.Usage()
+		os.Exit(2)
+	}
+	adaptiveInterval = gc.AdaptiveInterval{Min: *minIntervalFlag, Max: *maxIntervalFlag, Jitter: *intervalJitterFlag}
+	if (adaptiveInterval.Min > 0) != (adaptiveInterval.Max > 0) || adaptiveInterval.Min > adaptiveInterval.Max ||
+		adaptiveInterval.Jitter < 0 || adaptiveInterval.Jitter >= 1 {
+		log.WithFields(log.Fields{
+			"minInterval": adaptiveInterval.Min,
+			"maxInterval": adaptiveInterval.Max,
+			"jitter":      adaptiveInterval.Jitter,
+		}).Error("Adaptive interval not valid, set both min_interval and max_interval with min below max and jitter between 0 and 1")
+		flag.Usage()
+		os.Exit(2)
+	}
 	statsdAddr = *statsdAddrFlag
 	statsdNamespace = *statsdNamespaceFlag
+	statsdTags = nil
+	if *statsdTagsFlag != "" {
+		statsdTags = strings.Split(*statsdTagsFlag, ",")
+	}
+	for _, tag := range statsdTags {
+		if strings.TrimSpace(tag) == "" || strings.ContainsAny(tag, " |#") {
+			log.WithField("tags", *statsdTagsFlag).Error("Statsd tags not valid, use comma separated tags without spaces, | or #")
+			flag.Usage()
+			os.Exit(2)
+		}
+	}
+	if *statsdMaxRepositoriesFlag < 0 {
+		log.WithField("maxRepositories", *statsdMaxRepositoriesFlag).Error("Statsd max repositories can't be negative")
+		flag.Usage()
+		os.Exit(2)
+	}
+	gc.StatsdRepositoryLimit = *statsdMaxRepositoriesFlag
+	explainID = *idFlag
+	output = *outputFlag
+	sortBy = *sortFlag
+	reportPath = *reportPathFlag
+	tagStatePath = *tagStatePathFlag
+
+	webhook = notify.Webhook{
+		URL:          *webhookURLFlag,
+		Headers:      map[string]string{},
+		Template:     *webhookTemplateFlag,
+		Timeout:      *webhookTimeoutFlag,
+		Retries:      *webhookRetriesFlag,
+		RetryBackoff: 1 * time.Second,
+	}
+	for _, header := range strings.Split(*webhookHeadersFlag, ",") {
+		if header == "" {
+			continue
+		}
+		keyAndValue := strings.SplitN(header, ":", 2)
+		if len(keyAndValue) != 2 {
+			log.Error(header + " is not valid webhook header")
+			flag.Usage()
+			os.Exit(2)
+		}
+		webhook.Headers[strings.TrimSpace(keyAndValue[0])] = strings.TrimSpace(keyAndValue[1])
+	}
+	events, err := notify.ParseEvents(*webhookEventsFlag)
+	if err != nil {
+		log.WithField("error", err).Error("Webhook events not valid")
+		flag.Usage()
+		os.Exit(2)
+	}
+	webhook.Events = events
+	filters = nil
+	if *filterFlag != "" {
+		filters = strings.Split(*filterFlag, ",")
+	}
 
 	gcPolicy.TtlImages = *imagesTtlFlag
 	gcPolicy.TtlContainers = *containersTtlFlag
-	gcPolicy.HighDiskSpaceThreshold = *highDiskSpaceThresholdFlag
-	gcPolicy.LowDiskSpaceThreshold = *lowDiskSpaceThresholdFlag
+	gcPolicy.TtlDanglingImages = nil
+	gcPolicy.TtlCreatedContainers = nil
+	rules, err := gc.ParseContainerRules(*containerRulesFlag)
+	if err != nil {
+		log.WithField("error", err).Error("Container rules not valid")
+		flag.Usage()
+		os.Exit(2)
+	}
+	gcPolicy.ContainerRules = rules
+	gcPolicy.TagGC = *tagGCFlag
+	gcPolicy.ProtectedTags = nil
+	if *protectedTagsFlag != "" {
+		gcPolicy.ProtectedTags = strings.Split(*protectedTagsFlag, ",")
+	}
+	gcPolicy.HighDiskSpaceThreshold, gcPolicy.HighDiskSpaceFree, err = gc.ParseThreshold(*highDiskSpaceThresholdFlag)
+	if err == nil {
+		gcPolicy.LowDiskSpaceThreshold, gcPolicy.LowDiskSpaceFree, err = gc.ParseThreshold(*lowDiskSpaceThresholdFlag)
+	}
+	if err == nil {
+		err = gc.ValidateThresholds(gcPolicy.HighDiskSpaceThreshold, gcPolicy.HighDiskSpaceFree, gcPolicy.LowDiskSpaceThreshold, gcPolicy.LowDiskSpaceFree)
+	}
+	if err != nil {
+		log.WithField("error", err).Error("Disk space threshold not valid, check that values are valid percentage values between 0-100 or free space and that high is bigger than low")
+		flag.Usage()
+		os.Exit(2)
+	}
+	gcPolicy.HighInodeThreshold = *highInodeThresholdFlag
+	gcPolicy.LowInodeThreshold = *lowInodeThresholdFlag
+	filesystems, err := gc.ParseFilesystems(*filesystemsFlag)
+	if err != nil {
+		log.WithField("error", err).Error("Filesystems not valid")
+		flag.Usage()
+		os.Exit(2)
+	}
+	gcPolicy.Filesystems = filesystems
+	gcPolicy.DiscoverFilesystems = *discoverFilesystemsFlag
+	location, err := time.LoadLocation(*timezoneFlag)
+	if err != nil {
+		log.WithField("error", err).Error("Time zone not valid")
+		flag.Usage()
+		os.Exit(2)
+	}
+	schedules, err = gc.ParseSchedules(*schedulesFlag, location)
+	if err != nil {
+		log.WithField("error", err).Error("Schedules not valid")
+		flag.Usage()
+		os.Exit(2)
+	}
+	gcPolicy.MaintenanceWindows, err = gc.ParseMaintenanceWindows(*maintenanceWindowsFlag, location)
+	if err != nil {
+		log.WithField("error", err).Error("Maintenance windows not valid")
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *maxDeletionsFlag < 0 {
+		log.WithField("maxDeletions", *maxDeletionsFlag).Error("Max deletions can't be negative")
+		flag.Usage()
+		os.Exit(2)
+	}
+	gcPolicy.MaxDeletions = *maxDeletionsFlag
+	gcPolicy.PredictionHorizon = *predictionHorizonFlag
+	gcPolicy.PredictionWindow = *predictionWindowFlag
+
+	gcPolicy.MaxLogSize = 0
+	if *maxLogSizeFlag != "" {
+		gcPolicy.MaxLogSize = parseBytesFlag("max_log_size", *maxLogSizeFlag)
+	}
+	gcPolicy.LogKeepTail = parseBytesFlag("log_keep_tail", *logKeepTailFlag)
+	gcPolicy.RotateLogs = *rotateLogsFlag
+	if *maxRotatedLogsFlag <= 0 {
+		log.WithField("maxRotatedLogs", *maxRotatedLogsFlag).Error("Max rotated logs must be positive")
+		flag.Usage()
+		os.Exit(2)
+	}
+	gcPolicy.MaxRotatedLogs = *maxRotatedLogsFlag
+
+	// Build cache pruning is enabled by setting either of its flags, dangling
+	// images get their own TTL and created containers are collected only when
+	// their TTL is set
+	gcPolicy.PruneBuildCache = false
+	gcPolicy.TtlBuildCache = *buildCacheTtlFlag
+	gcPolicy.BuildCacheKeepStorage = 0
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "dangling_images_ttl":
+			gcPolicy.TtlDanglingImages = danglingImagesTtlFlag
+		case "created_containers_ttl":
+			gcPolicy.TtlCreatedContainers = createdContainersTtlFlag
+		case "build_cache_ttl":
+			gcPolicy.PruneBuildCache = true
+		case "build_cache_keep_storage":
+			gcPolicy.PruneBuildCache = true
+			gcPolicy.BuildCacheKeepStorage = parseBytesFlag(f.Name, f.Value.String())
+		}
+	})
+
+	// Fallback is enabled by setting either of its TTLs, the other one
+	// defaults to the regular policy
+	gcPolicy.Fallback = nil
+	fallback := gc.GCPolicy{TtlImages: gcPolicy.TtlImages, TtlContainers: gcPolicy.TtlContainers}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "fallback_images_ttl":
+			fallback.TtlImages = *fallbackImagesTtlFlag
+			gcPolicy.Fallback = &fallback
+		case "fallback_containers_ttl":
+			fallback.TtlContainers = *fallbackContainersTtlFlag
+			gcPolicy.Fallback = &fallback
+		}
+	})
+
+	if err := gc.ValidateInodeThresholds(gcPolicy.HighInodeThreshold, gcPolicy.LowInodeThreshold); err != nil {
+		log.WithField("error", err).Error("Inode thresholds not valid")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if output != gc.TableOutput && output != gc.JSONOutput && (output != gc.CSVOutput || command == "explain") {
+		log.Error(output + " is not valid output format")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if command == "explain" && explainID == "" {
+		log.Error("-id is required for explain")
+		flag.Usage()
+		os.Exit(2)
+	}
+}
 
-	if gcPolicy.HighDiskSpaceThreshold > 100 || gcPolicy.HighDiskSpaceThreshold < 0 ||
-		gcPolicy.LowDiskSpaceThreshold > gcPolicy.HighDiskSpaceThreshold || gcPolicy.LowDiskSpaceThreshold < 0 {
-		log.Error("Disk space threshold not valid, check that values are valid percentage values between 0-100 and that high is bigger than low")
+func parseBytesFlag(name, value string) int64 {
+	bytes, err := helpers.ParseBytes(value)
+	if err != nil {
+		log.WithField("error", err).Error("-" + name + " not valid")
 		flag.Usage()
 		os.Exit(2)
 	}
+	return bytes
 }
 
 func initBugSnag(bugsnagKey string) {
@@ -2,6 +2,10 @@ package main
 
 import (
 	"flag"
+	"os"
+	"pkg/gc"
+	"pkg/notify"
+	"strings"
 	"testing"
 	"time"
 
@@ -30,3 +34,213 @@ func TestParseFlagsWithBadParams(t *testing.T) {
 	parseFlags()
 	assert.NotEqual(t, gcPolicy.TtlContainers.String(), 0, "Command parsing failed")
 }
+
+// resetFlags replaces the command line with a fresh one holding every flag at
+// its default, so flag.Visit in parseFlags only sees the flags of a case.
+// Flags of the testing package keep their values
+func resetFlags() {
+	previous := flag.CommandLine
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	previous.VisitAll(func(f *flag.Flag) {
+		if !strings.HasPrefix(f.Name, "test.") {
+			f.Value.Set(f.DefValue)
+		}
+		flag.CommandLine.Var(f.Value, f.Name, f.Usage)
+	})
+}
+
+func TestParseFlags(t *testing.T) {
+	defer resetFlags()
+
+	tests := []struct {
+		name  string
+		flags map[string]string
+		check func(t *testing.T)
+	}{
+		{"webhook", map[string]string{
+			"webhook_url":     "http://127.0.0.1:8080/hook",
+			"webhook_headers": "Authorization:Bearer xyz,X-Env: prod",
+			"webhook_events":  "run_failed",
+		}, func(t *testing.T) {
+			assert.Equal(t, "http://127.0.0.1:8080/hook", webhook.URL, "Webhook URL parsing didn't succeed")
+			assert.Equal(t, map[string]string{"Authorization": "Bearer xyz", "X-Env": "prod"}, webhook.Headers, "Webhook headers parsing didn't succeed")
+			assert.Equal(t, []notify.Event{notify.RunFailed}, webhook.Events, "Webhook events parsing didn't succeed")
+		}},
+		{"max deletions", map[string]string{
+			"max_deletions":  "100",
+			"webhook_events": "deletion_cap_reached",
+		}, func(t *testing.T) {
+			assert.Equal(t, 100, gcPolicy.MaxDeletions, "Max deletions parsing didn't succeed")
+			assert.Equal(t, []notify.Event{notify.DeletionCapReached}, webhook.Events, "Deletion cap event parsing didn't succeed")
+		}},
+		{"fallback", map[string]string{
+			"images_ttl":              "10h",
+			"fallback_containers_ttl": "0s",
+		}, func(t *testing.T) {
+			if assert.NotNil(t, gcPolicy.Fallback, "Setting a fallback TTL enables fallback") {
+				assert.Equal(t, time.Duration(0), gcPolicy.Fallback.TtlContainers, "Fallback containers TTL parsing didn't succeed")
+				assert.Equal(t, 10*time.Hour, gcPolicy.Fallback.TtlImages, "Fallback images TTL should default to the regular one")
+			}
+		}},
+		{"no fallback", map[string]string{}, func(t *testing.T) {
+			assert.Nil(t, gcPolicy.Fallback, "Fallback is disabled by default")
+			assert.Nil(t, gcPolicy.TtlDanglingImages, "Dangling images share the images TTL by default")
+			assert.Nil(t, gcPolicy.TtlCreatedContainers, "Created containers aren't collected by default")
+			assert.False(t, gcPolicy.PruneBuildCache, "Build cache isn't pruned by default")
+		}},
+		{"log cleanup", map[string]string{
+			"max_log_size":  "500MiB",
+			"log_keep_tail": "10KiB",
+		}, func(t *testing.T) {
+			assert.Equal(t, int64(500<<20), gcPolicy.MaxLogSize, "Max log size parsing didn't succeed")
+			assert.Equal(t, int64(10<<10), gcPolicy.LogKeepTail, "Log keep tail parsing didn't succeed")
+		}},
+		{"build cache", map[string]string{
+			"build_cache_ttl":          "48h",
+			"build_cache_keep_storage": "20GiB",
+		}, func(t *testing.T) {
+			assert.True(t, gcPolicy.PruneBuildCache, "Setting build cache flags enables pruning")
+			assert.Equal(t, 48*time.Hour, gcPolicy.TtlBuildCache, "Build cache TTL parsing didn't succeed")
+			assert.Equal(t, int64(20<<30), gcPolicy.BuildCacheKeepStorage, "Build cache keep storage parsing didn't succeed")
+		}},
+		{"dangling images ttl", map[string]string{
+			"dangling_images_ttl": "1m",
+		}, func(t *testing.T) {
+			if assert.NotNil(t, gcPolicy.TtlDanglingImages, "Setting dangling images TTL should separate it from images TTL") {
+				assert.Equal(t, 1*time.Minute, *gcPolicy.TtlDanglingImages, "Dangling images TTL parsing didn't succeed")
+			}
+		}},
+		{"tag gc", map[string]string{
+			"tag_gc":         "true",
+			"protected_tags": "*:production,*:latest",
+		}, func(t *testing.T) {
+			assert.True(t, gcPolicy.TagGC, "Tag GC parsing didn't succeed")
+			assert.Equal(t, []string{"*:production", "*:latest"}, gcPolicy.ProtectedTags, "Protected tags parsing didn't succeed")
+		}},
+		{"container rules", map[string]string{
+			"container_rules": "exit=nonzero,ttl=24h;name=ci-*,ttl=0s,volumes=true",
+		}, func(t *testing.T) {
+			assert.Equal(t, []gc.ContainerRule{
+				{Exit: gc.ExitNonZero, Ttl: 24 * time.Hour},
+				{Name: "ci-*", RemoveVolumes: true},
+			}, gcPolicy.ContainerRules, "Container rules parsing didn't succeed")
+		}},
+		{"created containers ttl", map[string]string{
+			"created_containers_ttl": "6h",
+		}, func(t *testing.T) {
+			if assert.NotNil(t, gcPolicy.TtlCreatedContainers, "Setting created containers TTL enables collecting them") {
+				assert.Equal(t, 6*time.Hour, *gcPolicy.TtlCreatedContainers, "Created containers TTL parsing didn't succeed")
+			}
+		}},
+		{"filesystems", map[string]string{
+			"filesystems":          "/var/lib/docker/containers:logs:90:80",
+			"discover_filesystems": "true",
+		}, func(t *testing.T) {
+			assert.True(t, gcPolicy.DiscoverFilesystems, "Discover filesystems parsing didn't succeed")
+			assert.Equal(t, []gc.Filesystem{
+				{Path: "/var/lib/docker/containers", Resources: []string{gc.ResourceLogs}, HighDiskSpaceThreshold: 90, LowDiskSpaceThreshold: 80},
+			}, gcPolicy.Filesystems, "Filesystems parsing didn't succeed")
+		}},
+		{"inode thresholds", map[string]string{
+			"high_inode_threshold": "90",
+			"low_inode_threshold":  "80",
+		}, func(t *testing.T) {
+			assert.Equal(t, 90.0, gcPolicy.HighInodeThreshold, "High inode threshold parsing didn't succeed")
+			assert.Equal(t, 80.0, gcPolicy.LowInodeThreshold, "Low inode threshold parsing didn't succeed")
+		}},
+		{"free space thresholds", map[string]string{
+			"high_disk_space_threshold": "20GiB free",
+			"low_disk_space_threshold":  "40GiB free",
+		}, func(t *testing.T) {
+			assert.Equal(t, int64(20<<30), gcPolicy.HighDiskSpaceFree, "High free space threshold parsing didn't succeed")
+			assert.Equal(t, int64(40<<30), gcPolicy.LowDiskSpaceFree, "Low free space threshold parsing didn't succeed")
+		}},
+		{"percentage thresholds", map[string]string{
+			"high_disk_space_threshold": "85.5",
+			"low_disk_space_threshold":  "50.25%",
+		}, func(t *testing.T) {
+			assert.Equal(t, 85.5, gcPolicy.HighDiskSpaceThreshold, "Sub-percent threshold parsing didn't succeed")
+			assert.Equal(t, int64(0), gcPolicy.HighDiskSpaceFree, "Percentage threshold doesn't set free space")
+			assert.Equal(t, 50.25, gcPolicy.LowDiskSpaceThreshold, "Percentage threshold with % sign parsing didn't succeed")
+		}},
+		{"prediction", map[string]string{
+			"prediction_horizon": "15m",
+			"prediction_window":  "30m",
+		}, func(t *testing.T) {
+			assert.Equal(t, 15*time.Minute, gcPolicy.PredictionHorizon, "Prediction horizon parsing didn't succeed")
+			assert.Equal(t, 30*time.Minute, gcPolicy.PredictionWindow, "Prediction window parsing didn't succeed")
+		}},
+		{"adaptive interval", map[string]string{
+			"min_interval":    "10s",
+			"max_interval":    "5m",
+			"interval_jitter": "0.2",
+		}, func(t *testing.T) {
+			assert.Equal(t, gc.AdaptiveInterval{Min: 10 * time.Second, Max: 5 * time.Minute, Jitter: 0.2}, adaptiveInterval, "Adaptive interval parsing didn't succeed")
+			assert.Equal(t, 15*time.Minute, staleAfter(), "Health goes stale after three max intervals")
+		}},
+		{"schedules", map[string]string{
+			"schedules":           "images=0 2 * * *;containers=*/5 * * * *",
+			"maintenance_windows": "deny images mon-fri 09:00-18:00",
+			"timezone":            "UTC",
+		}, func(t *testing.T) {
+			if assert.Equal(t, 2, len(schedules), "Schedules parsing didn't succeed") {
+				assert.Equal(t, "0 2 * * *", schedules[0].Cron.String(), "Schedule cron expression parsing didn't succeed")
+			}
+			if assert.Equal(t, 1, len(gcPolicy.MaintenanceWindows), "Maintenance windows parsing didn't succeed") {
+				assert.Equal(t, "deny images mon-fri 09:00-18:00", gcPolicy.MaintenanceWindows[0].String(), "Maintenance window parsing didn't succeed")
+			}
+			assert.Equal(t, time.Duration(0), staleAfter(), "Staleness isn't checked with schedules")
+		}},
+		{"scheduler", map[string]string{
+			"missed_runs": "queue",
+			"run_timeout": "30m",
+		}, func(t *testing.T) {
+			assert.Equal(t, gc.QueueMissedRuns, missedRuns, "Missed runs parsing didn't succeed")
+			assert.Equal(t, 30*time.Minute, runTimeout, "Run timeout parsing didn't succeed")
+		}},
+		{"sweep lock", map[string]string{
+			"lock_file":       "/var/run/docker-gc.lock",
+			"lock_contention": "preempt",
+		}, func(t *testing.T) {
+			assert.Equal(t, "/var/run/docker-gc.lock", lockPath, "Lock file parsing didn't succeed")
+			assert.Equal(t, gc.PreemptLock, lockContention, "Lock contention parsing didn't succeed")
+		}},
+		{"api address", map[string]string{
+			"api_address": "unix:///var/run/docker-gc.sock",
+		}, func(t *testing.T) {
+			assert.Equal(t, "unix:///var/run/docker-gc.sock", apiAddress, "API address parsing didn't succeed")
+		}},
+		{"health", map[string]string{
+			"health_stale_after":   "10m",
+			"healthcheck_endpoint": "/readyz",
+		}, func(t *testing.T) {
+			assert.Equal(t, 10*time.Minute, staleAfter(), "Health stale after parsing didn't succeed")
+			assert.Equal(t, "/readyz", healthcheckEndpoint, "Healthcheck endpoint parsing didn't succeed")
+		}},
+		{"reconnect backoff", map[string]string{
+			"max_reconnect_backoff": "5m",
+		}, func(t *testing.T) {
+			assert.Equal(t, 5*time.Minute, maxReconnectBackoff, "Max reconnect backoff parsing didn't succeed")
+		}},
+		{"statsd tags", map[string]string{
+			"statsd_tags":             "env:prod,role:ci",
+			"statsd_max_repositories": "10",
+		}, func(t *testing.T) {
+			assert.Equal(t, []string{"env:prod", "role:ci"}, statsdTags, "Statsd tags parsing didn't succeed")
+			assert.Equal(t, 10, gc.StatsdRepositoryLimit, "Statsd max repositories parsing didn't succeed")
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resetFlags()
+			for name, value := range test.flags {
+				if err := flag.Set(name, value); err != nil {
+					t.Fatalf("setting -%s=%s: %v", name, value, err)
+				}
+			}
+			parseFlags()
+			test.check(t)
+		})
+	}
+}
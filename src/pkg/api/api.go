@@ -0,0 +1,330 @@
+// Package api is the local HTTP API of the continuous modes for triggering
+// sweeps, pausing the scheduled ones and querying the state of the daemon.
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"pkg/gc"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const unixPrefix = "unix://"
+
+// Server serves the API of a daemon running its sweeps with the scheduler
+type Server struct {
+	Scheduler *gc.Scheduler
+	Policy    gc.GCPolicy
+	// Sweep runs a sweep of the mode of the daemon with the policy
+	Sweep func(gc.GCPolicy)
+	// Plan returns what a sweep with the policy would delete without deleting
+	Plan func(gc.GCPolicy) ([]gc.InventoryEntry, error)
+	// Ping checks the Docker daemon answers
+	Ping func() error
+	// The daemon isn't healthy when it hasn't swept successfully for this
+	// long, zero never makes it unhealthy
+	StaleAfter time.Duration
+
+	started     time.Time
+	lastReport  *gc.Report
+	lastSuccess time.Time
+	lastError   string
+	lastErrorAt time.Time
+	lock        sync.Mutex
+}
+
+// PolicyOverride replaces parts of the policy of the daemon for a single
+// sweep or plan, durations and thresholds are in the format of the flags
+type PolicyOverride struct {
+	ImagesTtl              string `json:"imagesTtl"`
+	DanglingImagesTtl      string `json:"danglingImagesTtl"`
+	ContainersTtl          string `json:"containersTtl"`
+	HighDiskSpaceThreshold string `json:"highDiskSpaceThreshold"`
+	LowDiskSpaceThreshold  string `json:"lowDiskSpaceThreshold"`
+}
+
+// New returns the server of a daemon in the given mode, keeping the report of
+// the last run
+func New(scheduler *gc.Scheduler, mode string, policy gc.GCPolicy) *Server {
+	s := &Server{Scheduler: scheduler, Policy: policy, Plan: plan, Ping: pingDocker, started: time.Now()}
+	s.Sweep = func(policy gc.GCPolicy) { gc.CleanAll(gc.DatePolicy, policy) }
+	if mode == gc.DiskPolicy {
+		s.Sweep = gc.CleanAllWithDiskSpacePolicy
+	}
+	gc.AddReportHook(s.recordReport)
+	return s
+}
+
+// Listen listens on unix:///path or on a TCP address of the loopback
+// interface, the API is not authenticated
+func Listen(address string) (net.Listener, error) {
+	if strings.HasPrefix(address, unixPrefix) {
+		path := strings.TrimPrefix(address, unixPrefix)
+		// A socket left behind by a previous process
+		if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(path)
+		}
+		listener, err := net.Listen("unix", path)
+		if err == nil {
+			err = os.Chmod(path, 0600)
+		}
+		return listener, err
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("%s is not a loopback address, the API can only listen on localhost or a unix socket", address)
+	}
+	return net.Listen("tcp", address)
+}
+
+// Serve serves the API until the listener is closed
+func (s *Server) Serve(listener net.Listener) error {
+	log.WithField("address", listener.Addr().String()).Info("Control API listening")
+	return http.Serve(listener, s.Handler())
+}
+
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sweep", s.post(s.sweep))
+	mux.HandleFunc("/pause", s.post(s.pause))
+	mux.HandleFunc("/resume", s.post(s.resume))
+	mux.HandleFunc("/report", s.report)
+	mux.HandleFunc("/policy", s.policy)
+	mux.HandleFunc("/plan", s.plan)
+	mux.HandleFunc("/healthz", s.healthz)
+	mux.HandleFunc("/readyz", s.readyz)
+	return mux
+}
+
+func (s *Server) post(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("use POST"))
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// sweep triggers a sweep, with ?wait=true it responds with its report once it
+// has run
+func (s *Server) sweep(w http.ResponseWriter, r *http.Request) {
+	policy, err := s.requestPolicy(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	log.WithField("remote", r.RemoteAddr).Info("Sweep triggered through control API")
+	done := s.Scheduler.Trigger("api", func() { s.Sweep(policy) })
+	if r.URL.Query().Get("wait") != "true" {
+		writeJSON(w, http.StatusAccepted, map[string]bool{"triggered": true})
+		return
+	}
+	select {
+	case ran := <-done:
+		if !ran {
+			writeError(w, http.StatusServiceUnavailable, fmt.Errorf("sweep didn't run, the Docker daemon is down or docker-gc is stopping"))
+			return
+		}
+	case <-r.Context().Done():
+		// The sweep keeps running without the client
+		return
+	}
+	s.report(w, r)
+}
+
+func (s *Server) pause(w http.ResponseWriter, r *http.Request) {
+	s.Scheduler.Pause()
+	log.WithField("remote", r.RemoteAddr).Info("Scheduled runs paused through control API")
+	writeJSON(w, http.StatusOK, map[string]bool{"paused": true})
+}
+
+func (s *Server) resume(w http.ResponseWriter, r *http.Request) {
+	s.Scheduler.Resume()
+	log.WithField("remote", r.RemoteAddr).Info("Scheduled runs resumed through control API")
+	writeJSON(w, http.StatusOK, map[string]bool{"paused": false})
+}
+
+func (s *Server) report(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	report := s.lastReport
+	s.lock.Unlock()
+	if report == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no run has finished yet"))
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+func (s *Server) policy(w http.ResponseWriter, r *http.Request) {
+	view := policyView(s.Policy)
+	view["paused"] = s.Scheduler.Paused()
+	writeJSON(w, http.StatusOK, view)
+}
+
+// plan lists the images and containers a sweep would delete, past their TTL
+// and not in use. Diskspace mode deletes them oldest first only until the
+// low threshold is reached.
+func (s *Server) plan(w http.ResponseWriter, r *http.Request) {
+	policy, err := s.requestPolicy(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	entries, err := s.Plan(policy)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if entries == nil {
+		entries = []gc.InventoryEntry{}
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+func plan(policy gc.GCPolicy) ([]gc.InventoryEntry, error) {
+	entries, err := gc.Inventory(policy)
+	if err != nil {
+		return nil, err
+	}
+	entries, err = gc.FilterInventory(entries, []string{gc.FilterCandidates})
+	if err == nil {
+		err = gc.SortInventory(entries, gc.SortByCreated)
+	}
+	return entries, err
+}
+
+func (s *Server) recordReport(report gc.Report) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.lastReport = &report
+	if report.Error == "" {
+		s.lastSuccess = report.End
+	} else {
+		s.lastError, s.lastErrorAt = report.Error, report.End
+	}
+}
+
+// requestPolicy returns the policy of the daemon with the override of the
+// request body applied
+func (s *Server) requestPolicy(r *http.Request) (gc.GCPolicy, error) {
+	var override PolicyOverride
+	if r.Body != nil && r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&override); err != nil {
+			return s.Policy, fmt.Errorf("policy override is not valid JSON: %s", err)
+		}
+	}
+	return override.Apply(s.Policy)
+}
+
+// Apply returns the policy with the set fields of the override
+func (o PolicyOverride) Apply(policy gc.GCPolicy) (gc.GCPolicy, error) {
+	var err error
+	durations := []struct {
+		value  string
+		target *time.Duration
+	}{
+		{o.ImagesTtl, &policy.TtlImages},
+		{o.ContainersTtl, &policy.TtlContainers},
+	}
+	for _, d := range durations {
+		if d.value == "" {
+			continue
+		}
+		if *d.target, err = time.ParseDuration(d.value); err != nil {
+			return policy, err
+		}
+	}
+	if o.DanglingImagesTtl != "" {
+		ttl, err := time.ParseDuration(o.DanglingImagesTtl)
+		if err != nil {
+			return policy, err
+		}
+		policy.TtlDanglingImages = &ttl
+	}
+
+	if o.HighDiskSpaceThreshold != "" {
+		if policy.HighDiskSpaceThreshold, policy.HighDiskSpaceFree, err = gc.ParseThreshold(o.HighDiskSpaceThreshold); err != nil {
+			return policy, err
+		}
+	}
+	if o.LowDiskSpaceThreshold != "" {
+		if policy.LowDiskSpaceThreshold, policy.LowDiskSpaceFree, err = gc.ParseThreshold(o.LowDiskSpaceThreshold); err != nil {
+			return policy, err
+		}
+	}
+	err = gc.ValidateThresholds(policy.HighDiskSpaceThreshold, policy.HighDiskSpaceFree,
+		policy.LowDiskSpaceThreshold, policy.LowDiskSpaceFree)
+	return policy, err
+}
+
+// policyView is the policy with durations and thresholds formatted like the
+// flags
+func policyView(p gc.GCPolicy) map[string]interface{} {
+	view := map[string]interface{}{
+		"imagesTtl":              p.TtlImages.String(),
+		"containersTtl":          p.TtlContainers.String(),
+		"highDiskSpaceThreshold": gc.FormatThreshold(p.HighDiskSpaceThreshold, p.HighDiskSpaceFree),
+		"lowDiskSpaceThreshold":  gc.FormatThreshold(p.LowDiskSpaceThreshold, p.LowDiskSpaceFree),
+		"highInodeThreshold":     p.HighInodeThreshold,
+		"lowInodeThreshold":      p.LowInodeThreshold,
+		"tagGC":                  p.TagGC,
+		"protectedTags":          p.ProtectedTags,
+		"pruneBuildCache":        p.PruneBuildCache,
+		"buildCacheTtl":          p.TtlBuildCache.String(),
+		"buildCacheKeepStorage":  p.BuildCacheKeepStorage,
+		"maxLogSize":             p.MaxLogSize,
+		"logKeepTail":            p.LogKeepTail,
+		"rotateLogs":             p.RotateLogs,
+		"maxRotatedLogs":         p.MaxRotatedLogs,
+		"maxDeletions":           p.MaxDeletions,
+		"discoverFilesystems":    p.DiscoverFilesystems,
+		"predictionHorizon":      p.PredictionHorizon.String(),
+		"predictionWindow":       p.PredictionWindow.String(),
+		"containerRules":         stringsOf(len(p.ContainerRules), func(i int) string { return p.ContainerRules[i].String() }),
+		"filesystems":            stringsOf(len(p.Filesystems), func(i int) string { return p.Filesystems[i].String() }),
+		"maintenanceWindows":     stringsOf(len(p.MaintenanceWindows), func(i int) string { return p.MaintenanceWindows[i].String() }),
+	}
+	if p.TtlDanglingImages != nil {
+		view["danglingImagesTtl"] = p.TtlDanglingImages.String()
+	}
+	if p.TtlCreatedContainers != nil {
+		view["createdContainersTtl"] = p.TtlCreatedContainers.String()
+	}
+	if p.Fallback != nil {
+		view["fallback"] = policyView(*p.Fallback)
+	}
+	return view
+}
+
+func stringsOf(count int, format func(int) string) []string {
+	values := make([]string, count)
+	for i := range values {
+		values[i] = format(i)
+	}
+	return values
+}
+
+func writeJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		log.WithField("error", err).Warn("Writing control API response failed")
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
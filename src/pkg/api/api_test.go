@@ -0,0 +1,150 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"pkg/gc"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testAPI(t *testing.T) (*Server, *httptest.Server, *[]gc.GCPolicy) {
+	scheduler, _ := gc.NewScheduler(gc.SkipMissedRuns, 0)
+	var sweeps []gc.GCPolicy
+	s := &Server{
+		Scheduler: scheduler,
+		Policy:    gc.GCPolicy{TtlImages: time.Hour, TtlContainers: time.Minute, HighDiskSpaceThreshold: 85, LowDiskSpaceThreshold: 50},
+		Ping:      func() error { return nil },
+		started:   time.Now(),
+	}
+	s.Sweep = func(policy gc.GCPolicy) {
+		sweeps = append(sweeps, policy)
+		s.recordReport(gc.Report{Mode: gc.DatePolicy, Images: gc.ResourceReport{Deleted: len(sweeps)}})
+	}
+	s.Plan = func(policy gc.GCPolicy) ([]gc.InventoryEntry, error) {
+		if policy.TtlImages == 0 {
+			return []gc.InventoryEntry{{Type: gc.Image, ID: "old", Collect: true}}, nil
+		}
+		return nil, nil
+	}
+	return s, httptest.NewServer(s.Handler()), &sweeps
+}
+
+func request(t *testing.T, method, url, body string, response interface{}) int {
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if response != nil {
+		json.NewDecoder(resp.Body).Decode(response)
+	}
+	return resp.StatusCode
+}
+
+func TestSweep(t *testing.T) {
+	s, server, sweeps := testAPI(t)
+	defer server.Close()
+	defer s.Scheduler.Stop()
+
+	assert.Equal(t, http.StatusNotFound, request(t, "GET", server.URL+"/report", "", nil), "no report before the first run")
+	assert.Equal(t, http.StatusMethodNotAllowed, request(t, "GET", server.URL+"/sweep", "", nil), "sweep is triggered with POST")
+
+	var report gc.Report
+	assert.Equal(t, http.StatusOK, request(t, "POST", server.URL+"/sweep?wait=true", `{"imagesTtl": "10m"}`, &report), "sweep succeeds")
+	assert.Equal(t, 1, report.Images.Deleted, "waiting sweep responds with its report")
+	assert.Equal(t, 10*time.Minute, (*sweeps)[0].TtlImages, "sweep has the policy override")
+	assert.Equal(t, time.Minute, (*sweeps)[0].TtlContainers, "sweep has the policy of the daemon")
+
+	assert.Equal(t, http.StatusAccepted, request(t, "POST", server.URL+"/sweep", "", nil), "sweep is triggered without waiting")
+	assert.Equal(t, http.StatusBadRequest, request(t, "POST", server.URL+"/sweep", `{"imagesTtl": "soon"}`, nil), "override must be valid")
+	assert.Equal(t, http.StatusBadRequest, request(t, "POST", server.URL+"/sweep", `{"lowDiskSpaceThreshold": "90"}`, nil), "override thresholds must be valid")
+
+	assert.Equal(t, http.StatusOK, request(t, "GET", server.URL+"/report", "", &report), "last report is available")
+}
+
+func TestSweepNotRun(t *testing.T) {
+	s, server, sweeps := testAPI(t)
+	defer server.Close()
+	s.recordReport(gc.Report{Mode: gc.DatePolicy})
+	s.Scheduler.Stop()
+
+	assert.Equal(t, http.StatusServiceUnavailable, request(t, "POST", server.URL+"/sweep?wait=true", "", nil), "sweep that didn't run isn't reported as the previous one")
+	assert.Equal(t, 0, len(*sweeps), "stopped scheduler doesn't sweep")
+}
+
+func TestSweepClientGone(t *testing.T) {
+	s, server, _ := testAPI(t)
+	defer server.Close()
+	defer s.Scheduler.Stop()
+	release := make(chan struct{})
+	defer close(release)
+	s.Sweep = func(gc.GCPolicy) { <-release }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest("POST", "/sweep?wait=true", nil).WithContext(ctx)
+	handled := make(chan struct{})
+	go func() {
+		s.Handler().ServeHTTP(httptest.NewRecorder(), req)
+		close(handled)
+	}()
+	cancel()
+	select {
+	case <-handled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler waits for the sweep after the client is gone")
+	}
+}
+
+func TestPauseAndPolicy(t *testing.T) {
+	s, server, _ := testAPI(t)
+	defer server.Close()
+	defer s.Scheduler.Stop()
+
+	assert.Equal(t, http.StatusOK, request(t, "POST", server.URL+"/pause", "", nil), "pausing succeeds")
+	assert.True(t, s.Scheduler.Paused(), "scheduled runs are paused")
+
+	var policy map[string]interface{}
+	request(t, "GET", server.URL+"/policy", "", &policy)
+	assert.Equal(t, "1h0m0s", policy["imagesTtl"], "policy has durations formatted")
+	assert.Equal(t, "85%", policy["highDiskSpaceThreshold"], "policy has thresholds formatted")
+	assert.Equal(t, true, policy["paused"], "policy tells the runs are paused")
+
+	assert.Equal(t, http.StatusOK, request(t, "POST", server.URL+"/resume", "", nil), "resuming succeeds")
+	assert.False(t, s.Scheduler.Paused(), "scheduled runs are resumed")
+}
+
+func TestPlan(t *testing.T) {
+	s, server, sweeps := testAPI(t)
+	defer server.Close()
+	defer s.Scheduler.Stop()
+
+	var entries []gc.InventoryEntry
+	assert.Equal(t, http.StatusOK, request(t, "GET", server.URL+"/plan", "", &entries), "plan succeeds")
+	assert.Equal(t, 0, len(entries), "nothing is past the TTL of the daemon")
+
+	request(t, "POST", server.URL+"/plan", `{"imagesTtl": "0s"}`, &entries)
+	assert.Equal(t, 1, len(entries), "plan has the policy override")
+	assert.Equal(t, 0, len(*sweeps), "plan doesn't sweep")
+}
+
+func TestListen(t *testing.T) {
+	listener, err := Listen("127.0.0.1:0")
+	assert.Nil(t, err, "listening on loopback succeeds")
+	listener.Close()
+
+	_, err = Listen("0.0.0.0:0")
+	assert.NotNil(t, err, "listening on all interfaces is not allowed")
+
+	path := fmt.Sprintf("/tmp/docker-gc-api-%d.sock", time.Now().UnixNano())
+	listener, err = Listen(unixPrefix + path)
+	assert.Nil(t, err, "listening on unix socket succeeds")
+	listener.Close()
+}
@@ -0,0 +1,105 @@
+package api
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"pkg/gc"
+	"strings"
+	"time"
+)
+
+// Health is the state of the daemon reported by /healthz and /readyz
+type Health struct {
+	Healthy         bool   `json:"healthy"`
+	Ready           bool   `json:"ready"`
+	DockerReachable bool   `json:"dockerReachable"`
+	DockerError     string `json:"dockerError,omitempty"`
+	// Since the start of the daemon until the first successful sweep
+	SinceLastSuccessfulSweep string     `json:"sinceLastSuccessfulSweep"`
+	LastSuccessfulSweep      *time.Time `json:"lastSuccessfulSweep,omitempty"`
+	StaleAfter               string     `json:"staleAfter"`
+	LastError                string     `json:"lastError,omitempty"`
+	LastErrorAt              *time.Time `json:"lastErrorAt,omitempty"`
+}
+
+func pingDocker() error {
+	if gc.Client == nil {
+		return fmt.Errorf("Docker client is not started")
+	}
+	return gc.Client.Ping()
+}
+
+// health tells the daemon is healthy while it has swept successfully within
+// StaleAfter, and ready while it's healthy and the daemon answers
+func (s *Server) health() Health {
+	s.lock.Lock()
+	lastSuccess, lastError, lastErrorAt := s.lastSuccess, s.lastError, s.lastErrorAt
+	s.lock.Unlock()
+
+	since := time.Since(s.started)
+	health := Health{StaleAfter: s.StaleAfter.String(), LastError: lastError}
+	if !lastSuccess.IsZero() {
+		since = time.Since(lastSuccess)
+		health.LastSuccessfulSweep = &lastSuccess
+	}
+	if !lastErrorAt.IsZero() {
+		health.LastErrorAt = &lastErrorAt
+	}
+	health.SinceLastSuccessfulSweep = since.String()
+	health.Healthy = s.StaleAfter == 0 || since <= s.StaleAfter
+
+	if err := s.Ping(); err != nil {
+		health.DockerError = err.Error()
+	} else {
+		health.DockerReachable = true
+	}
+	health.Ready = health.Healthy && health.DockerReachable
+	return health
+}
+
+func (s *Server) healthz(w http.ResponseWriter, r *http.Request) {
+	health := s.health()
+	writeJSON(w, healthStatus(health.Healthy), health)
+}
+
+func (s *Server) readyz(w http.ResponseWriter, r *http.Request) {
+	health := s.health()
+	writeJSON(w, healthStatus(health.Ready), health)
+}
+
+func healthStatus(ok bool) int {
+	if ok {
+		return http.StatusOK
+	}
+	return http.StatusServiceUnavailable
+}
+
+// Check requests the endpoint of the API on the address and fails unless it
+// responds OK, for running as a HEALTHCHECK of a container
+func Check(address, endpoint string, timeout time.Duration) (string, error) {
+	client := &http.Client{Timeout: timeout}
+	url := "http://" + address + endpoint
+	if strings.HasPrefix(address, unixPrefix) {
+		path := strings.TrimPrefix(address, unixPrefix)
+		client.Transport = &http.Transport{
+			Dial: func(_, _ string) (net.Conn, error) { return net.Dial("unix", path) },
+		}
+		url = "http://localhost" + endpoint
+	}
+
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return string(body), fmt.Errorf("%s responded %s", endpoint, resp.Status)
+	}
+	return string(body), nil
+}
@@ -0,0 +1,71 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"pkg/gc"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealth(t *testing.T) {
+	s, server, _ := testAPI(t)
+	defer server.Close()
+	defer s.Scheduler.Stop()
+
+	var health Health
+	assert.Equal(t, http.StatusOK, request(t, "GET", server.URL+"/healthz", "", &health), "healthy without staleness threshold")
+	assert.True(t, health.DockerReachable, "Docker is reachable")
+	assert.Nil(t, health.LastSuccessfulSweep, "no sweep has finished")
+
+	s.StaleAfter = time.Minute
+	s.started = time.Now().Add(-2 * time.Minute)
+	assert.Equal(t, http.StatusServiceUnavailable, request(t, "GET", server.URL+"/healthz", "", nil), "unhealthy without a sweep within the threshold")
+
+	s.recordReport(gc.Report{End: time.Now().Add(-30 * time.Second)})
+	assert.Equal(t, http.StatusOK, request(t, "GET", server.URL+"/healthz", "", &health), "healthy after a recent sweep")
+	assert.NotNil(t, health.LastSuccessfulSweep, "last successful sweep is reported")
+
+	s.recordReport(gc.Report{End: time.Now(), Error: "daemon went away"})
+	request(t, "GET", server.URL+"/readyz", "", &health)
+	assert.Equal(t, "daemon went away", health.LastError, "last error is reported")
+	assert.True(t, health.Ready, "failed sweep doesn't reset the last successful one")
+
+	s.recordReport(gc.Report{End: time.Now().Add(-2 * time.Minute)})
+	assert.Equal(t, http.StatusServiceUnavailable, request(t, "GET", server.URL+"/readyz", "", nil), "stale daemon isn't ready")
+
+	s.recordReport(gc.Report{End: time.Now()})
+	s.Ping = func() error { return fmt.Errorf("connection refused") }
+	assert.Equal(t, http.StatusOK, request(t, "GET", server.URL+"/healthz", "", nil), "unreachable Docker doesn't make it unhealthy")
+	assert.Equal(t, http.StatusServiceUnavailable, request(t, "GET", server.URL+"/readyz", "", &health), "unreachable Docker makes it not ready")
+	assert.Equal(t, "connection refused", health.DockerError, "Docker error is reported")
+}
+
+func TestCheck(t *testing.T) {
+	s, server, _ := testAPI(t)
+	defer server.Close()
+	defer s.Scheduler.Stop()
+	address := strings.TrimPrefix(server.URL, "http://")
+
+	_, err := Check(address, "/healthz", time.Second)
+	assert.Nil(t, err, "check of healthy daemon succeeds")
+
+	s.Ping = func() error { return fmt.Errorf("connection refused") }
+	body, err := Check(address, "/readyz", time.Second)
+	assert.NotNil(t, err, "check of daemon not ready fails")
+	assert.Contains(t, body, "connection refused", "check returns the response")
+
+	path := fmt.Sprintf("/tmp/docker-gc-health-%d.sock", time.Now().UnixNano())
+	listener, err := Listen(unixPrefix + path)
+	assert.Nil(t, err, "listening on unix socket succeeds")
+	defer listener.Close()
+	go http.Serve(listener, s.Handler())
+	_, err = Check(unixPrefix+path, "/healthz", time.Second)
+	assert.Nil(t, err, "check over unix socket succeeds")
+
+	_, err = Check("127.0.0.1:1", "/healthz", time.Second)
+	assert.NotNil(t, err, "check fails when nothing listens")
+}
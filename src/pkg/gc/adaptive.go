@@ -0,0 +1,97 @@
+package gc
+
+import (
+	"math/rand"
+	"pkg/statsd"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// AdaptiveInterval runs diskspace mode more often the closer the used disk
+// space is to the high threshold
+type AdaptiveInterval struct {
+	// Interval at the high threshold and at or below the low threshold
+	Min time.Duration
+	Max time.Duration
+	// Fraction of the interval randomly added or removed so hosts started at
+	// the same time don't check their disks at the same time, eg. 0.1
+	Jitter float64
+}
+
+var jitterRandom = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+// AdaptiveDiskSpaceGC runs the diskspace mode cleanup with the interval
+// adapting to the used disk space
+func AdaptiveDiskSpaceGC(scheduler *Scheduler, adaptive AdaptiveInterval, policy GCPolicy) {
+	diskSpaceFetcher = &DiskSpaceFetcher{}
+	first := true
+	next := func(now time.Time) time.Time {
+		if first {
+			first = false
+			return now.Add(adaptive.Min)
+		}
+		// Called once the previous run has finished, so the pressure is
+		// what its cleanup left
+		interval := adaptive.next(diskPressure(policy), jitterRandom.Float64())
+		log.WithFields(log.Fields{
+			"interval": interval,
+			"nextRun":  now.Add(interval).Format(time.RFC3339),
+		}).Info("Next diskspace run scheduled")
+		statsd.TaggedGauge("gc.interval", interval.Seconds(), []string{policyTag(DiskPolicy)}, StatsdSamplingRate)
+		return now.Add(interval)
+	}
+	scheduler.ScheduleAfterRun(DiskPolicy, next, func() { CleanAllWithDiskSpacePolicy(policy) })
+
+	log.WithFields(log.Fields{
+		"minInterval": adaptive.Min,
+		"maxInterval": adaptive.Max,
+		"jitter":      adaptive.Jitter,
+	}).Info("Continous run started in diskspace mode with adaptive interval")
+}
+
+// next returns the interval for the pressure between 0 at the low threshold
+// and 1 at the high threshold, jittered with random between 0 and 1. The band
+// is narrowed by the jitter first so jittered intervals spread up to Max and
+// down to Min rather than piling up on them.
+func (a AdaptiveInterval) next(pressure, random float64) time.Duration {
+	low, high := float64(a.Min)/(1-a.Jitter), float64(a.Max)/(1+a.Jitter)
+	if low > high {
+		low, high = float64(a.Min), float64(a.Max)
+	}
+	interval := high - pressure*(high-low)
+	interval += interval * a.Jitter * (2*random - 1)
+	if interval < float64(a.Min) {
+		return a.Min
+	}
+	if interval > float64(a.Max) {
+		return a.Max
+	}
+	return time.Duration(interval)
+}
+
+// diskPressure returns the highest pressure of the monitored filesystems,
+// full pressure when the usage can't be read so it's checked again soon
+func diskPressure(policy GCPolicy) float64 {
+	filesystems := monitoredFilesystems(policy)
+	if len(filesystems) == 0 {
+		filesystems = []Filesystem{{}}
+	}
+
+	highest := 0.0
+	for _, filesystem := range filesystems {
+		disk := diskSpaceFetcher
+		if filesystem.Path != "" {
+			disk = newDiskSpaceFetcher(filesystem.Path)
+		}
+		usage, err := disk.GetDiskUsage()
+		if err != nil {
+			log.WithField("error", err).Error("Reading disk space failed")
+			return 1
+		}
+		if pressure := filesystem.policy(policy).pressure(usage); pressure > highest {
+			highest = pressure
+		}
+	}
+	return highest
+}
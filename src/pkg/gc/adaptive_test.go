@@ -0,0 +1,61 @@
+package gc
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdaptiveInterval(t *testing.T) {
+	adaptive := AdaptiveInterval{Min: 10 * time.Second, Max: 110 * time.Second}
+	assert.Equal(t, 110*time.Second, adaptive.next(0, 0.5), "max interval far below high threshold")
+	assert.Equal(t, 60*time.Second, adaptive.next(0.5, 0.5), "interval shortens towards high threshold")
+	assert.Equal(t, 10*time.Second, adaptive.next(1, 0.5), "min interval at high threshold")
+
+	adaptive.Jitter = 0.1
+	middle := adaptive.next(0.5, 0.5)
+	assert.InDelta(t, middle.Seconds()*0.9, adaptive.next(0.5, 0).Seconds(), 0.001, "jitter removes up to the fraction")
+	assert.InDelta(t, middle.Seconds()*1.1, adaptive.next(0.5, 1).Seconds(), 0.001, "jitter adds up to the fraction")
+
+	adaptive.Min, adaptive.Max = 50*time.Second, 55*time.Second
+	assert.Equal(t, 50*time.Second, adaptive.next(1, 0), "jitter doesn't go below min interval when the band is too narrow")
+	assert.Equal(t, 55*time.Second, adaptive.next(0, 1), "jitter doesn't go above max interval when the band is too narrow")
+}
+
+func TestAdaptiveIntervalJitterSpreadsAtBothEnds(t *testing.T) {
+	adaptive := AdaptiveInterval{Min: 10 * time.Second, Max: 110 * time.Second, Jitter: 0.1}
+	for _, pressure := range []float64{0, 1} {
+		intervals := map[time.Duration]bool{}
+		atBound := 0
+		for i := 0; i <= 100; i++ {
+			interval := adaptive.next(pressure, float64(i)/100)
+			assert.True(t, interval >= adaptive.Min && interval <= adaptive.Max, "jittered interval stays within min and max")
+			if interval == adaptive.Min || interval == adaptive.Max {
+				atBound++
+			}
+			intervals[interval] = true
+		}
+		assert.True(t, atBound <= 1, fmt.Sprintf("jittered intervals don't pile up on the bound at pressure %v", pressure))
+		assert.Equal(t, 101, len(intervals), fmt.Sprintf("jittered intervals are spread at pressure %v", pressure))
+	}
+	assert.InDelta(t, 110, adaptive.next(0, 1).Seconds(), 0.001, "jitter reaches max interval")
+	assert.InDelta(t, 10, adaptive.next(1, 0).Seconds(), 0.001, "jitter reaches min interval")
+}
+
+func TestDiskPressure(t *testing.T) {
+	policy := GCPolicy{HighDiskSpaceThreshold: 90, LowDiskSpaceThreshold: 50}
+	assert.Equal(t, 0.0, policy.pressure(DiskUsage{BytesUsedPercent: 40}), "no pressure below low threshold")
+	assert.Equal(t, 0.5, policy.pressure(DiskUsage{BytesUsedPercent: 70}), "pressure between thresholds")
+	assert.Equal(t, 1.0, policy.pressure(DiskUsage{BytesUsedPercent: 95}), "full pressure above high threshold")
+	assert.Equal(t, 0.75, policy.pressure(DiskUsage{BytesUsedPercent: 60, InodesUsedPercent: 80}), "inode pressure counts")
+
+	policy = GCPolicy{HighDiskSpaceFree: 10 << 30, LowDiskSpaceFree: 30 << 30}
+	assert.Equal(t, 0.5, policy.pressure(DiskUsage{BytesUsed: 80 << 30, BytesTotal: 100 << 30}), "free space pressure")
+
+	previous := diskSpaceFetcher
+	defer func() { diskSpaceFetcher = previous }()
+	diskSpaceFetcher = fixedDiskSpaceFetcher(70)
+	assert.Equal(t, 0.5, diskPressure(GCPolicy{HighDiskSpaceThreshold: 90, LowDiskSpaceThreshold: 50}), "pressure of the Docker root")
+}
@@ -0,0 +1,153 @@
+package gc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"pkg/helpers"
+	"pkg/statsd"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/fsouza/go-dockerclient"
+)
+
+// dockerEndpoint is kept for the API calls the Docker client doesn't support
+var dockerEndpoint string
+
+var (
+	// buildCachePruneTimeout fails a prune the daemon doesn't answer, so a
+	// stuck daemon doesn't hold the sweep lock forever
+	buildCachePruneTimeout = 10 * time.Minute
+	// socketClients are reused so each call doesn't leave a transport with
+	// its idle connections behind
+	socketClients     = map[string]*http.Client{}
+	socketClientsLock sync.Mutex
+)
+
+type buildCachePruneResponse struct {
+	CachesDeleted  []string
+	SpaceReclaimed int64
+}
+
+// pruneBuildCache asks the daemon to remove the build cache not used within
+// the TTL of the policy while keeping at most BuildCacheKeepStorage bytes of it.
+// Requires Docker API 1.39 or newer.
+func pruneBuildCache(policy GCPolicy, report *Report) {
+	defer timePhase(phaseDeletion)()
+	query := url.Values{}
+	if policy.TtlBuildCache > 0 {
+		filters, _ := json.Marshal(map[string][]string{"until": {policy.TtlBuildCache.String()}})
+		query.Set("filters", string(filters))
+	}
+	if policy.BuildCacheKeepStorage > 0 {
+		query.Set("keep-storage", strconv.FormatInt(policy.BuildCacheKeepStorage, 10))
+	}
+
+	fields := log.Fields{
+		"ttl":         policy.TtlBuildCache,
+		"keepStorage": helpers.FormatBytes(policy.BuildCacheKeepStorage),
+	}
+	tags := []string{resourceTag(ResourceBuildCache), policyTag(report.Mode)}
+	pruned, err := postBuildCachePrune(query)
+	countDeletion(ResourceBuildCache, report.Mode, "", err)
+	if err != nil {
+		fields["error"] = err
+		log.WithFields(fields).Error("Build cache pruning error")
+		statsd.Count("buildcache.prune.error", 1, tags, StatsdSamplingRate)
+		report.BuildCache.Candidates++
+		report.BuildCache.Failed++
+		return
+	}
+
+	fields["deleted"] = len(pruned.CachesDeleted)
+	fields["reclaimed"] = helpers.FormatBytes(pruned.SpaceReclaimed)
+	log.WithFields(fields).Info("Pruned build cache")
+	statsd.Count("buildcache.deleted", int64(len(pruned.CachesDeleted)), tags, StatsdSamplingRate)
+	statsd.Count("buildcache.reclaimed_bytes", pruned.SpaceReclaimed, tags, StatsdSamplingRate)
+
+	report.BuildCache.Candidates += len(pruned.CachesDeleted)
+	report.BuildCache.Deleted += len(pruned.CachesDeleted)
+	report.EstimatedBytesReclaimed += pruned.SpaceReclaimed
+}
+
+func postBuildCachePrune(query url.Values) (buildCachePruneResponse, error) {
+	var pruned buildCachePruneResponse
+
+	client, base, err := dockerHTTPClient()
+	if err != nil {
+		return pruned, err
+	}
+	req, err := http.NewRequest("POST", base+"/build/prune?"+query.Encode(), nil)
+	if err != nil {
+		return pruned, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	ctx, cancel := context.WithTimeout(context.Background(), buildCachePruneTimeout)
+	defer cancel()
+
+	finished := timeDockerCall("build.prune", ResourceBuildCache)
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		finished(err)
+		return pruned, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = &docker.Error{Status: resp.StatusCode, Message: resp.Status}
+		finished(err)
+		return pruned, fmt.Errorf("docker responded with %s", resp.Status)
+	}
+	finished(nil)
+	err = json.NewDecoder(resp.Body).Decode(&pruned)
+	return pruned, err
+}
+
+// dockerHTTPClient returns an HTTP client talking to dockerEndpoint and the
+// base URL to use with it. TCP endpoints go through the HTTP client of the
+// Docker client so they keep its TLS configuration.
+func dockerHTTPClient() (*http.Client, string, error) {
+	endpoint, err := url.Parse(dockerEndpoint)
+	if err != nil {
+		return nil, "", err
+	}
+
+	switch endpoint.Scheme {
+	case "unix":
+		return socketClient(endpoint.Path), "http://docker", nil
+	case "tcp", "http", "https":
+		if Client == nil || Client.HTTPClient == nil {
+			return nil, "", fmt.Errorf("Docker client is not started")
+		}
+		scheme := "http"
+		if endpoint.Scheme == "https" || Client.TLSConfig != nil {
+			scheme = "https"
+		}
+		return Client.HTTPClient, scheme + "://" + endpoint.Host, nil
+	default:
+		return nil, "", fmt.Errorf("%s is not supported docker endpoint", dockerEndpoint)
+	}
+}
+
+// socketClient returns the HTTP client dialing the unix socket, created once
+// per socket
+func socketClient(socket string) *http.Client {
+	socketClientsLock.Lock()
+	defer socketClientsLock.Unlock()
+	client, ok := socketClients[socket]
+	if !ok {
+		transport := &http.Transport{
+			Dial: func(_, _ string) (net.Conn, error) {
+				return net.Dial("unix", socket)
+			},
+		}
+		client = &http.Client{Transport: transport}
+		socketClients[socket] = client
+	}
+	return client
+}
@@ -0,0 +1,110 @@
+package gc
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCleanAllPrunesBuildCache(t *testing.T) {
+	responses := generateTestData(1, 1, t)
+	responses["/build/prune"] = []response{
+		{"POST", `filters={"until":["24h0m0s"]}`, `{"CachesDeleted": ["a", "b"], "SpaceReclaimed": 2048}`}}
+
+	hitsPerPath := map[string]int{}
+	server := testServer(responses, &hitsPerPath)
+	defer server.Close()
+
+	Client = nil
+	StartDockerClient(server.URL)
+
+	var reports []Report
+	reportHooks = nil
+	AddReportHook(func(report Report) { reports = append(reports, report) })
+	defer func() { reportHooks = nil }()
+
+	CleanAll(DatePolicy, GCPolicy{
+		TtlImages:       1000 * time.Hour,
+		TtlContainers:   1000 * time.Hour,
+		PruneBuildCache: true,
+		TtlBuildCache:   24 * time.Hour,
+	})
+
+	assert.Equal(t, 1, hitsPerPath["/build/prune"], "build cache is pruned once")
+	assert.Equal(t, ResourceReport{Candidates: 2, Deleted: 2}, reports[0].BuildCache, "pruned build cache is reported")
+	assert.Equal(t, int64(2048), reports[0].EstimatedBytesReclaimed, "reclaimed build cache is reported")
+}
+
+func TestPruneBuildCacheKeepsStorage(t *testing.T) {
+	responses := make(testResponseMap)
+	responses["/_ping"] = []response{{"GET", "default", "OK"}}
+	responses["/build/prune"] = []response{{"POST", "keep-storage=1073741824", `{"CachesDeleted": ["a"], "SpaceReclaimed": 10}`}}
+
+	hitsPerPath := map[string]int{}
+	server := testServer(responses, &hitsPerPath)
+	defer server.Close()
+
+	Client = nil
+	StartDockerClient(server.URL)
+
+	report := newReport(DiskPolicy)
+	pruneBuildCache(GCPolicy{PruneBuildCache: true, BuildCacheKeepStorage: 1 << 30}, report)
+	assert.Equal(t, ResourceReport{Candidates: 1, Deleted: 1}, report.BuildCache, "keep storage is sent to daemon")
+
+	report = newReport(DiskPolicy)
+	pruneBuildCache(GCPolicy{PruneBuildCache: true, BuildCacheKeepStorage: 1}, report)
+	assert.Equal(t, ResourceReport{Candidates: 1, Failed: 1}, report.BuildCache, "failed prune is reported")
+}
+
+func TestPruneBuildCacheTimesOut(t *testing.T) {
+	defer func(timeout time.Duration) { buildCachePruneTimeout = timeout }(buildCachePruneTimeout)
+	buildCachePruneTimeout = 50 * time.Millisecond
+
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/build/prune" {
+			<-release
+		}
+		w.Write([]byte("OK"))
+	}))
+	defer server.Close()
+	defer close(release)
+
+	Client = nil
+	StartDockerClient(server.URL)
+
+	report := newReport(DiskPolicy)
+	pruneBuildCache(GCPolicy{PruneBuildCache: true}, report)
+	assert.Equal(t, ResourceReport{Candidates: 1, Failed: 1}, report.BuildCache, "prune the daemon doesn't answer fails")
+}
+
+func TestDockerHTTPClientKeepsTLS(t *testing.T) {
+	defer func(endpoint string, client *docker.Client) { dockerEndpoint, Client = endpoint, client }(dockerEndpoint, Client)
+
+	dockerEndpoint = "tcp://docker.example.com:2376"
+	Client, _ = docker.NewClient(dockerEndpoint)
+	client, base, err := dockerHTTPClient()
+	assert.Nil(t, err, "tcp endpoint should be supported")
+	assert.True(t, client == Client.HTTPClient, "http client of the docker client is used")
+	assert.Equal(t, "http://docker.example.com:2376", base, "plain tcp endpoint uses http")
+
+	Client.TLSConfig = &tls.Config{}
+	_, base, _ = dockerHTTPClient()
+	assert.Equal(t, "https://docker.example.com:2376", base, "tcp endpoint with tls uses https")
+
+	dockerEndpoint = "unix:///var/run/docker.sock"
+	client, base, err = dockerHTTPClient()
+	assert.Nil(t, err, "unix endpoint should be supported")
+	assert.Equal(t, "http://docker", base, "unix endpoint is dialed directly")
+	again, _, _ := dockerHTTPClient()
+	assert.True(t, client == again, "client of the unix endpoint is reused")
+
+	dockerEndpoint = "npipe:////./pipe/docker_engine"
+	_, _, err = dockerHTTPClient()
+	assert.NotNil(t, err, "other endpoints are rejected")
+}
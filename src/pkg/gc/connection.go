@@ -0,0 +1,129 @@
+package gc
+
+import (
+	"pkg/statsd"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/fsouza/go-dockerclient"
+)
+
+// Delay before the first reconnection attempt at startup, doubled for each
+// following one up to the maximum backoff
+const initialReconnectBackoff = time.Second
+
+// connection tracks whether the Docker daemon answers in the continuous
+// modes, which outlive restarts of the daemon
+type connection struct {
+	// Policy of the continuous mode its metrics are tagged with
+	policy    string
+	connected bool
+	// When the daemon stopped answering
+	lostAt time.Time
+	lock   sync.Mutex
+}
+
+// daemon is nil for one-time commands, they exit when the daemon is down
+var daemon *connection
+
+// ConnectDockerClient starts the Docker client of the continuous mode of the
+// policy. It waits for the daemon to answer, retrying with exponential backoff
+// up to maxBackoff, and from then on sweeps are skipped while the daemon is
+// down.
+func ConnectDockerClient(endpoint, policy string, maxBackoff time.Duration) {
+	newDockerClient(endpoint)
+	daemon = &connection{policy: policy}
+	backoff := initialReconnectBackoff
+	for attempt := 1; ; attempt++ {
+		err := Client.Ping()
+		if err == nil {
+			break
+		}
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+		log.WithFields(log.Fields{
+			"error":   err,
+			"attempt": attempt,
+			"retryIn": backoff,
+		}).Warn("Docker daemon not reachable, retrying")
+		statsd.TaggedGauge("docker.connected", 0, daemon.tags(), StatsdSamplingRate)
+		<-clock.After(backoff)
+		backoff *= 2
+	}
+	daemon.setConnected(true)
+	log.WithField("endpoint", endpoint).Info("Connected to Docker daemon")
+}
+
+func newDockerClient(endpoint string) {
+	client, err := docker.NewClient(endpoint)
+	if err != nil {
+		log.WithField("error", err).Fatal("Error creating Docker client")
+	}
+	dockerEndpoint = endpoint
+	Client = client
+}
+
+// dockerAvailable pings the daemon before a sweep, logging when the
+// connection is lost and when it's back. It's always available for one-time
+// commands.
+func dockerAvailable() bool {
+	if daemon == nil {
+		return true
+	}
+	err := Client.Ping()
+	daemon.lock.Lock()
+	defer daemon.lock.Unlock()
+	switch {
+	case err != nil && daemon.connected:
+		daemon.lostAt = clock.Now()
+		log.WithField("error", err).Error("Lost connection to Docker daemon, skipping sweeps until it's back")
+		statsd.Count("docker.disconnected", 1, daemon.tags(), StatsdSamplingRate)
+	case err != nil:
+		log.WithFields(log.Fields{
+			"error": err,
+			"down":  clock.Now().Sub(daemon.lostAt),
+		}).Warn("Docker daemon still not reachable, skipping sweep")
+	case !daemon.connected:
+		closeIdleConnections()
+		log.WithField("down", clock.Now().Sub(daemon.lostAt)).Info("Reconnected to Docker daemon")
+		statsd.Count("docker.reconnected", 1, daemon.tags(), StatsdSamplingRate)
+	}
+	daemon.connected = err == nil
+	daemon.gauge()
+	return daemon.connected
+}
+
+// closeIdleConnections drops the connections to the previous daemon process.
+// The client is kept as the API handlers share it, idle connections over the
+// unix socket are dropped by their transport once the daemon closed them.
+func closeIdleConnections() {
+	if Client.HTTPClient == nil {
+		return
+	}
+	if transport, ok := Client.HTTPClient.Transport.(interface {
+		CloseIdleConnections()
+	}); ok {
+		transport.CloseIdleConnections()
+	}
+}
+
+func (c *connection) setConnected(connected bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.connected = connected
+	c.gauge()
+}
+
+func (c *connection) gauge() {
+	connected := 0
+	if c.connected {
+		connected = 1
+	}
+	statsd.TaggedGauge("docker.connected", float64(connected), c.tags(), StatsdSamplingRate)
+}
+
+func (c *connection) tags() []string {
+	return []string{policyTag(c.policy)}
+}
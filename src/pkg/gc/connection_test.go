@@ -0,0 +1,116 @@
+package gc
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// pingServer answers pings while up is set
+func pingServer(up *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(up) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("OK"))
+	}))
+}
+
+func TestConnectDockerClient(t *testing.T) {
+	fake, restore := withFakeScheduleClock(time.Date(2016, 3, 25, 0, 0, 0, 0, time.UTC))
+	defer restore()
+	defer func() { daemon = nil }()
+	var up int32
+	server := pingServer(&up)
+	defer server.Close()
+
+	connected := make(chan struct{})
+	go func() {
+		ConnectDockerClient(server.URL, DatePolicy, 3*time.Second)
+		close(connected)
+	}()
+	// Retried after 1s, 2s and then at most 3s
+	for _, backoff := range []time.Duration{time.Second, 2 * time.Second} {
+		fake.waitForWaiters(t, 1)
+		fake.Advance(backoff)
+	}
+	fake.waitForWaiters(t, 1)
+	atomic.StoreInt32(&up, 1)
+	fake.Advance(2 * time.Second)
+	select {
+	case <-connected:
+		t.Fatal("client connected before the backoff elapsed")
+	case <-time.After(10 * time.Millisecond):
+	}
+	fake.Advance(time.Second)
+	select {
+	case <-connected:
+	case <-time.After(time.Second):
+		t.Fatal("backoff was not capped at the maximum")
+	}
+	assert.True(t, daemon.connected, "client connects once the daemon answers")
+}
+
+func TestDockerAvailable(t *testing.T) {
+	_, restore := withFakeScheduleClock(time.Date(2016, 3, 25, 0, 0, 0, 0, time.UTC))
+	defer restore()
+	defer func() { daemon = nil }()
+	up := int32(1)
+	server := pingServer(&up)
+	defer server.Close()
+
+	StartDockerClient(server.URL)
+	atomic.StoreInt32(&up, 0)
+	assert.True(t, dockerAvailable(), "one-time commands don't check the daemon")
+
+	atomic.StoreInt32(&up, 1)
+	ConnectDockerClient(server.URL, DatePolicy, time.Second)
+	assert.True(t, dockerAvailable(), "daemon is available while it answers")
+
+	atomic.StoreInt32(&up, 0)
+	assert.False(t, dockerAvailable(), "daemon is unavailable when it stops answering")
+	assert.False(t, dockerAvailable(), "daemon is unavailable until it answers again")
+
+	client := Client
+	transport := &idleTrackingTransport{RoundTripper: Client.HTTPClient.Transport}
+	Client.HTTPClient.Transport = transport
+	atomic.StoreInt32(&up, 1)
+	assert.True(t, dockerAvailable(), "daemon is available again once it answers")
+	assert.True(t, client == Client, "client is kept on reconnection")
+	assert.Equal(t, 1, transport.closed, "idle connections are closed on reconnection")
+}
+
+type idleTrackingTransport struct {
+	http.RoundTripper
+	closed int
+}
+
+func (t *idleTrackingTransport) CloseIdleConnections() {
+	t.closed++
+}
+
+func TestSchedulerSkipsSweepsWhileDaemonIsDown(t *testing.T) {
+	_, restore := withFakeScheduleClock(time.Date(2016, 3, 25, 0, 0, 0, 0, time.UTC))
+	defer restore()
+	defer func() { daemon = nil }()
+	up := int32(1)
+	server := pingServer(&up)
+	defer server.Close()
+	ConnectDockerClient(server.URL, DatePolicy, time.Second)
+	scheduler, _ := NewScheduler(SkipMissedRuns, 0)
+	defer scheduler.Stop()
+
+	sweeps := 0
+	atomic.StoreInt32(&up, 0)
+	assert.False(t, <-scheduler.Trigger("sweep", func() { sweeps++ }), "trigger tells the sweep didn't run")
+	assert.Equal(t, 0, sweeps, "sweep is skipped while the daemon is down")
+
+	atomic.StoreInt32(&up, 1)
+	assert.True(t, <-scheduler.Trigger("sweep", func() { sweeps++ }), "trigger tells the sweep ran")
+	assert.Equal(t, 1, sweeps, "sweep runs once the daemon is back")
+}
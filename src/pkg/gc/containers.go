@@ -0,0 +1,270 @@
+package gc
+
+import (
+	"fmt"
+	"pkg/helpers"
+	"pkg/statsd"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/fsouza/go-dockerclient"
+)
+
+const (
+	// ContainerWithVolumes is a container removed together with its anonymous
+	// volumes
+	ContainerWithVolumes = "container with volumes"
+	// CreatedContainer is a container created but never started
+	CreatedContainer = "created container"
+
+	ExitZero      = "zero"
+	ExitNonZero   = "nonzero"
+	ExitOOMKilled = "oomkilled"
+)
+
+// ContainerRule gives a TTL to the finished containers matching all of its
+// conditions, empty conditions match everything
+type ContainerRule struct {
+	// ExitZero, ExitNonZero (including OOM killed) or ExitOOMKilled
+	Exit string
+	// Patterns where * matches any characters, image is matched against the
+	// image name the container was created with
+	Name  string
+	Image string
+	Ttl   time.Duration
+	// Remove the anonymous volumes of the container with it
+	RemoveVolumes bool
+}
+
+// Dead containers often fail the normal removal, they are forced and retried
+var (
+	deadContainerRetries    = 3
+	deadContainerRetryDelay = 5 * time.Second
+)
+
+// containerGroup has the containers removed with the same TTL by finish date
+type containerGroup struct {
+	dataType string
+	ttl      time.Duration
+	dataMap  map[int64][]string
+}
+
+// ParseContainerRules parses semicolon separated rules of comma separated
+// key=value conditions, eg. exit=nonzero,ttl=24h;name=ci-*,ttl=0s,volumes=true
+func ParseContainerRules(value string) ([]ContainerRule, error) {
+	var rules []ContainerRule
+	for _, definition := range strings.Split(value, ";") {
+		if strings.TrimSpace(definition) == "" {
+			continue
+		}
+
+		var rule ContainerRule
+		hasTtl := false
+		for _, condition := range strings.Split(definition, ",") {
+			keyAndValue := strings.SplitN(strings.TrimSpace(condition), "=", 2)
+			if len(keyAndValue) != 2 {
+				return nil, fmt.Errorf("%s is not valid container rule condition", condition)
+			}
+			key, val := keyAndValue[0], keyAndValue[1]
+
+			var err error
+			switch key {
+			case "exit":
+				if val != ExitZero && val != ExitNonZero && val != ExitOOMKilled {
+					return nil, fmt.Errorf("%s is not valid exit condition", val)
+				}
+				rule.Exit = val
+			case "name":
+				rule.Name = strings.TrimPrefix(val, "/")
+			case "image":
+				rule.Image = val
+			case "ttl":
+				rule.Ttl, err = time.ParseDuration(val)
+				hasTtl = true
+			case "volumes":
+				rule.RemoveVolumes, err = strconv.ParseBool(val)
+			default:
+				return nil, fmt.Errorf("%s is not valid container rule condition", key)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s is not valid %s: %s", val, key, err)
+			}
+		}
+		if !hasTtl {
+			return nil, fmt.Errorf("container rule %s has no ttl", definition)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (r ContainerRule) String() string {
+	var conditions []string
+	if r.Exit != "" {
+		conditions = append(conditions, "exit="+r.Exit)
+	}
+	if r.Name != "" {
+		conditions = append(conditions, "name="+r.Name)
+	}
+	if r.Image != "" {
+		conditions = append(conditions, "image="+r.Image)
+	}
+	conditions = append(conditions, "ttl="+r.Ttl.String())
+	if r.RemoveVolumes {
+		conditions = append(conditions, "volumes=true")
+	}
+	return strings.Join(conditions, ",")
+}
+
+func (r ContainerRule) matches(container ContainerInfo) bool {
+	switch r.Exit {
+	case ExitZero:
+		if container.ExitCode != 0 || container.OOMKilled {
+			return false
+		}
+	case ExitNonZero:
+		if container.ExitCode == 0 && !container.OOMKilled {
+			return false
+		}
+	case ExitOOMKilled:
+		if !container.OOMKilled {
+			return false
+		}
+	}
+	if r.Name != "" && !helpers.MatchGlob(r.Name, container.Name) {
+		return false
+	}
+	if r.Image != "" && !helpers.MatchGlob(r.Image, container.ImageName) {
+		return false
+	}
+	return true
+}
+
+// containerRule returns the index of the first rule matching the container or
+// -1 if the container is kept for TtlContainers
+func (p GCPolicy) containerRule(container ContainerInfo) int {
+	for i, rule := range p.ContainerRules {
+		if rule.matches(container) {
+			return i
+		}
+	}
+	return -1
+}
+
+// getContainerGroups returns the finished containers grouped by the rule
+// matching them followed by the group of containers no rule matches, and the
+// created containers by creation date when they have a TTL
+func getContainerGroups(policy GCPolicy, report *Report) []containerGroup {
+	containers, err := listFinishedContainers(false)
+	if err != nil {
+		log.WithField("error", err).Error("Listing containers error")
+		report.Error = err.Error()
+	}
+
+	for _, container := range containers {
+		report.states[container.ID] = container.State
+	}
+	groups := groupContainers(containers, policy, report.Mode)
+
+	if policy.TtlCreatedContainers != nil {
+		created, cErr := listCreatedContainers()
+		if cErr != nil {
+			log.WithField("error", cErr).Error("Listing containers error")
+			report.Error = cErr.Error()
+		}
+		group := containerGroup{dataType: CreatedContainer, ttl: *policy.TtlCreatedContainers, dataMap: map[int64][]string{}}
+		for _, container := range created {
+			report.states[container.ID] = container.State
+			if !evaluateContainer(container, policy, report.Mode).delete {
+				continue
+			}
+			date := container.Created.Unix()
+			group.dataMap[date] = append(group.dataMap[date], container.ID)
+		}
+		containers = append(containers, created...)
+		groups = append(groups, group)
+	}
+
+	report.Containers.Inventory = len(containers)
+	return groups
+}
+
+// listCreatedContainers returns the containers created but never started
+func listCreatedContainers() ([]ContainerInfo, error) {
+	containers, _, err := listContainersInState([]string{"created"}, false)
+	if err != nil {
+		return nil, err
+	}
+	for i := range containers {
+		containers[i].State = "created"
+	}
+	statsd.TaggedGauge("container.state.created.amount", float64(len(containers)), []string{resourceTag(Container)}, StatsdSamplingRate)
+	return containers, nil
+}
+
+// removeContainer removes the container, forcing and retrying the removal of
+// dead containers
+func removeContainer(options docker.RemoveContainerOptions, state string) error {
+	attempts := 1
+	if state == "dead" {
+		options.Force = true
+		attempts += deadContainerRetries
+	}
+
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(deadContainerRetryDelay)
+		}
+		finished := timeDockerCall("containers.remove", Container)
+		err = Client.RemoveContainer(options)
+		finished(err)
+		if err == nil {
+			return nil
+		}
+	}
+	log.WithFields(log.Fields{
+		"error":    err,
+		"id":       options.ID,
+		"state":    state,
+		"attempts": attempts,
+	}).Error("Container deletion error")
+	return err
+}
+
+// groupContainers splits the finished containers the cleanup of the mode
+// decides to delete by the rule matching them
+func groupContainers(containers []ContainerInfo, policy GCPolicy, mode string) []containerGroup {
+	groups := make([]containerGroup, 0, len(policy.ContainerRules)+1)
+	for _, rule := range policy.ContainerRules {
+		group := containerGroup{dataType: Container, ttl: rule.Ttl, dataMap: map[int64][]string{}}
+		if rule.RemoveVolumes {
+			group.dataType = ContainerWithVolumes
+		}
+		groups = append(groups, group)
+	}
+	groups = append(groups, containerGroup{dataType: Container, ttl: policy.TtlContainers, dataMap: map[int64][]string{}})
+
+	for _, container := range containers {
+		if !evaluateContainer(container, policy, mode).delete {
+			continue
+		}
+		group := groups[len(groups)-1]
+		if i := policy.containerRule(container); i >= 0 {
+			group = groups[i]
+		}
+		date := container.FinishedAt.Unix()
+		group.dataMap[date] = append(group.dataMap[date], container.ID)
+	}
+	return groups
+}
+
+func removeContainersBasedOnAge(policy GCPolicy, report *Report) int {
+	removed := 0
+	for _, group := range getContainerGroups(policy, report) {
+		removed += removeDataBasedOnAge(group.dataMap, group.dataType, group.ttl, report)
+	}
+	return removed
+}
@@ -0,0 +1,158 @@
+package gc
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseContainerRules(t *testing.T) {
+	rules, err := ParseContainerRules("exit=oomkilled,ttl=48h; name=ci-*,image=ci/*,ttl=0s,volumes=true")
+	assert.Nil(t, err, "parsing rules should succeed")
+	assert.Equal(t, []ContainerRule{
+		{Exit: ExitOOMKilled, Ttl: 48 * time.Hour},
+		{Name: "ci-*", Image: "ci/*", RemoveVolumes: true},
+	}, rules, "rules are parsed in order")
+	assert.Equal(t, "name=ci-*,image=ci/*,ttl=0s,volumes=true", rules[1].String(), "rule formats back to its definition")
+
+	for _, value := range []string{"exit=maybe,ttl=1h", "name=ci-*", "ttl=forever", "color=red,ttl=1h"} {
+		_, err := ParseContainerRules(value)
+		assert.NotNil(t, err, value+" should not parse")
+	}
+}
+
+func TestCleanAllWithContainerRules(t *testing.T) {
+	finished := time.Now().Add(-2 * time.Hour).Format(time.RFC3339)
+	containers := []struct {
+		id        string
+		name      string
+		image     string
+		exitCode  int
+		oomKilled bool
+	}{
+		{"succeeded", "app-1", "app:latest", 0, false},
+		{"failed", "app-2", "app:latest", 1, false},
+		{"oom", "app-3", "app:latest", 137, true},
+		{"ci", "ci-build-1", "ci/runner:latest", 1, false},
+	}
+
+	responses := make(testResponseMap)
+	responses["/_ping"] = []response{{"GET", "default", "OK"}}
+	responses["/images/json"] = []response{{"GET", "all=1", "[]"}}
+	exitedFilter := mustMarshal(filters{Status: []string{"exited", "dead"}})
+	var listed []containerListInfo
+	for _, c := range containers {
+		listed = append(listed, containerListInfo{Id: c.id, Image: c.image})
+		inspect := map[string]interface{}{
+			"Id":     c.id,
+			"Name":   "/" + c.name,
+			"Config": map[string]interface{}{"Image": c.image},
+			"State":  map[string]interface{}{"FinishedAt": finished, "ExitCode": c.exitCode, "OOMKilled": c.oomKilled},
+		}
+		responses["/containers/"+c.id+"/json"] = []response{{"GET", "default", string(mustMarshal(inspect))}}
+		responses["/containers/"+c.id] = []response{{"DELETE", "v=", "OK"}}
+	}
+	responses["/containers/ci"] = []response{{"DELETE", "v=1", "OK"}}
+	responses["/containers/json"] = []response{
+		{"GET", "default", "[]"},
+		{"GET", fmt.Sprintf("filters=%s", string(exitedFilter)), string(mustMarshal(listed))}}
+
+	hitsPerPath := map[string]int{}
+	server := testServer(responses, &hitsPerPath)
+	defer server.Close()
+
+	Client = nil
+	StartDockerClient(server.URL)
+
+	policy := GCPolicy{
+		TtlImages:     1000 * time.Hour,
+		TtlContainers: 24 * time.Hour,
+		ContainerRules: []ContainerRule{
+			{Name: "ci-*", Ttl: 0, RemoveVolumes: true},
+			{Exit: ExitOOMKilled, Ttl: 1000 * time.Hour},
+			{Exit: ExitZero, Ttl: 0},
+		},
+	}
+	cleanedContainers, _ := CleanAll(DatePolicy, policy)
+
+	assert.Equal(t, 2, cleanedContainers, "two containers match rules with expired TTL")
+	assert.Equal(t, 1, hitsPerPath["/containers/ci"], "first matching rule wins and removes volumes")
+	assert.Equal(t, 1, hitsPerPath["/containers/succeeded"], "succeeded container is removed right away")
+	assert.Equal(t, 0, hitsPerPath["/containers/failed"], "failed container is kept for containers TTL")
+	assert.Equal(t, 0, hitsPerPath["/containers/oom"], "OOM killed container is kept for its rule TTL")
+
+	explanation, err := Explain("oom", policy)
+	assert.Nil(t, err, "explaining container should succeed")
+	assert.Contains(t, explanation.Verdicts[1].Reason, "matches rule 2 exit=oomkilled,ttl=1000h0m0s", "explain shows the matching rule")
+}
+
+func TestCleanCreatedAndDeadContainers(t *testing.T) {
+	defer func(retries int, delay time.Duration) {
+		deadContainerRetries, deadContainerRetryDelay = retries, delay
+	}(deadContainerRetries, deadContainerRetryDelay)
+	deadContainerRetries, deadContainerRetryDelay = 2, 0
+
+	now := time.Now()
+	containers := []struct {
+		id      string
+		status  string
+		created time.Time
+	}{
+		{"exited", "exited", now.Add(-48 * time.Hour)},
+		{"dead", "dead", now.Add(-48 * time.Hour)},
+		{"stuck", "dead", now.Add(-48 * time.Hour)},
+		{"created-old", "created", now.Add(-48 * time.Hour)},
+		{"created-new", "created", now},
+	}
+
+	responses := make(testResponseMap)
+	responses["/_ping"] = []response{{"GET", "default", "OK"}}
+	responses["/images/json"] = []response{{"GET", "all=1", "[]"}}
+	finished := []containerListInfo{}
+	created := []containerListInfo{}
+	for _, c := range containers {
+		if c.status == "created" {
+			created = append(created, containerListInfo{Id: c.id})
+		} else {
+			finished = append(finished, containerListInfo{Id: c.id})
+		}
+		inspect := map[string]interface{}{
+			"Id":      c.id,
+			"Name":    "/" + c.id,
+			"Created": c.created.Format(time.RFC3339),
+			"State":   map[string]interface{}{"Status": c.status, "FinishedAt": c.created.Format(time.RFC3339)},
+		}
+		responses["/containers/"+c.id+"/json"] = []response{{"GET", "default", string(mustMarshal(inspect))}}
+		responses["/containers/"+c.id] = []response{{"DELETE", "force=", "OK"}}
+	}
+	// Dead containers are forced, stuck one never goes away
+	responses["/containers/dead"] = []response{{"DELETE", "force=1", "OK"}}
+	responses["/containers/stuck"] = []response{}
+	exitedFilter := mustMarshal(filters{Status: []string{"exited", "dead"}})
+	createdFilter := mustMarshal(filters{Status: []string{"created"}})
+	responses["/containers/json"] = []response{
+		{"GET", "default", "[]"},
+		{"GET", fmt.Sprintf("filters=%s", string(exitedFilter)), string(mustMarshal(finished))},
+		{"GET", fmt.Sprintf("filters=%s", string(createdFilter)), string(mustMarshal(created))}}
+
+	hitsPerPath := map[string]int{}
+	server := testServer(responses, &hitsPerPath)
+	defer server.Close()
+
+	Client = nil
+	StartDockerClient(server.URL)
+
+	createdTtl := 1 * time.Hour
+	cleanedContainers := CleanContainers(1 * time.Hour)
+	assert.Equal(t, 2, cleanedContainers, "created containers are kept without their own TTL")
+	assert.Equal(t, 0, hitsPerPath["/containers/created-old"], "created container is kept without TTL")
+
+	hitsPerPath["/containers/stuck"] = 0
+	cleanedContainers, _ = CleanAll(DatePolicy, GCPolicy{TtlImages: 1 * time.Hour, TtlContainers: 1 * time.Hour, TtlCreatedContainers: &createdTtl})
+	assert.Equal(t, 3, cleanedContainers, "exited, dead and old created containers are removed")
+	assert.Equal(t, 1, hitsPerPath["/containers/created-old"], "old created container is removed")
+	assert.Equal(t, 0, hitsPerPath["/containers/created-new"], "new created container is kept")
+	assert.Equal(t, 3, hitsPerPath["/containers/stuck"], "dead container removal is retried")
+}
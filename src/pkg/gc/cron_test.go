@@ -0,0 +1,49 @@
+package gc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCronNext(t *testing.T) {
+	helsinki, err := time.LoadLocation("Europe/Helsinki")
+	if err != nil {
+		t.Skip("no time zone database")
+	}
+	start := time.Date(2016, 3, 25, 10, 7, 30, 0, time.UTC) // Friday
+
+	expectations := []struct {
+		expression string
+		location   *time.Location
+		next       time.Time
+	}{
+		{"* * * * *", time.UTC, time.Date(2016, 3, 25, 10, 8, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.UTC, time.Date(2016, 3, 25, 10, 15, 0, 0, time.UTC)},
+		{"0 2 * * *", time.UTC, time.Date(2016, 3, 26, 2, 0, 0, 0, time.UTC)},
+		{"30 9 * * mon-fri", time.UTC, time.Date(2016, 3, 28, 9, 30, 0, 0, time.UTC)},
+		{"0 0 1 jan,jul *", time.UTC, time.Date(2016, 7, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 12 13 * 5", time.UTC, time.Date(2016, 3, 25, 12, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.UTC, time.Date(2016, 3, 27, 0, 0, 0, 0, time.UTC)},
+		{"@daily", time.UTC, time.Date(2016, 3, 26, 0, 0, 0, 0, time.UTC)},
+		{"0 2 * * *", helsinki, time.Date(2016, 3, 26, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, e := range expectations {
+		cron, err := ParseCron(e.expression, e.location)
+		assert.Nil(t, err, e.expression+" should parse")
+		assert.True(t, e.next.Equal(cron.Next(start)), e.expression+" runs next at "+e.next.String()+", not "+cron.Next(start).String())
+	}
+
+	// Clocks in Helsinki skip from 03:00 to 04:00 on March 27th
+	cron, _ := ParseCron("30 3 * * *", helsinki)
+	assert.True(t, time.Date(2016, 3, 28, 0, 30, 0, 0, time.UTC).Equal(cron.Next(time.Date(2016, 3, 26, 12, 0, 0, 0, time.UTC))), "skipped time runs the next day")
+
+	cron, _ = ParseCron("0 0 30 feb *", time.UTC)
+	assert.True(t, cron.Next(start).IsZero(), "schedule that never matches has no next run")
+
+	for _, expression := range []string{"* * * *", "60 * * * *", "* 5-1 * * *", "*/0 * * * *", "* * * foo *", "@often"} {
+		_, err := ParseCron(expression, time.UTC)
+		assert.NotNil(t, err, expression+" should not parse")
+	}
+}
@@ -0,0 +1,274 @@
+package gc
+
+import (
+	"errors"
+	"fmt"
+	"pkg/helpers"
+	"strings"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+const (
+	InUseRule  = "in-use"
+	StateRule  = "state"
+	TtlRule    = "ttl"
+	WindowRule = "maintenance-window"
+)
+
+// Verdict is the outcome of a single GC rule for an image or a container
+type Verdict struct {
+	Rule   string `json:"rule"`
+	Keep   bool   `json:"keep"`
+	Reason string `json:"reason"`
+}
+
+// Explanation describes how the GC policies are evaluated for a single image
+// or container
+type Explanation struct {
+	Type     string    `json:"type"`
+	ID       string    `json:"id"`
+	Names    []string  `json:"names,omitempty"`
+	Verdicts []Verdict `json:"verdicts"`
+	// Position in the order images are removed in diskspace mode, zero if the
+	// image is never removed there
+	EvictionPosition int  `json:"evictionPosition,omitempty"`
+	EvictionBatch    int  `json:"evictionBatch,omitempty"`
+	EvictionBatches  int  `json:"evictionBatches,omitempty"`
+	Delete           bool `json:"delete"`
+	// Stale tags untagged from an image its other tags keep
+	Untag []string `json:"untag,omitempty"`
+}
+
+// decision is what the cleanup does with an image or a container and the
+// verdicts of the rules it's based on
+type decision struct {
+	verdicts []Verdict
+	delete   bool
+	untag    []string
+}
+
+var errNotFound = errors.New("no such image or container")
+
+func inUseVerdict(image ImageInfo) Verdict {
+	if len(image.UsedBy) > 0 {
+		return Verdict{
+			Rule:   InUseRule,
+			Keep:   true,
+			Reason: "used by running containers " + strings.Join(image.UsedBy, ", "),
+		}
+	}
+	return Verdict{Rule: InUseRule, Reason: "not used by any running container"}
+}
+
+func ttlVerdict(date time.Time, ttl time.Duration) Verdict {
+	age := time.Since(date)
+	if age > ttl {
+		return Verdict{Rule: TtlRule, Reason: fmt.Sprintf("age %v exceeds ttl %v", age, ttl)}
+	}
+	return Verdict{Rule: TtlRule, Keep: true, Reason: fmt.Sprintf("age %v is within ttl %v", age, ttl)}
+}
+
+// Explain evaluates the GC policies for the image or container matching the
+// given ID, ID prefix, image tag or container name
+func Explain(query string, policy GCPolicy) (Explanation, error) {
+	images, err := listImages()
+	if err != nil {
+		return Explanation{}, err
+	}
+
+	var matches []ImageInfo
+	for _, image := range images {
+		if matchesID(image.ID, query) || matchesTag(image.RepoTags, query) {
+			matches = append(matches, image)
+		}
+	}
+	if len(matches) > 1 {
+		return Explanation{}, fmt.Errorf("%s matches %d images", query, len(matches))
+	}
+	if len(matches) == 1 {
+		return explainImage(matches[0], images, policy), nil
+	}
+
+	return explainContainer(query, policy)
+}
+
+// evaluateImage decides what the cleanup of the mode does with the image,
+// running the rules in the order the cleanup applies them and stopping at the
+// first one keeping the image
+func evaluateImage(image ImageInfo, policy GCPolicy, mode string) decision {
+	var d decision
+	verdict := inUseVerdict(image)
+	d.verdicts = append(d.verdicts, verdict)
+	if !verdict.Keep && policy.TagGC {
+		verdict, d.untag = tagsVerdict(image, policy)
+		d.verdicts = append(d.verdicts, verdict)
+	}
+	if !verdict.Keep {
+		verdict = imageTtlVerdict(image, policy)
+		d.verdicts = append(d.verdicts, verdict)
+	}
+	d.delete = !verdict.Keep
+	return d.withinWindows(ResourceImages, policy, mode)
+}
+
+func imageTtlVerdict(image ImageInfo, policy GCPolicy) Verdict {
+	verdict := ttlVerdict(image.Created, policy.imageTtl(image))
+	if image.Dangling && policy.TtlDanglingImages != nil {
+		verdict.Reason = "dangling image " + verdict.Reason
+	}
+	return verdict
+}
+
+// evaluateContainer decides what the cleanup of the mode does with a finished
+// or created container
+func evaluateContainer(container ContainerInfo, policy GCPolicy, mode string) decision {
+	var d decision
+	if container.State == "created" {
+		if policy.TtlCreatedContainers == nil {
+			d.verdicts = []Verdict{{Rule: StateRule, Keep: true, Reason: "container was never started and created containers have no ttl"}}
+			return d
+		}
+		ttl := ttlVerdict(container.Created, *policy.TtlCreatedContainers)
+		d.verdicts = []Verdict{{Rule: StateRule, Reason: "container was never started"}, ttl}
+		d.delete = !ttl.Keep
+		return d.withinWindows(ResourceContainers, policy, mode)
+	}
+
+	var ttl Verdict
+	if i := policy.containerRule(container); i >= 0 {
+		rule := policy.ContainerRules[i]
+		ttl = ttlVerdict(container.FinishedAt, rule.Ttl)
+		ttl.Reason = fmt.Sprintf("matches rule %d %s, %s", i+1, rule, ttl.Reason)
+	} else {
+		ttl = ttlVerdict(container.FinishedAt, policy.TtlContainers)
+	}
+	d.verdicts = []Verdict{{Rule: StateRule, Reason: fmt.Sprintf("container is %s with exit code %d", container.State, container.ExitCode)}, ttl}
+	d.delete = !ttl.Keep
+	return d.withinWindows(ResourceContainers, policy, mode)
+}
+
+// withinWindows keeps everything while the maintenance windows don't allow
+// deleting the resource, they only apply to TTL mode
+func (d decision) withinWindows(resource string, policy GCPolicy, mode string) decision {
+	if mode != DatePolicy || !d.delete && len(d.untag) == 0 || policy.deletionAllowed(resource) {
+		return d
+	}
+	d.verdicts = append(d.verdicts, Verdict{Rule: WindowRule, Keep: true, Reason: "maintenance windows don't allow deleting " + resource + " now"})
+	d.delete, d.untag = false, nil
+	return d
+}
+
+func explainImage(image ImageInfo, images []ImageInfo, policy GCPolicy) Explanation {
+	d := evaluateImage(image, policy, DatePolicy)
+	explanation := Explanation{
+		Type:     Image,
+		ID:       image.ID,
+		Names:    image.RepoTags,
+		Verdicts: d.verdicts,
+		Delete:   d.delete,
+		Untag:    d.untag,
+	}
+	if !d.delete {
+		return explanation
+	}
+
+	// Same groups and ordering removeImagesInBatch works on
+	tagged, dangling := groupImages(images, policy, DiskPolicy)
+	batches := evictionBatches(mergeDataMaps(tagged.dataMap, dangling.dataMap))
+	explanation.EvictionBatches = len(batches)
+	position := 0
+	for i, batch := range batches {
+		for _, group := range []imageGroup{tagged, dangling} {
+			groupBatch := batchOf(group.dataMap, batch)
+			for _, date := range helpers.SortDataMapReverse(groupBatch) {
+				for _, id := range groupBatch[date] {
+					position++
+					if id == image.ID {
+						explanation.EvictionBatch = i + 1
+						explanation.EvictionPosition = position
+					}
+				}
+			}
+		}
+	}
+	return explanation
+}
+
+func explainContainer(query string, policy GCPolicy) (Explanation, error) {
+	containers, err := listFinishedContainers(false)
+	if err != nil {
+		return Explanation{}, err
+	}
+	created, err := listCreatedContainers()
+	if err != nil {
+		return Explanation{}, err
+	}
+	containers = append(containers, created...)
+
+	for _, container := range containers {
+		if matchesID(container.ID, query) || container.Name == strings.TrimPrefix(query, "/") {
+			d := evaluateContainer(container, policy, DatePolicy)
+			return Explanation{
+				Type:     Container,
+				ID:       container.ID,
+				Names:    []string{container.Name},
+				Verdicts: d.verdicts,
+				Delete:   d.delete,
+			}, nil
+		}
+	}
+
+	// Everything not exited or dead is never collected
+	finished := timeDockerCall("containers.list", Container)
+	all, err := Client.ListContainers(docker.ListContainersOptions{All: true})
+	finished(err)
+	if err != nil {
+		return Explanation{}, err
+	}
+	for _, container := range all {
+		if matchesID(container.ID, query) || matchesName(container.Names, query) {
+			return Explanation{
+				Type:  Container,
+				ID:    container.ID,
+				Names: container.Names,
+				Verdicts: []Verdict{
+					{Rule: StateRule, Keep: true, Reason: "container is not exited, dead or created"},
+				},
+			}, nil
+		}
+	}
+
+	return Explanation{}, errNotFound
+}
+
+func batchOf(dataMap map[int64][]string, batch []int64) map[int64][]string {
+	batchDataMap := map[int64][]string{}
+	for _, date := range batch {
+		batchDataMap[date] = dataMap[date]
+	}
+	return batchDataMap
+}
+
+func matchesID(id, query string) bool {
+	id = strings.TrimPrefix(id, "sha256:")
+	query = strings.TrimPrefix(query, "sha256:")
+	return query != "" && strings.HasPrefix(id, query)
+}
+
+func matchesTag(tags []string, query string) bool {
+	if !strings.Contains(query[strings.LastIndex(query, "/")+1:], ":") {
+		query = query + ":latest"
+	}
+	return helpers.StringInSlice(query, tags)
+}
+
+func matchesName(names []string, query string) bool {
+	for _, name := range names {
+		if strings.TrimPrefix(name, "/") == strings.TrimPrefix(query, "/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,121 @@
+package gc
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExplainImage(t *testing.T) {
+	hitsPerPath := map[string]int{}
+	server := testServer(generateTestData(1, 1, t), &hitsPerPath)
+	defer server.Close()
+
+	Client = nil
+	StartDockerClient(server.URL)
+
+	policy := GCPolicy{TtlImages: 10 * time.Hour, TtlContainers: 1 * time.Minute}
+
+	explanation, err := Explain("4cb07b47f9fb1", policy)
+	assert.Nil(t, err, "explaining an existing image should succeed")
+	assert.Equal(t, Image, explanation.Type, "4cb07b47f9fb1 is an image")
+	assert.True(t, explanation.Delete, "12h old image is deleted with 10h ttl")
+	assert.Equal(t, 2, len(explanation.Verdicts), "both in-use and ttl rules are evaluated")
+	assert.Equal(t, 1, explanation.EvictionBatch, "all five images fit in the first batch")
+	assert.Equal(t, 1, explanation.EvictionPosition, "batches are removed newest first so 12h old image goes before the day old one")
+
+	explanation, err = Explain("8dfafdbc3a401", policy)
+	assert.Nil(t, err, "explaining an existing image should succeed")
+	assert.False(t, explanation.Delete, "fresh image is kept")
+	assert.Equal(t, 0, explanation.EvictionPosition, "fresh image is never evicted")
+	assert.Equal(t, 0, hitsPerPath["/images/8dfafdbc3a401"], "explain never deletes anything")
+}
+
+func TestExplainContainer(t *testing.T) {
+	// Images and containers share IDs in the test data so list no images to
+	// make sure the container is not shadowed
+	responses := generateTestData(1, 1, t)
+	responses["/images/json"] = []response{{"GET", "all=1", "[]"}}
+	hitsPerPath := map[string]int{}
+	server := testServer(responses, &hitsPerPath)
+	defer server.Close()
+
+	Client = nil
+	StartDockerClient(server.URL)
+
+	explanation, err := Explain("3176a2479c921", GCPolicy{TtlContainers: 1 * time.Minute})
+	assert.Nil(t, err, "explaining an existing container should succeed")
+	assert.Equal(t, Container, explanation.Type, "3176a2479c921 is a container")
+	assert.True(t, explanation.Delete, "12h old container is deleted with 1m ttl")
+
+	_, err = Explain("missing", GCPolicy{})
+	assert.Equal(t, errNotFound, err, "unknown IDs are reported")
+}
+
+func TestExplainMaintenanceWindow(t *testing.T) {
+	_, restore := withFakeScheduleClock(time.Date(2016, 3, 25, 12, 0, 0, 0, time.UTC))
+	defer restore()
+	hitsPerPath := map[string]int{}
+	server := testServer(generateTestData(1, 1, t), &hitsPerPath)
+	defer server.Close()
+
+	Client = nil
+	StartDockerClient(server.URL)
+
+	windows, _ := ParseMaintenanceWindows("deny images * 09:00-18:00", time.UTC)
+	explanation, err := Explain("4cb07b47f9fb1", GCPolicy{TtlImages: 10 * time.Hour, MaintenanceWindows: windows})
+	assert.Nil(t, err, "explaining an existing image should succeed")
+	assert.False(t, explanation.Delete, "image past its ttl is kept in a deny window")
+	last := explanation.Verdicts[len(explanation.Verdicts)-1]
+	assert.Equal(t, Verdict{Rule: WindowRule, Keep: true, Reason: "maintenance windows don't allow deleting images now"}, last, "maintenance window verdict is the reason")
+}
+
+func TestExplainUntag(t *testing.T) {
+	defer func() { tagState = &TagState{FirstSeen: map[string]time.Time{}} }()
+	tagState = &TagState{FirstSeen: map[string]time.Time{"app:sha@sha256:app": time.Now().Add(-2 * time.Hour)}}
+	responses := make(testResponseMap)
+	responses["/_ping"] = []response{{"GET", "default", "OK"}}
+	responses["/images/json"] = []response{{"GET", "all=1", `[{"Id": "sha256:app", "RepoTags": ["app:sha", "app:production"], "Created": 0}]`}}
+	responses["/containers/json"] = []response{{"GET", "default", "[]"}}
+	hitsPerPath := map[string]int{}
+	server := testServer(responses, &hitsPerPath)
+	defer server.Close()
+
+	Client = nil
+	StartDockerClient(server.URL)
+
+	policy := GCPolicy{TtlImages: time.Hour, TagGC: true, ProtectedTags: []string{"*:production"}}
+	explanation, err := Explain("app:production", policy)
+	assert.Nil(t, err, "explaining an existing image should succeed")
+	assert.False(t, explanation.Delete, "protected tag keeps the image")
+	assert.Equal(t, []string{"app:sha"}, explanation.Untag, "stale tag is untagged")
+	assert.Equal(t, 1, len(tagState.FirstSeen), "explaining doesn't record tags seen for the first time")
+
+	var out bytes.Buffer
+	assert.Nil(t, WriteExplanation(&out, explanation, TableOutput), "writing table should succeed")
+	assert.Contains(t, out.String(), "untag", "table output shows the untagged tags")
+}
+
+func TestWriteExplanation(t *testing.T) {
+	explanation := Explanation{
+		Type:     Image,
+		ID:       "4cb07b47f9fb1",
+		Verdicts: []Verdict{{Rule: TtlRule, Reason: "age 12h exceeds ttl 10h"}},
+		Delete:   true,
+	}
+
+	var out bytes.Buffer
+	assert.Nil(t, WriteExplanation(&out, explanation, JSONOutput), "writing JSON should succeed")
+	var decoded Explanation
+	assert.Nil(t, json.Unmarshal(out.Bytes(), &decoded), "output should be valid JSON")
+	assert.Equal(t, explanation, decoded, "JSON output should contain the whole explanation")
+
+	out.Reset()
+	assert.Nil(t, WriteExplanation(&out, explanation, TableOutput), "writing table should succeed")
+	assert.Contains(t, out.String(), "decision: delete", "table output should contain the decision")
+
+	assert.NotNil(t, WriteExplanation(&out, explanation, "xml"), "unknown formats are rejected")
+}
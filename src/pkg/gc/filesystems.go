@@ -0,0 +1,255 @@
+package gc
+
+import (
+	"fmt"
+	"path/filepath"
+	"pkg/helpers"
+	"strings"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Resources that can reclaim space on a filesystem
+const (
+	ResourceImages     = "images"
+	ResourceContainers = "containers"
+	ResourceLogs       = "logs"
+	ResourceBuildCache = "buildcache"
+)
+
+var allResources = []string{ResourceImages, ResourceContainers, ResourceLogs, ResourceBuildCache}
+
+// Volumes are never removed on their own, only anonymous ones along with
+// their containers, so a filesystem can't be mapped to them
+const volumesResource = "volumes"
+
+// Filesystem is a path monitored in diskspace mode and the resources cleaned
+// when its used disk space reaches the high threshold
+type Filesystem struct {
+	Path      string
+	Resources []string
+	// Unset thresholds are the ones of the policy
+	HighDiskSpaceThreshold float64
+	LowDiskSpaceThreshold  float64
+	HighDiskSpaceFree      int64
+	LowDiskSpaceFree       int64
+}
+
+// newDiskSpaceFetcher returns the disk space of a monitored filesystem
+var newDiskSpaceFetcher = func(path string) DiskSpace {
+	return &DiskSpaceFetcher{Path: path}
+}
+
+func (f Filesystem) has(resources ...string) bool {
+	for _, resource := range resources {
+		if helpers.StringInSlice(resource, f.Resources) {
+			return true
+		}
+	}
+	return false
+}
+
+// policy returns the policy with the thresholds of the filesystem
+func (f Filesystem) policy(policy GCPolicy) GCPolicy {
+	if f.HighDiskSpaceThreshold != 0 || f.HighDiskSpaceFree != 0 {
+		policy.HighDiskSpaceThreshold, policy.HighDiskSpaceFree = f.HighDiskSpaceThreshold, f.HighDiskSpaceFree
+	}
+	if f.LowDiskSpaceThreshold != 0 || f.LowDiskSpaceFree != 0 {
+		policy.LowDiskSpaceThreshold, policy.LowDiskSpaceFree = f.LowDiskSpaceThreshold, f.LowDiskSpaceFree
+	}
+	return policy
+}
+
+// withPath adds the path of the filesystem to the log fields when it's not the
+// Docker root monitored by default
+func (f Filesystem) withPath(fields log.Fields) log.Fields {
+	if f.Path != "" {
+		fields["path"] = f.Path
+	}
+	return fields
+}
+
+// ParseFilesystems parses comma separated path:resources:high:low definitions
+// where resources are joined with + and thresholds are what ParseThreshold
+// parses, eg. /var/lib/docker/containers:logs:90:80 or /data:images:10GiB
+// free:20GiB free. Everything after the path is optional.
+func ParseFilesystems(value string) ([]Filesystem, error) {
+	var filesystems []Filesystem
+	for _, definition := range strings.Split(value, ",") {
+		definition = strings.TrimSpace(definition)
+		if definition == "" {
+			continue
+		}
+
+		fields := strings.Split(definition, ":")
+		if len(fields) > 4 || fields[0] == "" {
+			return nil, fmt.Errorf("%s is not valid filesystem", definition)
+		}
+		filesystem := Filesystem{Path: filepath.Clean(fields[0])}
+		if len(fields) > 1 && fields[1] != "" {
+			for _, resource := range strings.Split(fields[1], "+") {
+				if resource == volumesResource {
+					return nil, fmt.Errorf("volumes of %s can't be reclaimed, docker-gc only removes anonymous volumes with their containers", filesystem.Path)
+				}
+				if !helpers.StringInSlice(resource, allResources) {
+					return nil, fmt.Errorf("%s is not valid resource, use one of %s", resource, strings.Join(allResources, ", "))
+				}
+				filesystem.Resources = append(filesystem.Resources, resource)
+			}
+		}
+		var err error
+		if len(fields) > 2 && fields[2] != "" {
+			filesystem.HighDiskSpaceThreshold, filesystem.HighDiskSpaceFree, err = ParseThreshold(fields[2])
+		}
+		if err == nil && len(fields) > 3 && fields[3] != "" {
+			filesystem.LowDiskSpaceThreshold, filesystem.LowDiskSpaceFree, err = ParseThreshold(fields[3])
+			if err == nil && len(fields[2]) > 0 {
+				err = ValidateThresholds(filesystem.HighDiskSpaceThreshold, filesystem.HighDiskSpaceFree,
+					filesystem.LowDiskSpaceThreshold, filesystem.LowDiskSpaceFree)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("thresholds of %s are not valid: %s", filesystem.Path, err)
+		}
+		filesystems = append(filesystems, filesystem)
+	}
+	return filesystems, nil
+}
+
+func (f Filesystem) String() string {
+	definition := f.Path + ":" + strings.Join(f.Resources, "+")
+	if f.HighDiskSpaceThreshold != 0 || f.HighDiskSpaceFree != 0 || f.LowDiskSpaceThreshold != 0 || f.LowDiskSpaceFree != 0 {
+		definition += ":" + FormatThreshold(f.HighDiskSpaceThreshold, f.HighDiskSpaceFree) +
+			":" + FormatThreshold(f.LowDiskSpaceThreshold, f.LowDiskSpaceFree)
+	}
+	return definition
+}
+
+// DiscoverFilesystems finds the filesystems Docker stores its data on and maps
+// them to the resources stored there. Paths on the same filesystem are merged,
+// a volumes directory on its own filesystem isn't monitored as nothing on it
+// can be reclaimed.
+// The extra filesystems override the thresholds and resources of the
+// discovered filesystem they are on, or are monitored on their own.
+func DiscoverFilesystems(extra []Filesystem) ([]Filesystem, error) {
+	finished := timeDockerCall("info", "system")
+	info, err := Client.Info()
+	finished(err)
+	if err != nil {
+		log.WithField("error", err).Error("Getting docker info failed")
+		return nil, err
+	}
+
+	// The root has the resources that are not on a filesystem of their own
+	root := info.DockerRootDir
+	candidates := []Filesystem{
+		{Path: root},
+		{Path: filepath.Join(root, "containers"), Resources: []string{ResourceLogs}},
+		{Path: filepath.Join(root, "buildkit"), Resources: []string{ResourceBuildCache}},
+	}
+	if info.Driver != "" {
+		// Container writable layers are stored with the image layers
+		candidates = append(candidates, Filesystem{Path: filepath.Join(root, info.Driver), Resources: []string{ResourceImages, ResourceContainers}})
+	}
+
+	var filesystems []Filesystem
+	devices := map[uint64]int{}
+	for _, candidate := range candidates {
+		device, err := fileDevice(candidate.Path)
+		if err != nil {
+			continue
+		}
+		i, ok := devices[device]
+		if !ok {
+			i = len(filesystems)
+			devices[device] = i
+			filesystems = append(filesystems, Filesystem{Path: candidate.Path})
+		}
+		filesystems[i].Resources = mergeResources(filesystems[i].Resources, candidate.Resources)
+	}
+	volumes := filepath.Join(root, "volumes")
+	if device, err := fileDevice(volumes); err == nil {
+		if _, ok := devices[device]; !ok {
+			log.WithField("path", volumes).Info("Volumes are on a filesystem of their own, not monitoring it as docker-gc can't reclaim volumes")
+		}
+	}
+	if len(filesystems) > 0 && filesystems[0].Path == root {
+		filesystems[0].Resources = mergeResources(filesystems[0].Resources, unclaimedResources(filesystems[1:]))
+	}
+
+	for _, filesystem := range extra {
+		device, err := fileDevice(filesystem.Path)
+		if i, ok := devices[device]; err == nil && ok {
+			filesystems[i].HighDiskSpaceThreshold = filesystem.HighDiskSpaceThreshold
+			filesystems[i].LowDiskSpaceThreshold = filesystem.LowDiskSpaceThreshold
+			filesystems[i].HighDiskSpaceFree = filesystem.HighDiskSpaceFree
+			filesystems[i].LowDiskSpaceFree = filesystem.LowDiskSpaceFree
+			if len(filesystem.Resources) > 0 {
+				filesystems[i].Resources = filesystem.Resources
+			}
+			continue
+		}
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+				"path":  filesystem.Path,
+			}).Warn("Configured filesystem is not available")
+		}
+		if len(filesystem.Resources) == 0 {
+			filesystem.Resources = allResources
+		}
+		if err == nil {
+			devices[device] = len(filesystems)
+		}
+		filesystems = append(filesystems, filesystem)
+	}
+	return filesystems, nil
+}
+
+// unclaimedResources returns the resources none of the filesystems has
+func unclaimedResources(filesystems []Filesystem) []string {
+	var resources []string
+	for _, resource := range allResources {
+		claimed := false
+		for _, filesystem := range filesystems {
+			claimed = claimed || filesystem.has(resource)
+		}
+		if !claimed {
+			resources = append(resources, resource)
+		}
+	}
+	return resources
+}
+
+func mergeResources(resources []string, more []string) []string {
+	merged := append([]string{}, resources...)
+	for _, resource := range more {
+		if !helpers.StringInSlice(resource, merged) {
+			merged = append(merged, resource)
+		}
+	}
+	return merged
+}
+
+func fileDevice(path string) (uint64, error) {
+	var stat syscall.Stat_t
+	if err := syscall.Stat(path, &stat); err != nil {
+		return 0, err
+	}
+	return uint64(stat.Dev), nil
+}
+
+// monitoredFilesystems returns the filesystems checked in diskspace mode, nil
+// when only the Docker root is monitored
+func monitoredFilesystems(policy GCPolicy) []Filesystem {
+	if !policy.DiscoverFilesystems {
+		return policy.Filesystems
+	}
+	filesystems, err := DiscoverFilesystems(policy.Filesystems)
+	if err != nil {
+		log.WithField("error", err).Error("Discovering filesystems failed, monitoring only the docker root")
+		return nil
+	}
+	return filesystems
+}
@@ -0,0 +1,105 @@
+package gc
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fixedDiskSpaceFetcher int
+
+func (d fixedDiskSpaceFetcher) GetDiskUsage() (DiskUsage, error) {
+	return DiskUsage{BytesUsedPercent: float64(d)}, nil
+}
+
+func TestParseFilesystems(t *testing.T) {
+	filesystems, err := ParseFilesystems("/var/lib/docker/containers:logs:90:80, /mnt/docker/:images+containers, /data")
+	assert.Nil(t, err, "parsing filesystems should succeed")
+	assert.Equal(t, []Filesystem{
+		{Path: "/var/lib/docker/containers", Resources: []string{ResourceLogs}, HighDiskSpaceThreshold: 90, LowDiskSpaceThreshold: 80},
+		{Path: "/mnt/docker", Resources: []string{ResourceImages, ResourceContainers}},
+		{Path: "/data"},
+	}, filesystems, "filesystems are parsed in order")
+	assert.Equal(t, "/var/lib/docker/containers:logs:90%:80%", filesystems[0].String(), "filesystem formats back to its definition")
+
+	for _, value := range []string{"/data:photos", "/data:volumes", "/data:images+volumes", "/data:images:high", "/data:images:101", "/data:images:50:60", "/data:images:1:1:1"} {
+		_, err := ParseFilesystems(value)
+		assert.NotNil(t, err, value+" should not parse")
+	}
+}
+
+func TestDiscoverFilesystems(t *testing.T) {
+	root, err := ioutil.TempDir("", "docker-gc-root")
+	assert.Nil(t, err, "creating temp dir should succeed")
+	defer os.RemoveAll(root)
+	for _, dir := range []string{"containers", "volumes", "overlay2"} {
+		os.Mkdir(filepath.Join(root, dir), 0755)
+	}
+
+	responses := make(testResponseMap)
+	responses["/_ping"] = []response{{"GET", "default", "OK"}}
+	responses["/info"] = []response{{"GET", "default", string(mustMarshal(map[string]string{"DockerRootDir": root, "Driver": "overlay2"}))}}
+
+	hitsPerPath := map[string]int{}
+	server := testServer(responses, &hitsPerPath)
+	defer server.Close()
+
+	Client = nil
+	StartDockerClient(server.URL)
+
+	filesystems, err := DiscoverFilesystems(nil)
+	assert.Nil(t, err, "discovering filesystems should succeed")
+	assert.Equal(t, 1, len(filesystems), "paths on the same filesystem are merged")
+	assert.Equal(t, root, filesystems[0].Path, "root is the path of the merged filesystem")
+	assert.Equal(t, len(allResources), len(filesystems[0].Resources), "everything is cleaned on the root filesystem")
+
+	filesystems, err = DiscoverFilesystems([]Filesystem{
+		{Path: filepath.Join(root, "volumes"), HighDiskSpaceThreshold: 95, LowDiskSpaceThreshold: 90},
+		{Path: "/nonexistent/docker-gc", Resources: []string{ResourceBuildCache}},
+	})
+	assert.Nil(t, err, "discovering filesystems should succeed")
+	assert.Equal(t, 2, len(filesystems), "missing extra filesystem is still monitored")
+	assert.Equal(t, 95.0, filesystems[0].HighDiskSpaceThreshold, "extra filesystem overrides the thresholds of the one it's on")
+	assert.Equal(t, len(allResources), len(filesystems[0].Resources), "extra filesystem without resources keeps the discovered ones")
+}
+
+func TestCleanAllWithFilesystems(t *testing.T) {
+	hitsPerPath := map[string]int{}
+	server := testServer(generateTestData(1, 1, t), &hitsPerPath)
+	defer server.Close()
+
+	Client = nil
+	StartDockerClient(server.URL)
+
+	defer func(fetcher func(string) DiskSpace) { newDiskSpaceFetcher = fetcher }(newDiskSpaceFetcher)
+	fetchers := map[string]DiskSpace{
+		// The Docker root, measured for the report
+		"":            fixedDiskSpaceFetcher(10),
+		"/images":     &FakeDiskSpaceFetcher{},
+		"/containers": fixedDiskSpaceFetcher(10),
+	}
+	newDiskSpaceFetcher = func(path string) DiskSpace { return fetchers[path] }
+
+	var reports []Report
+	reportHooks = nil
+	AddReportHook(func(report Report) { reports = append(reports, report) })
+	defer func() { reportHooks = nil }()
+
+	CleanAllWithDiskSpacePolicy(GCPolicy{
+		HighDiskSpaceThreshold: 99,
+		LowDiskSpaceThreshold:  0,
+		TtlContainers:          1000 * time.Hour,
+		Filesystems: []Filesystem{
+			{Path: "/images", Resources: []string{ResourceImages}},
+			{Path: "/containers", Resources: []string{ResourceContainers, ResourceLogs}, HighDiskSpaceThreshold: 50},
+		},
+	})
+
+	assert.Equal(t, 1, len(reports), "one report covers all filesystems")
+	assert.Equal(t, 5, reports[0].Images.Deleted, "images are cleaned on the full filesystem")
+	assert.Equal(t, 0, reports[0].Containers.Deleted, "containers are kept for their TTL on the filesystem below threshold")
+}
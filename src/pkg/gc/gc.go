@@ -1,16 +1,17 @@
 package gc
 
 import (
-	"math"
+	"fmt"
 	"os"
 	"pkg/helpers"
+	"pkg/notify"
 	"pkg/statsd"
+	"strings"
 	"syscall"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/fsouza/go-dockerclient"
-	"github.com/n1koo/gocron"
 )
 
 const (
@@ -18,6 +19,7 @@ const (
 	StatsdSamplingRate = 1.0
 	BatchSizeToDelete  = 10
 	Image              = "image"
+	DanglingImage      = "dangling image"
 	Container          = "container"
 	DatePolicy         = "date"
 	DiskPolicy         = "disk"
@@ -28,36 +30,130 @@ var (
 	diskSpaceFetcher DiskSpace
 )
 
-type DiskSpaceFetcher struct{}
+// DiskSpaceFetcher reads the disk space of the filesystem of Path, the Docker
+// root when empty
+type DiskSpaceFetcher struct {
+	Path string
+}
 type DiskSpace interface {
-	GetUsedDiskSpaceInPercents() (int, error)
+	GetDiskUsage() (DiskUsage, error)
+}
+
+// ImageInfo is an image known to the daemon with the data GC policies are
+// evaluated against
+type ImageInfo struct {
+	ID       string    `json:"id"`
+	RepoTags []string  `json:"repoTags,omitempty"`
+	Created  time.Time `json:"created"`
+	Size     int64     `json:"size"`
+	UsedBy   []string  `json:"usedBy,omitempty"`
+	// Untagged and not a parent of any other image
+	Dangling bool `json:"dangling"`
+}
+
+// ContainerInfo is a finished container with the data GC policies are
+// evaluated against
+type ContainerInfo struct {
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	State      string    `json:"state"`
+	Image      string    `json:"image"`
+	ImageName  string    `json:"imageName"`
+	Created    time.Time `json:"created"`
+	FinishedAt time.Time `json:"finishedAt"`
+	ExitCode   int       `json:"exitCode"`
+	OOMKilled  bool      `json:"oomKilled"`
+	Size       int64     `json:"size,omitempty"`
 }
 
 type GCPolicy struct {
-	HighDiskSpaceThreshold int
-	LowDiskSpaceThreshold  int
-	TtlContainers          time.Duration
-	TtlImages              time.Duration
+	// Used disk space in percents, replaced by the free space in bytes when
+	// the Free threshold is set
+	HighDiskSpaceThreshold float64
+	LowDiskSpaceThreshold  float64
+	HighDiskSpaceFree      int64
+	LowDiskSpaceFree       int64
+	// Inode usage has the disk space thresholds unless HighInodeThreshold is
+	// set
+	HighInodeThreshold float64
+	LowInodeThreshold  float64
+	TtlContainers      time.Duration
+	TtlImages          time.Duration
+	// Finished containers get the TTL of the first matching rule, the ones no
+	// rule matches are kept for TtlContainers
+	ContainerRules []ContainerRule
+	// Containers created but never started are collected by their creation
+	// time only when they have a TTL
+	TtlCreatedContainers *time.Duration
+	// Dangling images are kept for TtlImages unless they have their own TTL
+	TtlDanglingImages *time.Duration
+	// With tag GC each tag is kept for TtlImages from when it was first seen,
+	// stale tags are untagged and images are only removed when all of their
+	// tags are stale. Tags matching ProtectedTags are never stale.
+	TagGC         bool
+	ProtectedTags []string
+	// Build cache is only pruned when enabled, unused for longer than the TTL
+	// and down to keeping at most BuildCacheKeepStorage bytes
+	PruneBuildCache       bool
+	TtlBuildCache         time.Duration
+	BuildCacheKeepStorage int64
+	// Container logs larger than this are truncated in diskspace mode, zero
+	// disables log cleanup
+	MaxLogSize int64
+	// Bytes kept from the end of a truncated log
+	LogKeepTail int64
+	// Save the whole log compressed next to it and empty it instead of
+	// keeping its tail, with at most MaxRotatedLogs saved logs kept
+	RotateLogs     bool
+	MaxRotatedLogs int
+	// Filesystems monitored in diskspace mode instead of the Docker root, with
+	// DiscoverFilesystems they are added to the ones Docker stores data on
+	Filesystems         []Filesystem
+	DiscoverFilesystems bool
+	// Cleanup starts early when the high threshold is projected to be reached
+	// within the horizon at the fill rate of the window, zero horizon
+	// disables prediction
+	PredictionHorizon time.Duration
+	PredictionWindow  time.Duration
+	// Deletions in TTL mode only happen when the maintenance windows allow
+	MaintenanceWindows []MaintenanceWindow
+	// At most this many images and containers are deleted in a single run,
+	// zero for no cap
+	MaxDeletions int
+	// Fallback is used in diskspace mode when cleaning with this policy
+	// couldn't reach the low threshold
+	Fallback *GCPolicy
+}
+
+// imageTtl returns how long the policy keeps the image
+func (p GCPolicy) imageTtl(image ImageInfo) time.Duration {
+	if image.Dangling && p.TtlDanglingImages != nil {
+		return *p.TtlDanglingImages
+	}
+	return p.TtlImages
+}
+
+// imageGroup has the images removed with the same TTL by creation date
+type imageGroup struct {
+	dataType string
+	ttl      time.Duration
+	dataMap  map[int64][]string
 }
 
 func StartDockerClientDefault() *docker.Client {
 	return StartDockerClient(DockerEndpoint)
 }
 
+// StartDockerClient starts the Docker client of one-time commands, exiting
+// when the daemon doesn't answer
 func StartDockerClient(endpoint string) *docker.Client {
-	var err error
-
 	if Client != nil {
 		log.Warn("Docker client already initialized, reinitialize happening")
 	}
 
-	Client, err = docker.NewClient(endpoint)
-	if err != nil {
-		log.WithField("error", err).Fatal("Error creating Docker client")
-		os.Exit(1)
-	}
-
-	err = Client.Ping()
+	newDockerClient(endpoint)
+	daemon = nil
+	err := Client.Ping()
 	if err != nil {
 		log.WithField("error", err).Fatal("Error talking to Docker API when initializing client")
 		os.Exit(1)
@@ -66,79 +162,199 @@ func StartDockerClient(endpoint string) *docker.Client {
 	return nil
 }
 
-func DiskSpaceGC(intervalInSeconds uint64, policy GCPolicy) {
+func DiskSpaceGC(scheduler *Scheduler, intervalInSeconds uint64, policy GCPolicy) {
 	diskSpaceFetcher = &DiskSpaceFetcher{}
-	gocron.Every(intervalInSeconds).Seconds().Do(CleanAllWithDiskSpacePolicy, policy)
+	scheduler.Every(time.Duration(intervalInSeconds)*time.Second, DiskPolicy, func() { CleanAllWithDiskSpacePolicy(policy) })
 	log.Info("Continous run started in diskspace mode with interval (in seconds): ", intervalInSeconds)
-	gocron.Start()
 }
 
-func TtlGC(intervalInSeconds uint64, policy GCPolicy) {
-	gocron.Every(intervalInSeconds).Seconds().Do(CleanAll, DatePolicy, policy)
+func TtlGC(scheduler *Scheduler, intervalInSeconds uint64, policy GCPolicy) {
+	scheduler.Every(time.Duration(intervalInSeconds)*time.Second, DatePolicy, func() { CleanAll(DatePolicy, policy) })
 	log.Info("Continous run started in timebased mode with interval (in seconds): ", intervalInSeconds)
-	gocron.Start()
 }
 
-func StopGC() {
-	gocron.Clear()
+func CleanAllWithDiskSpacePolicy(policy GCPolicy) {
+	report := newReport(DiskPolicy)
+	report.maxDeletions = policy.MaxDeletions
+	defer publishReport(report)
+
+	filesystems := monitoredFilesystems(policy)
+	if len(filesystems) == 0 {
+		cleanFilesystem(diskSpaceFetcher, Filesystem{Resources: allResources}, policy, report)
+		return
+	}
+	for _, filesystem := range filesystems {
+		if sweepPreempted() {
+			return
+		}
+		cleanFilesystem(newDiskSpaceFetcher(filesystem.Path), filesystem, filesystem.policy(policy), report)
+	}
 }
 
-func CleanAllWithDiskSpacePolicy(policy GCPolicy) {
-	usedDiskSpace, diskErr := diskSpaceFetcher.GetUsedDiskSpaceInPercents()
+// cleanFilesystem cleans the resources of the filesystem when its used disk
+// space has reached the high threshold
+func cleanFilesystem(disk DiskSpace, filesystem Filesystem, policy GCPolicy, report *Report) {
+	usage, diskErr := disk.GetDiskUsage()
 	if diskErr != nil {
 		log.WithField("error", diskErr).Error("Reading disk space failed")
+		report.Error = diskErr.Error()
 		return
 	}
+	gaugeDiskUsage(filesystem, usage)
+	highInodeThreshold, lowInodeThreshold := policy.inodeThresholds()
 
-	if usedDiskSpace >= policy.HighDiskSpaceThreshold {
-		log.WithFields(log.Fields{
-			"currentUsedDiskSpace":   usedDiskSpace,
-			"highDiskSpaceThreshold": policy.HighDiskSpaceThreshold,
-			"lowDiskSpaceThreshold":  policy.LowDiskSpaceThreshold,
-		}).Info("Cleaning images to reach low used disk space threshold")
-		cleanedContainers, cleanedImages := CleanAll(DiskPolicy, policy)
-		usedDiskSpace, diskErr := diskSpaceFetcher.GetUsedDiskSpaceInPercents()
+	triggers := policy.triggers(usage)
+	if predictTrigger(filesystem, usage, policy) && len(triggers) == 0 {
+		triggers = []string{TriggerPredicted}
+	}
+	if len(triggers) > 0 {
+		report.recordTriggers(triggers)
+		log.WithFields(filesystem.withPath(log.Fields{
+			"currentUsedDiskSpace":   usage.usedPercent(),
+			"usedBlocks":             usage.BytesUsedPercent,
+			"usedInodes":             usage.InodesUsedPercent,
+			"triggers":               triggers,
+			"highDiskSpaceThreshold": policy.highThreshold(),
+			"lowDiskSpaceThreshold":  policy.lowThreshold(),
+			"highInodeThreshold":     highInodeThreshold,
+			"lowInodeThreshold":      lowInodeThreshold,
+		})).Info("Cleaning images to reach low used disk space threshold")
+		notify.Notify(notify.HighThresholdReached, "Used disk space reached high threshold, cleaning images", filesystem.withPath(log.Fields{
+			"usedDiskSpace":          usage.usedPercent(),
+			"usedBlocks":             usage.BytesUsedPercent,
+			"usedInodes":             usage.InodesUsedPercent,
+			"triggers":               triggers,
+			"highDiskSpaceThreshold": policy.highThreshold(),
+			"lowDiskSpaceThreshold":  policy.lowThreshold(),
+			"highInodeThreshold":     highInodeThreshold,
+			"lowInodeThreshold":      lowInodeThreshold,
+		}))
+		// A preempted sweep skips its remaining steps
+		if policy.PruneBuildCache && filesystem.has(ResourceBuildCache) && !sweepPreempted() {
+			pruneBuildCache(policy, report)
+		}
+		if policy.MaxLogSize > 0 && filesystem.has(ResourceLogs) && !sweepPreempted() {
+			cleanLogs(policy, report)
+		}
+		cleanedContainers, cleanedImages := cleanAll(DiskPolicy, disk, filesystem, policy, report)
+		usage, diskErr := disk.GetDiskUsage()
 		if diskErr != nil {
 			log.WithField("error", diskErr).Error("Reading disk space failed")
+			report.Error = diskErr.Error()
 			return
 		}
-		log.WithFields(log.Fields{
+		if !policy.lowReached(usage) && policy.Fallback != nil && !sweepPreempted() {
+			fallback := *policy.Fallback
+			fallback.HighDiskSpaceThreshold = policy.HighDiskSpaceThreshold
+			fallback.LowDiskSpaceThreshold = policy.LowDiskSpaceThreshold
+			fallback.HighDiskSpaceFree = policy.HighDiskSpaceFree
+			fallback.LowDiskSpaceFree = policy.LowDiskSpaceFree
+			fallback.HighInodeThreshold = policy.HighInodeThreshold
+			fallback.LowInodeThreshold = policy.LowInodeThreshold
+			log.WithFields(log.Fields{
+				"currentUsedDiskSpace":  usage.usedPercent(),
+				"lowDiskSpaceThreshold": policy.lowThreshold(),
+				"lowInodeThreshold":     lowInodeThreshold,
+				"containersTtl":         fallback.TtlContainers,
+				"imagesTtl":             fallback.TtlImages,
+			}).Warn("Low disk space threshold not reached, escalating to fallback policy")
+			fallbackContainers, fallbackImages := cleanAll(DiskPolicy, disk, filesystem, fallback, report)
+			cleanedContainers += fallbackContainers
+			cleanedImages += fallbackImages
+			usage, diskErr = disk.GetDiskUsage()
+			if diskErr != nil {
+				log.WithField("error", diskErr).Error("Reading disk space failed")
+				report.Error = diskErr.Error()
+				return
+			}
+		}
+		log.WithFields(filesystem.withPath(log.Fields{
 			"cleanedContainer": cleanedContainers,
 			"cleanedImages":    cleanedImages,
-			"usedDiskSpace":    usedDiskSpace,
-		}).Info("Cleaning images finished")
+			"usedDiskSpace":    usage.usedPercent(),
+			"usedBlocks":       usage.BytesUsedPercent,
+			"usedInodes":       usage.InodesUsedPercent,
+		})).Info("Cleaning images finished")
+		if !policy.lowReached(usage) && !sweepPreempted() {
+			breakdown := reportUnreclaimablePressure(filesystem, usage, policy)
+			notify.Notify(notify.LowThresholdNotReached, "Cleaning images could not reach low disk space threshold", filesystem.withPath(log.Fields{
+				"cleanedContainers":     cleanedContainers,
+				"cleanedImages":         cleanedImages,
+				"usedDiskSpace":         usage.usedPercent(),
+				"usedBlocks":            usage.BytesUsedPercent,
+				"usedInodes":            usage.InodesUsedPercent,
+				"lowDiskSpaceThreshold": policy.lowThreshold(),
+				"lowInodeThreshold":     lowInodeThreshold,
+				"breakdown":             breakdown,
+			}))
+		}
 	} else {
-		log.WithFields(log.Fields{
-			"currentUsedDiskSpace":   usedDiskSpace,
-			"highDiskSpaceThreshold": policy.HighDiskSpaceThreshold,
-			"lowDiskSpaceThreshold":  policy.LowDiskSpaceThreshold,
-		}).Info("Disk space threshold not reached, cleaning only the containers based on TTL")
-		CleanContainers(policy.TtlContainers)
+		log.WithFields(filesystem.withPath(log.Fields{
+			"currentUsedDiskSpace":   usage.usedPercent(),
+			"usedBlocks":             usage.BytesUsedPercent,
+			"usedInodes":             usage.InodesUsedPercent,
+			"highDiskSpaceThreshold": policy.highThreshold(),
+			"lowDiskSpaceThreshold":  policy.lowThreshold(),
+			"highInodeThreshold":     highInodeThreshold,
+			"lowInodeThreshold":      lowInodeThreshold,
+		})).Info("Disk space threshold not reached, cleaning only the containers based on TTL")
+		if filesystem.has(ResourceContainers) {
+			removeContainersBasedOnAge(policy, report)
+		}
 	}
 }
 
 func CleanImages(ttl time.Duration) int {
-	return removeDataBasedOnAge(getImages(), Image, ttl)
+	report := newReport(DatePolicy)
+	defer publishReport(report)
+	return removeImagesBasedOnAge(GCPolicy{TtlImages: ttl}, report)
+}
+
+// CleanDanglingImages removes only the untagged images older than ttl
+func CleanDanglingImages(ttl time.Duration) int {
+	report := newReport(DatePolicy)
+	defer publishReport(report)
+	_, dangling := getImageGroups(GCPolicy{TtlDanglingImages: &ttl}, report)
+	return removeDataBasedOnAge(dangling.dataMap, dangling.dataType, dangling.ttl, report)
 }
 
 func CleanContainers(ttl time.Duration) int {
-	return removeDataBasedOnAge(getFinishedContainers(), Container, ttl)
+	report := newReport(DatePolicy)
+	defer publishReport(report)
+	return removeContainersBasedOnAge(GCPolicy{TtlContainers: ttl}, report)
 }
 
 func CleanAll(mode string, policy GCPolicy) (int, int) {
+	report := newReport(mode)
+	report.maxDeletions = policy.MaxDeletions
+	defer publishReport(report)
+	return cleanAll(mode, diskSpaceFetcher, Filesystem{Resources: allResources}, policy, report)
+}
+
+// cleanAll removes the containers and images of the policy. In diskspace mode
+// only the ones reclaiming space on the filesystem are removed, images only
+// until the disk reaches the low threshold.
+func cleanAll(mode string, disk DiskSpace, filesystem Filesystem, policy GCPolicy, report *Report) (int, int) {
+	if sweepPreempted() {
+		return 0, 0
+	}
 	log.Info("Cleaning all images/containers")
-	statsd.Count("clean.start", 1, []string{}, StatsdSamplingRate)
+	statsd.Count("clean.start", 1, []string{policyTag(report.Mode)}, StatsdSamplingRate)
 
 	var removedContainers int
 	var removedImages int
 
 	switch mode {
 	case DiskPolicy:
-		removedContainers = removeDataBasedOnAge(getFinishedContainers(), Container, policy.TtlContainers)
-		removedImages = removeImagesInBatch(policy)
+		// Anonymous volumes are removed with their containers
+		if filesystem.has(ResourceContainers) {
+			removedContainers = removeContainersBasedOnAge(policy, report)
+		}
+		if filesystem.has(ResourceImages) && !sweepPreempted() {
+			removedImages = removeImagesInBatch(disk, policy, report)
+		}
 	case DatePolicy:
-		removedContainers = removeDataBasedOnAge(getFinishedContainers(), Container, policy.TtlContainers)
-		removedImages = removeDataBasedOnAge(getImages(), Image, policy.TtlImages)
+		removedContainers, removedImages = cleanResourcesBasedOnAge(ttlResources, policy, report)
 	default:
 		log.Error(mode + " is not valid policy")
 		os.Exit(2)
@@ -146,133 +362,247 @@ func CleanAll(mode string, policy GCPolicy) (int, int) {
 	return removedContainers, removedImages
 }
 
-func getDockerRoot() string {
+// getDockerRoot returns the Docker root directory, callers log the error
+func getDockerRoot() (string, error) {
+	finished := timeDockerCall("info", "system")
 	info, err := Client.Info()
+	finished(err)
 	if err != nil {
-		log.WithField("error", err).Error("Getting docker info failed")
-		os.Exit(1)
+		return "", fmt.Errorf("getting docker info failed: %s", err)
 	}
 
-	return info.DockerRootDir
+	return info.DockerRootDir, nil
 }
 
-func getImagesInUse() []string {
+func getImagesInUse() map[string][]string {
 	containersList := getRunningContainers()
-	var usedImages []string
+	usedImages := map[string][]string{}
 
+	defer timePhase(phaseHistory)()
 	for _, container := range containersList {
-		usedImages = append(usedImages, container.Image)
+		usedImages[container.Image] = append(usedImages[container.Image], container.ID)
+		finished := timeDockerCall("images.history", Image)
 		imageHistory, err := Client.ImageHistory(container.Image)
+		finished(err)
 		if err != nil {
 			log.WithField("error", err).Error("Getting image history failed")
 			continue
 		}
 		for _, image := range imageHistory {
-			usedImages = append(usedImages, image.ID)
+			if image.ID != container.Image {
+				usedImages[image.ID] = append(usedImages[image.ID], container.ID)
+			}
 		}
 	}
 
 	return usedImages
 }
 
-func getImages() map[int64][]string {
-	imageMap := map[int64][]string{}
+// listImages returns all images known to the daemon, including the running
+// containers that keep each of them in use
+func listImages() ([]ImageInfo, error) {
+	finishedListing := timePhase(phaseListing)
+	finished := timeDockerCall("images.list", Image)
 	imageData, err := Client.ListImages(docker.ListImagesOptions{All: true})
+	finished(err)
+	finishedListing()
 	if err != nil {
-		log.WithField("error", err).Error("Listing images error")
-		return imageMap
+		return nil, err
 	}
 
 	usedImages := getImagesInUse()
+	parents := map[string]bool{}
+	for _, data := range imageData {
+		parents[data.ParentID] = true
+	}
 
+	images := make([]ImageInfo, 0, len(imageData))
 	for _, data := range imageData {
-		if !helpers.StringInSlice(data.ID, usedImages) {
-			imageMap[data.Created] = append(imageMap[data.Created], data.ID)
+		size := data.VirtualSize
+		if size == 0 {
+			size = data.Size
+		}
+		images = append(images, ImageInfo{
+			ID:       data.ID,
+			RepoTags: data.RepoTags,
+			Created:  time.Unix(data.Created, 0),
+			Size:     size,
+			UsedBy:   usedImages[data.ID],
+			Dangling: isUntagged(data.RepoTags) && !parents[data.ID],
+		})
+	}
+	return images, nil
+}
+
+// getImageGroups returns the images not in use split to the ones removed with
+// TtlImages and the dangling ones removed with their own TTL
+func getImageGroups(policy GCPolicy, report *Report) (imageGroup, imageGroup) {
+	images, err := listImages()
+	if err != nil {
+		log.WithField("error", err).Error("Listing images error")
+		report.Error = err.Error()
+	}
+
+	report.Images.Inventory = len(images)
+	for _, image := range images {
+		report.sizes[image.ID] = image.Size
+		report.repositories[image.ID] = repositoryOf(firstTag(image.RepoTags))
+	}
+	statsd.TaggedGauge("image.amount", float64(len(images)), []string{resourceTag(Image)}, StatsdSamplingRate)
+	if policy.TagGC && err == nil {
+		images = untagStaleTags(images, policy, report)
+	}
+	for _, image := range images {
+		report.tagged[image.ID] = !isUntagged(image.RepoTags)
+	}
+	return groupImages(images, policy, report.Mode)
+}
+
+// groupImages splits the images the cleanup of the mode decides to delete to
+// the tagged and the dangling ones
+func groupImages(images []ImageInfo, policy GCPolicy, mode string) (imageGroup, imageGroup) {
+	tagged := imageGroup{dataType: Image, ttl: policy.TtlImages, dataMap: map[int64][]string{}}
+	dangling := imageGroup{dataType: DanglingImage, ttl: policy.TtlImages, dataMap: map[int64][]string{}}
+	if policy.TtlDanglingImages != nil {
+		dangling.ttl = *policy.TtlDanglingImages
+	}
+
+	for _, image := range images {
+		if !evaluateImage(image, policy, mode).delete {
+			continue
+		}
+		date := image.Created.Unix()
+		if image.Dangling {
+			dangling.dataMap[date] = append(dangling.dataMap[date], image.ID)
+		} else {
+			tagged.dataMap[date] = append(tagged.dataMap[date], image.ID)
 		}
 	}
-	statsd.Gauge("image.amount", len(imageData))
-	return imageMap
+	return tagged, dangling
 }
 
-func getFinishedContainers() map[int64][]string {
-	containerMap := map[int64][]string{}
+func removeImagesBasedOnAge(policy GCPolicy, report *Report) int {
+	tagged, dangling := getImageGroups(policy, report)
+	removed := removeDataBasedOnAge(tagged.dataMap, tagged.dataType, tagged.ttl, report)
+	return removed + removeDataBasedOnAge(dangling.dataMap, dangling.dataType, dangling.ttl, report)
+}
 
+// listFinishedContainers returns the exited and dead containers with the
+// data from their full inspection. Computing the size is expensive for the
+// daemon so it's only done when asked for.
+func listFinishedContainers(withSize bool) ([]ContainerInfo, error) {
 	//XXX: Support for dead is only in 1.10 https://github.com/docker/docker/pull/17908
-	options := docker.ListContainersOptions{Filters: map[string][]string{"status": {"exited", "dead"}}}
-	exited, err := Client.ListContainers(options)
+	containers, listed, err := listContainersInState([]string{"exited", "dead"}, withSize)
 	if err != nil {
-		log.WithField("error", err).Error("Listing containers error")
-		return containerMap
+		return nil, err
+	}
+
+	amounts := map[string]int{"exited": 0, "dead": 0}
+	for _, container := range containers {
+		amounts[container.State]++
+	}
+	tags := []string{resourceTag(Container)}
+	statsd.TaggedGauge("container.dead.amount", float64(listed), tags, StatsdSamplingRate)
+	statsd.TaggedGauge("container.state.exited.amount", float64(amounts["exited"]), tags, StatsdSamplingRate)
+	statsd.TaggedGauge("container.state.dead.amount", float64(amounts["dead"]), tags, StatsdSamplingRate)
+	return containers, nil
+}
+
+// listContainersInState returns the inspected containers in the given states
+// and how many containers the daemon listed
+func listContainersInState(states []string, withSize bool) ([]ContainerInfo, int, error) {
+	options := docker.ListContainersOptions{Size: withSize, Filters: map[string][]string{"status": states}}
+	finishedListing := timePhase(phaseListing)
+	finished := timeDockerCall("containers.list", Container)
+	listedContainers, err := Client.ListContainers(options)
+	finished(err)
+	finishedListing()
+	if err != nil {
+		return nil, 0, err
 	}
 
-	for _, data := range exited {
-		data, cErr := Client.InspectContainer(data.ID)
+	defer timePhase(phaseInspection)()
+	containers := make([]ContainerInfo, 0, len(listedContainers))
+	for _, listed := range listedContainers {
+		finished := timeDockerCall("containers.inspect", Container)
+		data, cErr := Client.InspectContainer(listed.ID)
+		finished(cErr)
 		if cErr != nil {
 			log.WithField("error", cErr).Error("Fetching container full data error")
 		} else {
-			date := data.State.FinishedAt.Unix()
-			containerMap[date] = append(containerMap[date], data.ID)
+			imageName := listed.Image
+			if data.Config != nil {
+				imageName = data.Config.Image
+			}
+			state := data.State.Status
+			if state == "" {
+				// Status is only in API 1.21 and newer
+				state = "exited"
+				if data.State.Dead {
+					state = "dead"
+				}
+			}
+			containers = append(containers, ContainerInfo{
+				ID:         data.ID,
+				State:      state,
+				Name:       strings.TrimPrefix(data.Name, "/"),
+				Image:      data.Image,
+				ImageName:  imageName,
+				Created:    data.Created,
+				FinishedAt: data.State.FinishedAt,
+				ExitCode:   data.State.ExitCode,
+				OOMKilled:  data.State.OOMKilled,
+				Size:       listed.SizeRw,
+			})
 		}
 
 	}
-	statsd.Gauge("container.dead.amount", len(exited))
-	return containerMap
+	return containers, len(listedContainers), nil
 }
 
 func getRunningContainers() []docker.APIContainers {
 	options := docker.ListContainersOptions{Filters: map[string][]string{"status": {"running"}}}
+	defer timePhase(phaseListing)()
+	finished := timeDockerCall("containers.list", Container)
 	running, err := Client.ListContainers(options)
+	finished(err)
 	if err != nil {
 		log.WithField("error", err).Error("Listing containers error")
 	}
 	return running
 }
 
-func removeImagesInBatch(policy GCPolicy) int {
-	dataMap := getImages()
+func removeImagesInBatch(disk DiskSpace, policy GCPolicy, report *Report) int {
+	tagged, dangling := getImageGroups(policy, report)
+	groups := []imageGroup{tagged, dangling}
 
 	totalDeletedImages := 0
-	batchCounter := 0
 
-	dates := helpers.SortDataMap(dataMap)
-
-	usedDiskSpace, diskErr := diskSpaceFetcher.GetUsedDiskSpaceInPercents()
+	usage, diskErr := disk.GetDiskUsage()
 	if diskErr != nil {
 		log.WithField("error", diskErr).Error("Reading disk space failed")
 		return 0
 	}
 
-	for usedDiskSpace > policy.LowDiskSpaceThreshold {
-		var batch []int64
-		if len(dates) > BatchSizeToDelete {
-			// Two pointers to move so that we can have like 0:10, 10:20 etc
-			start := BatchSizeToDelete * batchCounter
-			end := start + BatchSizeToDelete
-
-			if start >= len(dates) {
-				break
-			}
-
-			if end > len(dates) {
-				end = len(dates)
-			}
+	var batches []imageBatch
+	if triggers := policy.triggers(usage); len(triggers) == 1 && triggers[0] == TriggerInodes {
+		log.Info("Cleanup triggered by inode usage, removing images with most files first")
+		batches = inodeBatches(groups, estimateImageFiles(groups))
+	} else {
+		batches = dateBatches(groups)
+	}
 
-			batch = dates[start:end]
-		} else {
-			batch = dates
+	for _, batch := range batches {
+		if policy.lowReached(usage) || sweepPreempted() || deletionCapReached(report) {
+			break
 		}
 
-		// Create a new map with only the values in the batch
-		batchDataMap := map[int64][]string{}
-		for _, date := range batch {
-			//Notice this might not be exactly BatchSizeToDelete because there might multiple images created at same exact moment
-			batchDataMap[date] = dataMap[date]
+		//Notice this might not be exactly BatchSizeToDelete because there might multiple images created at same exact moment
+		for i, group := range groups {
+			totalDeletedImages = totalDeletedImages + removeDataBasedOnAge(batch[i], group.dataType, group.ttl, report)
 		}
 
-		totalDeletedImages = totalDeletedImages + removeDataBasedOnAge(batchDataMap, Image, policy.TtlImages)
-		batchCounter++
-
-		usedDiskSpace, diskErr = diskSpaceFetcher.GetUsedDiskSpaceInPercents()
+		usage, diskErr = disk.GetDiskUsage()
 		if diskErr != nil {
 			log.WithField("error", diskErr).Error("Reading disk space failed")
 			break
@@ -282,34 +612,134 @@ func removeImagesInBatch(policy GCPolicy) int {
 	return totalDeletedImages
 }
 
-func removeDataBasedOnAge(dataMap map[int64][]string, dataType string, keepLast time.Duration) int {
+// imageBatch has the images of each image group removed together in
+// diskspace mode
+type imageBatch []map[int64][]string
+
+// dateBatches batches the images by creation date, oldest first
+func dateBatches(groups []imageGroup) []imageBatch {
+	var dataMaps []map[int64][]string
+	for _, group := range groups {
+		dataMaps = append(dataMaps, group.dataMap)
+	}
+
+	var batches []imageBatch
+	for _, dates := range evictionBatches(mergeDataMaps(dataMaps...)) {
+		batch := make(imageBatch, len(groups))
+		for i, group := range groups {
+			batch[i] = batchOf(group.dataMap, dates)
+		}
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+// evictionBatches splits the creation dates of the images into the batches
+// removed in diskspace mode, oldest first
+func evictionBatches(dataMap map[int64][]string) [][]int64 {
+	var batches [][]int64
+	dates := helpers.SortDataMap(dataMap)
+
+	// Two pointers to move so that we can have like 0:10, 10:20 etc
+	for start := 0; start < len(dates); start += BatchSizeToDelete {
+		end := start + BatchSizeToDelete
+		if end > len(dates) {
+			end = len(dates)
+		}
+		batches = append(batches, dates[start:end])
+	}
+	return batches
+}
+
+// mergeDataMaps combines the ids by date of the given maps
+func mergeDataMaps(dataMaps ...map[int64][]string) map[int64][]string {
+	merged := map[int64][]string{}
+	for _, dataMap := range dataMaps {
+		for date, ids := range dataMap {
+			merged[date] = append(merged[date], ids...)
+		}
+	}
+	return merged
+}
+
+// firstTag returns the first of the tags that isn't the untagged placeholder
+func firstTag(repoTags []string) string {
+	for _, tag := range repoTags {
+		if tag != untaggedTag {
+			return tag
+		}
+	}
+	return ""
+}
+
+func isUntagged(repoTags []string) bool {
+	for _, tag := range repoTags {
+		if tag != untaggedTag {
+			return false
+		}
+	}
+	return true
+}
+
+// removeDataBasedOnAge removes the data of the map, which has only what the
+// cleanup decided to delete, newest first
+func removeDataBasedOnAge(dataMap map[int64][]string, dataType string, keepLast time.Duration, report *Report) int {
+	defer timePhase(phaseDeletion)()
 	var deletedData int
 	dates := helpers.SortDataMapReverse(dataMap)
 	for _, date := range dates {
 		for _, id := range dataMap[date] {
+			if sweepPreempted() || deletionCapReached(report) {
+				return deletedData
+			}
 			ageOfData := time.Since(time.Unix(date, 0))
-			// If container/image is older than our threshold, delete it
-			if ageOfData > keepLast {
-				log.WithFields(log.Fields{
-					"type":      dataType,
-					"expires":   ageOfData - keepLast,
-					"age":       ageOfData,
-					"threshold": keepLast,
-				}).Info("Trying to delete "+dataType+": ", id)
-				if succeeded := removeData(id, dataType); succeeded {
-					deletedData++
-				}
+			log.WithFields(log.Fields{
+				"type":      dataType,
+				"expires":   ageOfData - keepLast,
+				"age":       ageOfData,
+				"threshold": keepLast,
+			}).Info("Trying to delete "+dataType+": ", id)
+			succeeded := removeData(id, dataType, report)
+			report.record(id, dataType, succeeded)
+			if succeeded {
+				deletedData++
 			}
 		}
 	}
 	return deletedData
 }
 
-func removeData(id, dataType string) bool {
-	if dataType == Image {
+// deletionCapReached tells whether the run has deleted as many images and
+// containers as its policy allows, notifying the first time it stops a
+// deletion
+func deletionCapReached(report *Report) bool {
+	if report.maxDeletions <= 0 || report.Images.Deleted+report.Containers.Deleted < report.maxDeletions {
+		return false
+	}
+	if !report.DeletionCapReached {
+		report.DeletionCapReached = true
+		fields := log.Fields{
+			"maxDeletions":      report.maxDeletions,
+			"deletedImages":     report.Images.Deleted,
+			"deletedContainers": report.Containers.Deleted,
+		}
+		log.WithFields(fields).Warn("Max deletions per run reached, leaving the rest for the next run")
+		statsd.Count("deletion.cap_reached", 1, []string{policyTag(report.Mode)}, StatsdSamplingRate)
+		notify.Notify(notify.DeletionCapReached, "Cleanup reached the max deletions per run", fields)
+	}
+	return true
+}
+
+func removeData(id, dataType string, report *Report) bool {
+	tags := []string{resourceTag(dataType), policyTag(report.Mode)}
+	if dataType == Image || dataType == DanglingImage {
 		// Prune false : don't delete untagged parents automatically since those might still be inside accepted TTL
 		// Force true : delete tagged images (since we dont want to explicitely call out to untag first)
-		err := Client.RemoveImageExtended(id, docker.RemoveImageOptions{NoPrune: true, Force: true})
+		// Untagged images are not forced so that the daemon refuses to remove them if something started using them
+		finished := timeDockerCall("images.remove", Image)
+		err := Client.RemoveImageExtended(id, docker.RemoveImageOptions{NoPrune: true, Force: report.tagged[id]})
+		finished(err)
+		countDeletion(dataType, report.Mode, report.repositories[id], err)
 		if err != nil {
 			log.WithFields(log.Fields{
 				"error": err,
@@ -317,17 +747,22 @@ func removeData(id, dataType string) bool {
 			}).Error("Image deletion error")
 			return false
 		}
-		statsd.Count("image.deleted", 1, []string{}, StatsdSamplingRate)
-	} else if dataType == Container {
-		err := Client.RemoveContainer(docker.RemoveContainerOptions{ID: id})
+		if repository := report.repositories[id]; repository != "" {
+			tags = append(tags, repositoryTag(repository))
+		}
+		statsd.Count("image.deleted", 1, tags, StatsdSamplingRate)
+	} else if dataType == Container || dataType == ContainerWithVolumes || dataType == CreatedContainer {
+		state := report.states[id]
+		options := docker.RemoveContainerOptions{ID: id, RemoveVolumes: dataType == ContainerWithVolumes}
+		err := removeContainer(options, state)
+		countDeletion(dataType, report.Mode, "", err)
 		if err != nil {
-			log.WithFields(log.Fields{
-				"error": err,
-				"id":    id,
-			}).Error("Container deletion error")
 			return false
 		}
-		statsd.Count("container.deleted", 1, []string{}, StatsdSamplingRate)
+		statsd.Count("container.deleted", 1, tags, StatsdSamplingRate)
+		if state != "" {
+			statsd.Count("container.state."+state+".deleted", 1, tags, StatsdSamplingRate)
+		}
 	} else {
 		log.Error("removeData called with unvalid Datatype: " + dataType)
 		return false
@@ -335,20 +770,30 @@ func removeData(id, dataType string) bool {
 	return true
 }
 
-func (d *DiskSpaceFetcher) GetUsedDiskSpaceInPercents() (int, error) {
-	path := getDockerRoot()
+func (d *DiskSpaceFetcher) GetDiskUsage() (DiskUsage, error) {
+	defer timePhase(phaseDiskStats)()
+	path := d.Path
+	if path == "" {
+		var err error
+		if path, err = getDockerRoot(); err != nil {
+			return DiskUsage{}, err
+		}
+	}
 
+	// Callers log the error, reports measure the usage on a best effort basis
 	s := syscall.Statfs_t{}
 	err := syscall.Statfs(path, &s)
 
 	if err != nil {
-		log.WithField("error", err).Error("Getting used disk space failed")
-		return 0, err
+		return DiskUsage{}, err
 	}
 
-	files := helpers.PercentUsed(s.Bfree, s.Blocks)
-	nodes := helpers.PercentUsed(s.Ffree, s.Files)
-	worst := math.Max(files, nodes)
-
-	return int(worst), nil
+	return DiskUsage{
+		BytesUsed:         (s.Blocks - s.Bfree) * uint64(s.Bsize),
+		BytesTotal:        s.Blocks * uint64(s.Bsize),
+		BytesUsedPercent:  helpers.PercentUsed(s.Bfree, s.Blocks),
+		InodesUsed:        s.Files - s.Ffree,
+		InodesTotal:       s.Files,
+		InodesUsedPercent: helpers.PercentUsed(s.Ffree, s.Files),
+	}, nil
 }
@@ -7,6 +7,7 @@ import (
 	"net/http/httptest"
 	"os"
 	"os/exec"
+	"pkg/notify"
 	"pkg/statsd"
 	"strings"
 	"testing"
@@ -18,16 +19,18 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
+// FakeDiskSpaceFetcher frees a percent on every read, the first read is by the
+// report at the start of the run so cleanup starts from 100%
 type FakeDiskSpaceFetcher struct {
 	counter int
 }
 
-func (d *FakeDiskSpaceFetcher) GetUsedDiskSpaceInPercents() (int, error) {
+func (d *FakeDiskSpaceFetcher) GetDiskUsage() (DiskUsage, error) {
 	if d.counter == 0 {
-		d.counter = 100
+		d.counter = 101
 	}
 	d.counter--
-	return d.counter + 1, nil
+	return DiskUsage{BytesUsedPercent: float64(d.counter + 1)}, nil
 }
 
 type testResponseMap map[string][]response
@@ -205,6 +208,9 @@ func generateTestData(imageAmount int, containerAmount int, t *testing.T) testRe
 	responses["/_ping"] = []response{
 		{"GET", "default", "OK"}}
 
+	responses["/info"] = []response{
+		{"GET", "default", `{"DockerRootDir": "/nonexistent/docker"}`}}
+
 	responses["/images/json"] = []response{
 		{"GET", "all=1", imageListAsJson}}
 
@@ -293,9 +299,59 @@ func TestCleanImages(t *testing.T) {
 	// Verify 2 images (12h + week old) were cleaned
 	assert.Equal(t, 2, cleanedImages, "we should be removing two images")
 	assert.Equal(t, log.InfoLevel, hook.Entries[1].Level, "all image removal messages should log on Info level")
-	assert.Equal(t, "Trying to delete image: 4cb07b47f9fb1", hook.Entries[0].Message, "expected to delete 4cb07b47f9fb1")
+	assert.Equal(t, "Trying to delete dangling image: 4cb07b47f9fb1", hook.Entries[0].Message, "expected to delete 4cb07b47f9fb1")
 	assert.Equal(t, log.InfoLevel, hook.Entries[0].Level, "all image removal messages should log on Info level")
-	assert.Equal(t, "Trying to delete image: 5c76a2479c921", hook.Entries[1].Message, "expected to delete 5c76a2479c921")
+	assert.Equal(t, "Trying to delete dangling image: 5c76a2479c921", hook.Entries[1].Message, "expected to delete 5c76a2479c921")
+}
+
+func danglingTestData() testResponseMap {
+	old := time.Now().Add(-24 * time.Hour).Unix()
+	images := []map[string]interface{}{
+		{"Id": "tagged", "RepoTags": []string{"app:latest"}, "ParentId": "parent", "Created": old},
+		{"Id": "parent", "RepoTags": []string{"<none>:<none>"}, "Created": old - 1},
+		{"Id": "dangling", "RepoTags": []string{"<none>:<none>"}, "Created": old - 2},
+	}
+
+	responses := make(testResponseMap)
+	responses["/_ping"] = []response{{"GET", "default", "OK"}}
+	responses["/images/json"] = []response{{"GET", "all=1", string(mustMarshal(images))}}
+	responses["/containers/json"] = []response{{"GET", "default", "[]"}}
+	// Only images that still have a tag are forced
+	responses["/images/tagged"] = []response{{"DELETE", "force=1", "OK"}}
+	responses["/images/parent"] = []response{{"DELETE", "force=", "OK"}}
+	responses["/images/dangling"] = []response{{"DELETE", "force=", "OK"}}
+	return responses
+}
+
+func TestCleanDanglingImages(t *testing.T) {
+	hitsPerPath := map[string]int{}
+	server := testServer(danglingTestData(), &hitsPerPath)
+	defer server.Close()
+
+	Client = nil
+	StartDockerClient(server.URL)
+
+	cleanedImages := CleanDanglingImages(1 * time.Hour)
+	assert.Equal(t, 1, cleanedImages, "only the dangling image is removed")
+	assert.Equal(t, 1, hitsPerPath["/images/dangling"], "dangling image is removed")
+	assert.Equal(t, 0, hitsPerPath["/images/tagged"], "tagged image is kept")
+	assert.Equal(t, 0, hitsPerPath["/images/parent"], "untagged parent is not dangling")
+}
+
+func TestCleanAllWithDanglingImagesTtl(t *testing.T) {
+	hitsPerPath := map[string]int{}
+	server := testServer(danglingTestData(), &hitsPerPath)
+	defer server.Close()
+
+	Client = nil
+	StartDockerClient(server.URL)
+
+	danglingTtl := 1 * time.Hour
+	_, cleanedImages := CleanAll(DatePolicy, GCPolicy{TtlImages: 1000 * time.Hour, TtlDanglingImages: &danglingTtl})
+	assert.Equal(t, 1, cleanedImages, "tagged images are kept for images TTL")
+
+	_, cleanedImages = CleanAll(DatePolicy, GCPolicy{TtlImages: 1 * time.Hour})
+	assert.Equal(t, 3, cleanedImages, "dangling images share images TTL by default")
 }
 
 func TestCleanContainers(t *testing.T) {
@@ -342,24 +398,26 @@ func TestTtlGC(t *testing.T) {
 	Client = nil
 	StartDockerClient(server.URL)
 
-	TtlGC(interval, GCPolicy{TtlContainers: containersTtl, TtlImages: imagesTtl})
+	scheduler, _ := NewScheduler(SkipMissedRuns, 0)
+	TtlGC(scheduler, interval, GCPolicy{TtlContainers: containersTtl, TtlImages: imagesTtl})
 	// Wait for three runs
 	time.Sleep(11 * time.Second)
-	StopGC()
+	scheduler.Stop()
 
 	// Assert all that is expected to happen during that 10s period
-	assert.Equal(t, 28, len(hook.Entries), "We see 28 message")
+	assert.Equal(t, 31, len(hook.Entries), "We see 31 message")
 	assert.Equal(t, log.InfoLevel, hook.Entries[0].Level, "We should use see Info about starting ttl GC")
 	assert.Equal(t, "Continous run started in timebased mode with interval (in seconds): 3", hook.Entries[0].Message, "report start of GC")
 	assert.Equal(t, "Cleaning all images/containers", hook.Entries[1].Message, "report start of first cleanup")
 	assert.Equal(t, "Trying to delete container: 3176a2479c921", hook.Entries[2].Message, "clean 12h old image")
 	assert.Equal(t, "Trying to delete container: 4cb07b47f9fb1", hook.Entries[3].Message, "clean five minutes old image")
 	assert.Equal(t, "Trying to delete container: 5c76a2479c921", hook.Entries[4].Message, "Clean old container")
-	assert.Equal(t, "Trying to delete image: 3176a2479c921", hook.Entries[5].Message, "clean old image")
-	assert.Equal(t, "Trying to delete image: 4cb07b47f9fb1", hook.Entries[6].Message, "Clean old image")
-	assert.Equal(t, "Cleaning all images/containers", hook.Entries[8].Message, "start of third")
-	assert.Equal(t, "Trying to delete container: 9cd87474be901", hook.Entries[9].Message, "Clean old container")
-	assert.Equal(t, "Trying to delete container: 3176a2479c921", hook.Entries[10].Message, "Clean old container")
+	assert.Equal(t, "Trying to delete dangling image: 3176a2479c921", hook.Entries[5].Message, "clean old image")
+	assert.Equal(t, "Trying to delete dangling image: 4cb07b47f9fb1", hook.Entries[6].Message, "Clean old image")
+	assert.Equal(t, "Run report", hook.Entries[8].Message, "report end of first cleanup")
+	assert.Equal(t, "Cleaning all images/containers", hook.Entries[9].Message, "start of third")
+	assert.Equal(t, "Trying to delete container: 9cd87474be901", hook.Entries[10].Message, "Clean old container")
+	assert.Equal(t, "Trying to delete container: 3176a2479c921", hook.Entries[11].Message, "Clean old container")
 }
 
 func TestStatsdReporting(t *testing.T) {
@@ -385,6 +443,8 @@ func TestStatsdReporting(t *testing.T) {
 
 	expectedContainerMessages := []string{
 		"test.dockergc.container.dead.amount:5|g",
+		"test.dockergc.container.state.exited.amount:5|g",
+		"test.dockergc.container.state.exited.deleted:1|c",
 		"test.dockergc.container.deleted:1|c",
 	}
 	udp.ShouldReceiveAll(t, expectedContainerMessages, func() {
@@ -421,8 +481,10 @@ func TestMonitorDiskSpacePartial(t *testing.T) {
 
 	// Assert that in the case where we cant free enough free space in a single run we go through all images
 	CleanAllWithDiskSpacePolicy(GCPolicy{HighDiskSpaceThreshold: 99, LowDiskSpaceThreshold: 0})
-	assert.Equal(t, 83, len(hook.Entries), "We see 60 message")
-	assert.Equal(t, 5*imageAmount, hook.Entries[len(hook.Entries)-1].Data["cleanedImages"], "Report that we clean all images")
+	assert.Equal(t, 85, len(hook.Entries), "We see 85 message")
+	assert.Equal(t, 5*imageAmount, hook.Entries[len(hook.Entries)-3].Data["cleanedImages"], "Report that we clean all images")
+	assert.Equal(t, log.WarnLevel, hook.Entries[len(hook.Entries)-2].Level, "Warn that the low threshold can't be reached")
+	assert.Equal(t, 5*imageAmount, hook.Entries[len(hook.Entries)-1].Data["deletedImages"], "Run report has the same amount of images")
 
 }
 
@@ -438,13 +500,78 @@ func TestMonitorDiskSpaceFull(t *testing.T) {
 	Client = nil
 	StartDockerClient(server.URL)
 
-	diskSpaceFetcher = &FakeDiskSpaceFetcher{}
+	diskSpaceFetcher = &FakeDiskSpaceFetcher{counter: 100}
 
 	// Assert that we see starting message for the cleanup and the last message reports that we got from 100 to 94 and stopped there
 	CleanAllWithDiskSpacePolicy(GCPolicy{HighDiskSpaceThreshold: 99, LowDiskSpaceThreshold: 95})
-	assert.Equal(t, 48, len(hook.Entries), "We see 48 message")
+	assert.Equal(t, 49, len(hook.Entries), "We see 49 message")
 	assert.Equal(t, log.InfoLevel, hook.Entries[0].Level, "We should report starting of cleanup based on threshold")
 	assert.Equal(t, "Cleaning images to reach low used disk space threshold", hook.Entries[0].Message, "report low image threshold reached")
-	assert.Equal(t, "Cleaning images finished", hook.Entries[len(hook.Entries)-1].Message, "Report that we have reached 94%")
-	assert.Equal(t, 94, hook.Entries[len(hook.Entries)-1].Data["usedDiskSpace"], "Report that we have reached 94%")
+	assert.Equal(t, "Cleaning images finished", hook.Entries[len(hook.Entries)-2].Message, "Report that we have reached 94%")
+	assert.Equal(t, 94.0, hook.Entries[len(hook.Entries)-2].Data["usedDiskSpace"], "Report that we have reached 94%")
+	assert.Equal(t, "Run report", hook.Entries[len(hook.Entries)-1].Message, "Run report is logged last")
+}
+
+func TestMonitorDiskSpaceNotifies(t *testing.T) {
+	_, hook := logrustest.NewNullLogger()
+	log.AddHook(hook)
+
+	hitsPerPath := map[string]int{}
+	server := testServer(generateTestData(1, 1, t), &hitsPerPath)
+	defer server.Close()
+
+	Client = nil
+	StartDockerClient(server.URL)
+
+	diskSpaceFetcher = &FakeDiskSpaceFetcher{}
+
+	events := make(chan notify.Event, 10)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var notification notify.Notification
+		json.NewDecoder(r.Body).Decode(&notification)
+		events <- notification.Event
+	}))
+	defer webhook.Close()
+
+	notify.Configure(notify.Webhook{URL: webhook.URL})
+	// Only five images to clean so we can't get from 100% to 0%
+	CleanAllWithDiskSpacePolicy(GCPolicy{HighDiskSpaceThreshold: 99, LowDiskSpaceThreshold: 0})
+	notify.Close()
+
+	assert.Equal(t, 2, len(events), "We should notify about both thresholds")
+	assert.Equal(t, notify.HighThresholdReached, <-events, "first notify that high threshold was reached")
+	assert.Equal(t, notify.LowThresholdNotReached, <-events, "then notify that low threshold could not be reached")
+}
+
+func TestCleanAllStopsAtDeletionCap(t *testing.T) {
+	hitsPerPath := map[string]int{}
+	server := testServer(danglingTestData(), &hitsPerPath)
+	defer server.Close()
+
+	Client = nil
+	StartDockerClient(server.URL)
+
+	var reports []Report
+	reportHooks = nil
+	AddReportHook(func(report Report) { reports = append(reports, report) })
+	defer func() { reportHooks = nil }()
+
+	events := make(chan notify.Event, 10)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var notification notify.Notification
+		json.NewDecoder(r.Body).Decode(&notification)
+		events <- notification.Event
+	}))
+	defer webhook.Close()
+
+	notify.Configure(notify.Webhook{URL: webhook.URL})
+	_, removedImages := CleanAll(DatePolicy, GCPolicy{MaxDeletions: 2})
+	notify.Close()
+
+	deleted := hitsPerPath["/images/tagged"] + hitsPerPath["/images/parent"] + hitsPerPath["/images/dangling"]
+	assert.Equal(t, 2, deleted, "deletions stop at the cap")
+	assert.Equal(t, 2, removedImages, "deletions stop at the cap")
+	assert.True(t, reports[0].DeletionCapReached, "report tells the cap was reached")
+	assert.Equal(t, 1, len(events), "cap is notified once")
+	assert.Equal(t, notify.DeletionCapReached, <-events, "notify that the cap was reached")
 }
@@ -0,0 +1,193 @@
+package gc
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// tarSplitFileEntry is the type of the tar-split entries that are files in the
+// layer, the rest are raw tar segments
+const tarSplitFileEntry = 1
+
+// layerFiles caches the file counts of layers by chain ID, layers never change
+var (
+	layerFiles     = map[string]int64{}
+	layerFilesLock sync.Mutex
+)
+
+// evictionCandidate is an image removed by its estimated file count when the
+// cleanup was triggered by inode usage
+type evictionCandidate struct {
+	id    string
+	group int
+	date  int64
+	files int64
+}
+
+// byFiles sorts the images with most files first, oldest first when the file
+// counts are the same
+type byFiles []evictionCandidate
+
+func (c byFiles) Len() int      { return len(c) }
+func (c byFiles) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+func (c byFiles) Less(i, j int) bool {
+	if c[i].files != c[j].files {
+		return c[i].files > c[j].files
+	}
+	return c[i].date < c[j].date
+}
+
+// inodeBatches batches the images past their TTL by the estimated number of
+// files in them, most files first
+func inodeBatches(groups []imageGroup, files map[string]int64) []imageBatch {
+	var candidates []evictionCandidate
+	for i, group := range groups {
+		for date, ids := range group.dataMap {
+			if ttlVerdict(time.Unix(date, 0), group.ttl).Keep {
+				continue
+			}
+			for _, id := range ids {
+				candidates = append(candidates, evictionCandidate{id: id, group: i, date: date, files: files[id]})
+			}
+		}
+	}
+	sort.Sort(byFiles(candidates))
+
+	var batches []imageBatch
+	for start := 0; start < len(candidates); start += BatchSizeToDelete {
+		end := start + BatchSizeToDelete
+		if end > len(candidates) {
+			end = len(candidates)
+		}
+		batch := make(imageBatch, len(groups))
+		for i := range batch {
+			batch[i] = map[int64][]string{}
+		}
+		for _, candidate := range candidates[start:end] {
+			batch[candidate.group][candidate.date] = append(batch[candidate.group][candidate.date], candidate.id)
+		}
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+// estimateImageFiles counts the files in the layers of the images past their
+// TTL from the tar-split metadata the daemon keeps of each layer. Shared layers
+// are counted for every image using them. Images whose layer metadata can't be
+// read have no files.
+func estimateImageFiles(groups []imageGroup) map[string]int64 {
+	files := map[string]int64{}
+	finished := timeDockerCall("info", "system")
+	info, err := Client.Info()
+	finished(err)
+	if err != nil {
+		log.WithField("error", err).Error("Getting docker info failed")
+		return files
+	}
+	layerdb := filepath.Join(info.DockerRootDir, "image", info.Driver, "layerdb")
+
+	for _, group := range groups {
+		for date, ids := range group.dataMap {
+			if ttlVerdict(time.Unix(date, 0), group.ttl).Keep {
+				continue
+			}
+			for _, id := range ids {
+				finished := timeDockerCall("images.inspect", Image)
+				image, iErr := Client.InspectImage(id)
+				finished(iErr)
+				if iErr != nil || image.RootFS == nil {
+					continue
+				}
+				for _, chainID := range chainIDs(image.RootFS.Layers) {
+					files[id] += countLayerFiles(layerdb, chainID)
+				}
+				log.WithFields(log.Fields{
+					"id":    id,
+					"files": files[id],
+				}).Debug("Estimated files of image")
+			}
+		}
+	}
+	return files
+}
+
+// chainIDs returns the IDs the daemon stores the layers with the diff IDs by,
+// each one identifies the layer together with all of its parents
+func chainIDs(diffIDs []string) []string {
+	var ids []string
+	for i, diffID := range diffIDs {
+		if i == 0 {
+			ids = append(ids, diffID)
+			continue
+		}
+		sum := sha256.Sum256([]byte(ids[i-1] + " " + diffID))
+		ids = append(ids, "sha256:"+hex.EncodeToString(sum[:]))
+	}
+	return ids
+}
+
+// countLayerFiles returns the number of files in the layer, zero when its
+// metadata can't be read
+func countLayerFiles(layerdb, chainID string) int64 {
+	layerFilesLock.Lock()
+	defer layerFilesLock.Unlock()
+	if count, ok := layerFiles[chainID]; ok {
+		return count
+	}
+
+	algorithmAndHex := strings.SplitN(chainID, ":", 2)
+	if len(algorithmAndHex) != 2 {
+		return 0
+	}
+	path := filepath.Join(layerdb, algorithmAndHex[0], algorithmAndHex[1], "tar-split.json.gz")
+	count, err := countTarSplitFiles(path)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+			"path":  path,
+		}).Debug("Reading layer metadata failed")
+		return 0
+	}
+	layerFiles[chainID] = count
+	return count
+}
+
+func countTarSplitFiles(path string) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	var count int64
+	decoder := json.NewDecoder(reader)
+	for {
+		var entry struct {
+			Type int `json:"type"`
+		}
+		if err := decoder.Decode(&entry); err == io.EOF {
+			return count, nil
+		} else if err != nil {
+			return 0, err
+		}
+		if entry.Type == tarSplitFileEntry {
+			count++
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package gc
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeInodeFetcher frees ten percent of inodes on every read with blocks below
+// thresholds
+type fakeInodeFetcher struct {
+	inodes int
+}
+
+func (d *fakeInodeFetcher) GetDiskUsage() (DiskUsage, error) {
+	usage := DiskUsage{BytesUsedPercent: 10, InodesUsedPercent: float64(d.inodes)}
+	d.inodes -= 10
+	return usage, nil
+}
+
+func writeTarSplit(t *testing.T, layerdb, chainID string, files int) {
+	dir := filepath.Join(layerdb, strings.Replace(chainID, ":", string(filepath.Separator), 1))
+	assert.Nil(t, os.MkdirAll(dir, 0755), "creating layer dir should succeed")
+	file, err := os.Create(filepath.Join(dir, "tar-split.json.gz"))
+	assert.Nil(t, err, "creating tar-split should succeed")
+	defer file.Close()
+	writer := gzip.NewWriter(file)
+	defer writer.Close()
+	for i := 0; i < files; i++ {
+		fmt.Fprintf(writer, "{\"type\":2,\"payload\":\"AAAA\",\"position\":%d}\n", 2*i)
+		fmt.Fprintf(writer, "{\"type\":1,\"name\":\"file-%d\",\"size\":1,\"position\":%d}\n", i, 2*i+1)
+	}
+}
+
+func TestInodeBatches(t *testing.T) {
+	old := time.Now().Add(-48 * time.Hour).Unix()
+	tagged := imageGroup{dataType: Image, ttl: 1 * time.Hour, dataMap: map[int64][]string{}}
+	dangling := imageGroup{dataType: DanglingImage, ttl: 1 * time.Hour, dataMap: map[int64][]string{}}
+	files := map[string]int64{}
+	for i := 0; i < 11; i++ {
+		id := fmt.Sprintf("image-%d", i)
+		tagged.dataMap[old+int64(i)] = []string{id}
+		files[id] = int64(i)
+	}
+	dangling.dataMap[old-1] = []string{"dangling-many"}
+	files["dangling-many"] = 1000
+	dangling.dataMap[time.Now().Unix()] = []string{"dangling-new"}
+	files["dangling-new"] = 2000
+
+	batches := inodeBatches([]imageGroup{tagged, dangling}, files)
+	assert.Equal(t, 2, len(batches), "expired images are batched by the batch size")
+	assert.Equal(t, map[int64][]string{old - 1: {"dangling-many"}}, batches[0][1], "image with most files is in the first batch")
+	assert.Equal(t, 9, len(batches[0][0]), "images with most files fill the first batch")
+	assert.Equal(t, map[int64][]string{old: {"image-0"}, old + 1: {"image-1"}}, batches[1][0], "images with least files are last")
+	assert.Equal(t, 0, len(batches[1][1]), "images within TTL are not batched")
+}
+
+func TestCleanWithInodeTrigger(t *testing.T) {
+	root, err := ioutil.TempDir("", "docker-gc-root")
+	assert.Nil(t, err, "creating temp dir should succeed")
+	defer os.RemoveAll(root)
+	layerdb := filepath.Join(root, "image", "overlay2", "layerdb")
+	defer func() { layerFiles = map[string]int64{} }()
+
+	base, small, many := "sha256:base", "sha256:small", "sha256:many"
+	writeTarSplit(t, layerdb, base, 10)
+	writeTarSplit(t, layerdb, chainIDs([]string{base, small})[1], 5)
+	writeTarSplit(t, layerdb, chainIDs([]string{base, many})[1], 500)
+
+	old := time.Now().Add(-48 * time.Hour).Unix()
+	images := []map[string]interface{}{
+		{"Id": "small", "RepoTags": []string{"small:latest"}, "Created": old},
+		{"Id": "many", "RepoTags": []string{"many:latest"}, "Created": old + 1},
+	}
+	responses := make(testResponseMap)
+	responses["/_ping"] = []response{{"GET", "default", "OK"}}
+	responses["/info"] = []response{{"GET", "default", string(mustMarshal(map[string]string{"DockerRootDir": root, "Driver": "overlay2"}))}}
+	responses["/images/json"] = []response{{"GET", "all=1", string(mustMarshal(images))}}
+	responses["/containers/json"] = []response{{"GET", "default", "[]"}}
+	for id, layers := range map[string][]string{"small": {base, small}, "many": {base, many}} {
+		inspect := map[string]interface{}{"Id": id, "RootFS": map[string]interface{}{"Type": "layers", "Layers": layers}}
+		responses["/images/"+id+"/json"] = []response{{"GET", "default", string(mustMarshal(inspect))}}
+		responses["/images/"+id] = []response{{"DELETE", "default", "OK"}}
+	}
+
+	hitsPerPath := map[string]int{}
+	server := testServer(responses, &hitsPerPath)
+	defer server.Close()
+
+	Client = nil
+	StartDockerClient(server.URL)
+
+	tagged := imageGroup{dataType: Image, ttl: 1 * time.Hour, dataMap: map[int64][]string{old: {"small"}, old + 1: {"many"}}}
+	files := estimateImageFiles([]imageGroup{tagged})
+	assert.Equal(t, map[string]int64{"small": 15, "many": 510}, files, "files are counted from layer metadata")
+
+	report := newReport(DiskPolicy)
+	cleanFilesystem(&fakeInodeFetcher{inodes: 100}, Filesystem{Resources: []string{ResourceImages}}, GCPolicy{
+		HighDiskSpaceThreshold: 95,
+		LowDiskSpaceThreshold:  50,
+		HighInodeThreshold:     95,
+		LowInodeThreshold:      80,
+		TtlImages:              1 * time.Hour,
+	}, report)
+
+	assert.Equal(t, []string{TriggerInodes}, report.Triggers, "inodes are reported as the trigger")
+	assert.Equal(t, 1, hitsPerPath["/images/many"], "images are removed until inodes are below low threshold")
+}
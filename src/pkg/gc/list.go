@@ -0,0 +1,139 @@
+package gc
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	SortByCreated = "created"
+	SortBySize    = "size"
+	SortByID      = "id"
+	SortByType    = "type"
+
+	FilterImages     = "images"
+	FilterContainers = "containers"
+	FilterCandidates = "candidates"
+	FilterInUse      = "in-use"
+)
+
+// InventoryEntry is a single image or container as seen by the cleanup
+type InventoryEntry struct {
+	Type       string    `json:"type"`
+	ID         string    `json:"id"`
+	Names      []string  `json:"names,omitempty"`
+	Created    time.Time `json:"created"`
+	FinishedAt time.Time `json:"finishedAt,omitempty"`
+	Size       int64     `json:"size"`
+	InUse      bool      `json:"inUse"`
+	Collect    bool      `json:"collect"`
+	// Stale tags untagged from an image its other tags keep
+	Untag []string `json:"untag,omitempty"`
+}
+
+// Inventory lists the images and finished containers, and created ones when
+// they have a TTL, the cleanup works on and what the TTL cleanup would do
+// with each of them under the given policy now
+func Inventory(policy GCPolicy) ([]InventoryEntry, error) {
+	images, err := listImages()
+	if err != nil {
+		return nil, err
+	}
+	containers, err := listFinishedContainers(true)
+	if err != nil {
+		return nil, err
+	}
+	if policy.TtlCreatedContainers != nil {
+		created, err := listCreatedContainers()
+		if err != nil {
+			return nil, err
+		}
+		containers = append(containers, created...)
+	}
+
+	entries := make([]InventoryEntry, 0, len(images)+len(containers))
+	for _, image := range images {
+		d := evaluateImage(image, policy, DatePolicy)
+		entries = append(entries, InventoryEntry{
+			Type:    Image,
+			ID:      image.ID,
+			Names:   image.RepoTags,
+			Created: image.Created,
+			Size:    image.Size,
+			InUse:   inUseVerdict(image).Keep,
+			Collect: d.delete,
+			Untag:   d.untag,
+		})
+	}
+	for _, container := range containers {
+		d := evaluateContainer(container, policy, DatePolicy)
+		entries = append(entries, InventoryEntry{
+			Type:       Container,
+			ID:         container.ID,
+			Names:      []string{container.Name},
+			Created:    container.Created,
+			FinishedAt: container.FinishedAt,
+			Size:       container.Size,
+			Collect:    d.delete,
+		})
+	}
+	return entries, nil
+}
+
+// FilterInventory keeps the entries matching all of the given filters
+func FilterInventory(entries []InventoryEntry, filters []string) ([]InventoryEntry, error) {
+	for _, filter := range filters {
+		var match func(InventoryEntry) bool
+		switch filter {
+		case FilterImages:
+			match = func(e InventoryEntry) bool { return e.Type == Image }
+		case FilterContainers:
+			match = func(e InventoryEntry) bool { return e.Type == Container }
+		case FilterCandidates:
+			match = func(e InventoryEntry) bool { return e.Collect || len(e.Untag) > 0 }
+		case FilterInUse:
+			match = func(e InventoryEntry) bool { return e.InUse }
+		default:
+			return nil, fmt.Errorf("%s is not valid filter", filter)
+		}
+
+		var filtered []InventoryEntry
+		for _, entry := range entries {
+			if match(entry) {
+				filtered = append(filtered, entry)
+			}
+		}
+		entries = filtered
+	}
+	return entries, nil
+}
+
+// SortInventory orders the entries by the given field, oldest and largest
+// first
+func SortInventory(entries []InventoryEntry, by string) error {
+	var less func(a, b InventoryEntry) bool
+	switch by {
+	case SortByCreated:
+		less = func(a, b InventoryEntry) bool { return a.Created.Before(b.Created) }
+	case SortBySize:
+		less = func(a, b InventoryEntry) bool { return a.Size > b.Size }
+	case SortByID:
+		less = func(a, b InventoryEntry) bool { return a.ID < b.ID }
+	case SortByType:
+		less = func(a, b InventoryEntry) bool { return a.Type < b.Type }
+	default:
+		return fmt.Errorf("%s is not valid sort field", by)
+	}
+	sort.Stable(inventorySorter{entries, less})
+	return nil
+}
+
+type inventorySorter struct {
+	entries []InventoryEntry
+	less    func(a, b InventoryEntry) bool
+}
+
+func (s inventorySorter) Len() int           { return len(s.entries) }
+func (s inventorySorter) Swap(i, j int)      { s.entries[i], s.entries[j] = s.entries[j], s.entries[i] }
+func (s inventorySorter) Less(i, j int) bool { return s.less(s.entries[i], s.entries[j]) }
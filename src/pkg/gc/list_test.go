@@ -0,0 +1,94 @@
+package gc
+
+import (
+	"bytes"
+	"encoding/csv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInventory(t *testing.T) {
+	hitsPerPath := map[string]int{}
+	server := testServer(generateTestData(1, 1, t), &hitsPerPath)
+	defer server.Close()
+
+	Client = nil
+	StartDockerClient(server.URL)
+
+	entries, err := Inventory(GCPolicy{TtlImages: 10 * time.Hour, TtlContainers: 1 * time.Minute})
+	assert.Nil(t, err, "building inventory should succeed")
+	assert.Equal(t, 10, len(entries), "five images and five containers are listed")
+
+	images, _ := FilterInventory(entries, []string{FilterImages, FilterCandidates})
+	assert.Equal(t, 2, len(images), "12h and day old images would be collected")
+	containers, _ := FilterInventory(entries, []string{FilterContainers, FilterCandidates})
+	assert.Equal(t, 3, len(containers), "containers older than a minute would be collected")
+
+	// Same decisions as the actual cleanup
+	assert.Equal(t, len(images), CleanImages(10*time.Hour), "list and cleanup should agree on images")
+	assert.Equal(t, len(containers), CleanContainers(1*time.Minute), "list and cleanup should agree on containers")
+
+	_, err = FilterInventory(entries, []string{"bogus"})
+	assert.NotNil(t, err, "unknown filters are rejected")
+}
+
+func TestInventoryMatchesCleanup(t *testing.T) {
+	// Containers are kept by the deny window at noon
+	_, restore := withFakeScheduleClock(time.Date(2016, 3, 25, 12, 0, 0, 0, time.UTC))
+	defer restore()
+	windows, _ := ParseMaintenanceWindows("deny containers * 09:00-18:00", time.UTC)
+	policy := GCPolicy{TtlImages: 10 * time.Hour, TtlContainers: 1 * time.Minute, MaintenanceWindows: windows}
+
+	hitsPerPath := map[string]int{}
+	server := testServer(generateTestData(1, 1, t), &hitsPerPath)
+	defer server.Close()
+
+	Client = nil
+	StartDockerClient(server.URL)
+
+	entries, err := Inventory(policy)
+	assert.Nil(t, err, "building inventory should succeed")
+	candidates, _ := FilterInventory(entries, []string{FilterCandidates})
+	assert.Equal(t, 2, len(candidates), "only images would be collected while containers are in a deny window")
+
+	CleanAll(DatePolicy, policy)
+	for _, entry := range entries {
+		path := "/images/" + entry.ID
+		if entry.Type == Container {
+			path = "/containers/" + entry.ID
+		}
+		deleted := hitsPerPath[path] > 0
+		assert.Equal(t, entry.Collect, deleted, entry.Type+" "+entry.ID+" is deleted only when listed as collected")
+	}
+}
+
+func TestSortInventory(t *testing.T) {
+	now := time.Now()
+	entries := []InventoryEntry{
+		{ID: "b", Size: 1, Created: now},
+		{ID: "a", Size: 3, Created: now.Add(-time.Hour)},
+		{ID: "c", Size: 2, Created: now.Add(-2 * time.Hour)},
+	}
+
+	assert.Nil(t, SortInventory(entries, SortBySize), "sorting by size should succeed")
+	assert.Equal(t, "a", entries[0].ID, "largest entry comes first")
+	assert.Nil(t, SortInventory(entries, SortByCreated), "sorting by created should succeed")
+	assert.Equal(t, "c", entries[0].ID, "oldest entry comes first")
+	assert.Nil(t, SortInventory(entries, SortByID), "sorting by id should succeed")
+	assert.Equal(t, "a", entries[0].ID, "entries are sorted by ID")
+	assert.NotNil(t, SortInventory(entries, "bogus"), "unknown sort fields are rejected")
+}
+
+func TestWriteInventoryCSV(t *testing.T) {
+	entries := []InventoryEntry{{Type: Image, ID: "4cb07b47f9fb1", Names: []string{"app:sha", "app:production"}, Size: 1024, Collect: true}}
+
+	var out bytes.Buffer
+	assert.Nil(t, WriteInventory(&out, entries, CSVOutput), "writing CSV should succeed")
+
+	records, err := csv.NewReader(&out).ReadAll()
+	assert.Nil(t, err, "output should be valid CSV")
+	assert.Equal(t, 2, len(records), "header and one entry")
+	assert.Equal(t, []string{Image, "4cb07b47f9fb1", "app:sha,app:production", "-", "-", "1024", "false", "true", ""}, records[1], "entry is written in full")
+}
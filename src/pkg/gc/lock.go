@@ -0,0 +1,138 @@
+package gc
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"pkg/statsd"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// How a one-time command gets the sweep lock held by another docker-gc
+// process, eg. the daemon
+const (
+	WaitForLock = "wait"
+	PreemptLock = "preempt"
+)
+
+var (
+	sweepLockPath       string
+	sweepLockContention string
+	preemptionsOnce     sync.Once
+	// Set while this process holds the sweep lock, and when another process
+	// asks the sweep to stop deleting
+	sweeping  int32
+	preempted int32
+)
+
+// ConfigureSweepLock makes every sweep hold an exclusive flock on the lock
+// file so that docker-gc processes on the same host don't delete the same
+// data at the same time. Preempted sweeps stop deleting and release the lock.
+func ConfigureSweepLock(path, contention string) error {
+	if contention != WaitForLock && contention != PreemptLock {
+		return fmt.Errorf("%s is not valid lock contention, use %s or %s", contention, WaitForLock, PreemptLock)
+	}
+	sweepLockPath, sweepLockContention = path, contention
+
+	preemptionsOnce.Do(func() {
+		preemptions := make(chan os.Signal, 1)
+		signal.Notify(preemptions, syscall.SIGUSR1)
+		go func() {
+			for range preemptions {
+				if atomic.LoadInt32(&sweeping) == 1 {
+					atomic.StoreInt32(&preempted, 1)
+				}
+			}
+		}()
+	})
+	return nil
+}
+
+// LockSweep waits for the sweep lock for a one-time command, preempting the
+// sweep holding it when configured so. It returns the function releasing it.
+func LockSweep(command string) func() {
+	return lockSweep(command, sweepLockContention == PreemptLock)
+}
+
+// lockSweep takes the sweep lock when it's configured. Failing to take it is
+// logged and the sweep runs without it rather than not at all.
+func lockSweep(run string, preempt bool) func() {
+	if sweepLockPath == "" {
+		return func() {}
+	}
+	fields := log.Fields{"path": sweepLockPath}
+	tags := []string{runTag(run)}
+	file, err := os.OpenFile(sweepLockPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		log.WithFields(fields).WithField("error", err).Error("Opening sweep lock failed, sweeping without it")
+		statsd.Count("lock.error", 1, tags, StatsdSamplingRate)
+		return func() {}
+	}
+
+	fd := int(file.Fd())
+	err = syscall.Flock(fd, syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		holder := lockHolder(file)
+		fields["holder"] = holder
+		statsd.Count("lock.contended", 1, tags, StatsdSamplingRate)
+		if preempt && holder > 0 {
+			log.WithFields(fields).Warn("Sweep lock held by another docker-gc process, preempting its sweep")
+			if err := syscall.Kill(holder, syscall.SIGUSR1); err != nil {
+				log.WithFields(fields).WithField("error", err).Warn("Preempting sweep failed, waiting for it")
+			}
+		} else {
+			log.WithFields(fields).Warn("Sweep lock held by another docker-gc process, waiting for it")
+		}
+
+		started := time.Now()
+		err = syscall.Flock(fd, syscall.LOCK_EX)
+		statsd.Timer("lock.wait", time.Since(started), tags, StatsdSamplingRate)
+	}
+	if err != nil {
+		log.WithFields(fields).WithField("error", err).Error("Taking sweep lock failed, sweeping without it")
+		statsd.Count("lock.error", 1, tags, StatsdSamplingRate)
+		file.Close()
+		return func() {}
+	}
+
+	// The holder is written for the processes preempting it
+	file.Truncate(0)
+	file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	atomic.StoreInt32(&preempted, 0)
+	atomic.StoreInt32(&sweeping, 1)
+
+	return func() {
+		atomic.StoreInt32(&sweeping, 0)
+		if atomic.SwapInt32(&preempted, 0) == 1 {
+			log.WithFields(fields).Warn("Sweep preempted by another docker-gc process")
+			statsd.Count("lock.preempted", 1, tags, StatsdSamplingRate)
+		}
+		file.Truncate(0)
+		syscall.Flock(fd, syscall.LOCK_UN)
+		file.Close()
+	}
+}
+
+// lockHolder returns the pid of the process holding the lock, zero when it's
+// not known
+func lockHolder(file *os.File) int {
+	content, err := ioutil.ReadAll(file)
+	if err != nil {
+		return 0
+	}
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(content)))
+	return pid
+}
+
+// sweepPreempted tells if the running sweep should stop deleting
+func sweepPreempted() bool {
+	return atomic.LoadInt32(&preempted) == 1
+}
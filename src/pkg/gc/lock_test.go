@@ -0,0 +1,118 @@
+package gc
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func withSweepLock(t *testing.T, contention string) (string, func()) {
+	dir, err := ioutil.TempDir("", "docker-gc-lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "docker-gc.lock")
+	assert.Nil(t, ConfigureSweepLock(path, contention), "configuring sweep lock should succeed")
+	return path, func() {
+		sweepLockPath = ""
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSweepLock(t *testing.T) {
+	assert.NotNil(t, ConfigureSweepLock("/tmp/docker-gc.lock", "maybe"), "contention must be wait or preempt")
+
+	path, restore := withSweepLock(t, WaitForLock)
+	defer restore()
+
+	unlock := lockSweep("test", false)
+	content, _ := ioutil.ReadFile(path)
+	assert.Equal(t, strconv.Itoa(os.Getpid())+"\n", string(content), "lock file has the pid of the holder")
+
+	locked := make(chan struct{})
+	go func() {
+		LockSweep("test")()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.Fatal("lock was taken while held")
+	case <-time.After(100 * time.Millisecond):
+	}
+	assert.False(t, sweepPreempted(), "waiting doesn't preempt the sweep")
+
+	unlock()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("lock was not taken after released")
+	}
+}
+
+func TestPreemptSweep(t *testing.T) {
+	_, restore := withSweepLock(t, PreemptLock)
+	defer restore()
+
+	unlock := lockSweep("test", false)
+	locked := make(chan struct{})
+	go func() {
+		LockSweep("test")()
+		close(locked)
+	}()
+	for i := 0; i < 1000 && !sweepPreempted(); i++ {
+		time.Sleep(time.Millisecond)
+	}
+	assert.True(t, sweepPreempted(), "waiting one-time command preempts the sweep")
+
+	assert.Equal(t, 0, removeDataBasedOnAge(map[int64][]string{0: {"preempted"}}, Image, 0, newReport(DatePolicy)), "preempted sweep stops deleting")
+
+	unlock()
+	<-locked
+	assert.False(t, sweepPreempted(), "preemption ends with the sweep")
+	assert.Equal(t, int32(0), atomic.LoadInt32(&sweeping), "lock is released")
+}
+
+func TestPreemptDiskSpaceSweep(t *testing.T) {
+	defer atomic.StoreInt32(&preempted, 0)
+	responses := generateTestData(1, 1, t)
+	responses["/build/prune"] = []response{{"POST", "default", `{"CachesDeleted": ["a"], "SpaceReclaimed": 10}`}}
+	hitsPerPath := map[string]int{}
+	routes := testServer(responses, &hitsPerPath)
+	routes.Close()
+	// The sweep is preempted while it prunes the build cache, its first step
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/build/prune" {
+			atomic.StoreInt32(&preempted, 1)
+		}
+		routes.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	Client = nil
+	StartDockerClient(server.URL)
+
+	diskSpaceFetcher = &FakeDiskSpaceFetcher{}
+	defer func() { diskSpaceFetcher = nil }()
+
+	fallback := GCPolicy{}
+	CleanAllWithDiskSpacePolicy(GCPolicy{
+		HighDiskSpaceThreshold: 99,
+		LowDiskSpaceThreshold:  0,
+		PruneBuildCache:        true,
+		MaxLogSize:             1,
+		TagGC:                  true,
+		Fallback:               &fallback,
+	})
+
+	assert.Equal(t, 1, hitsPerPath["/build/prune"], "build cache is pruned before the preemption")
+	assert.Equal(t, 0, hitsPerPath["/containers/json"], "logs and containers aren't listed after the preemption")
+	assert.Equal(t, 0, hitsPerPath["/images/json"], "images aren't listed after the preemption")
+}
@@ -0,0 +1,321 @@
+package gc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"pkg/helpers"
+	"pkg/statsd"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/fsouza/go-dockerclient"
+)
+
+const (
+	// KeepLogsLabel protects the logs of a container from being truncated
+	// unless its value is "false"
+	KeepLogsLabel = "docker-gc.keep-logs"
+	// DefaultLogKeepTail is kept from the end of a truncated log when the
+	// policy doesn't say otherwise
+	DefaultLogKeepTail = 1 << 20
+	// DefaultMaxRotatedLogs saved logs are kept next to each rotated log when
+	// the policy doesn't say otherwise
+	DefaultMaxRotatedLogs = 5
+
+	// Rotated logs are saved as <LogPath>.docker-gc-<UTC time>.gz, apart
+	// from the <LogPath>.N.gz files of Docker's own rotation
+	rotatedLogInfix      = ".docker-gc-"
+	rotatedLogTimeFormat = "20060102T150405.000"
+	// How many times the lines appended while saving a log, or moving its
+	// tail, are caught up with before truncating it
+	logCatchUpPasses = 10
+)
+
+// ContainerLog is the log file of a single, running or finished, container
+type ContainerLog struct {
+	ContainerID string
+	Name        string
+	Path        string
+	Size        int64
+	Protected   bool
+}
+
+// listContainerLogs inspects every container for its log file. Logs outside of
+// the Docker root are skipped so a bad LogPath can't make us touch other files.
+func listContainerLogs() ([]ContainerLog, error) {
+	root, err := getDockerRoot()
+	if err != nil {
+		return nil, err
+	}
+	root = filepath.Clean(root) + string(filepath.Separator)
+
+	finishedListing := timePhase(phaseListing)
+	finished := timeDockerCall("containers.list", Container)
+	containers, err := Client.ListContainers(docker.ListContainersOptions{All: true})
+	finished(err)
+	finishedListing()
+	if err != nil {
+		log.WithField("error", err).Error("Listing containers error")
+		return nil, err
+	}
+
+	var logs []ContainerLog
+	for _, container := range containers {
+		finished := timeDockerCall("containers.inspect", Container)
+		data, cErr := Client.InspectContainer(container.ID)
+		finished(cErr)
+		if cErr != nil {
+			log.WithField("error", cErr).Error("Fetching container full data error")
+			continue
+		}
+		if data.LogPath == "" {
+			continue
+		}
+		path := filepath.Clean(data.LogPath)
+		if !strings.HasPrefix(path, root) {
+			log.WithFields(log.Fields{
+				"containerId": container.ID,
+				"logPath":     data.LogPath,
+			}).Warn("Container log is outside of docker root, skipping")
+			continue
+		}
+		info, sErr := os.Stat(path)
+		if sErr != nil {
+			continue
+		}
+
+		protected := false
+		if data.Config != nil {
+			if value, ok := data.Config.Labels[KeepLogsLabel]; ok && value != "false" {
+				protected = true
+			}
+		}
+		logs = append(logs, ContainerLog{
+			ContainerID: container.ID,
+			Name:        strings.TrimPrefix(data.Name, "/"),
+			Path:        path,
+			Size:        info.Size(),
+			Protected:   protected,
+		})
+	}
+	return logs, nil
+}
+
+// cleanLogs truncates, or rotates, the container logs larger than the max log
+// size of the policy
+func cleanLogs(policy GCPolicy, report *Report) {
+	logs, err := listContainerLogs()
+	if err != nil {
+		log.WithField("error", err).Error("Listing container logs failed")
+		return
+	}
+
+	keepTail := policy.LogKeepTail
+	if keepTail <= 0 {
+		keepTail = DefaultLogKeepTail
+	}
+	maxRotated := policy.MaxRotatedLogs
+	if maxRotated <= 0 {
+		maxRotated = DefaultMaxRotatedLogs
+	}
+
+	tags := []string{resourceTag(ResourceLogs), policyTag(report.Mode)}
+	var total int64
+	for _, containerLog := range logs {
+		total += containerLog.Size
+		fields := log.Fields{
+			"containerId": containerLog.ContainerID,
+			"name":        containerLog.Name,
+			"logSize":     helpers.FormatBytes(containerLog.Size),
+		}
+		log.WithFields(fields).Debug("Container log size")
+
+		if containerLog.Size <= policy.MaxLogSize {
+			continue
+		}
+		if containerLog.Protected {
+			log.WithFields(fields).Info("Container log is protected by label, skipping")
+			continue
+		}
+		if sweepPreempted() {
+			continue
+		}
+
+		reclaimed, tErr := truncateLog(containerLog.Path, keepTail, policy.RotateLogs, maxRotated)
+		report.recordLog(reclaimed, tErr == nil)
+		countDeletion(ResourceLogs, report.Mode, "", tErr)
+		if tErr != nil {
+			fields["error"] = tErr
+			log.WithFields(fields).Error("Container log truncation error")
+			statsd.Count("log.truncate.error", 1, tags, StatsdSamplingRate)
+			continue
+		}
+		fields["reclaimed"] = helpers.FormatBytes(reclaimed)
+		log.WithFields(fields).Info("Truncated container log")
+		statsd.Count("log.truncated", 1, tags, StatsdSamplingRate)
+	}
+	statsd.TaggedGauge("logs.size", float64(total), []string{resourceTag(ResourceLogs)}, StatsdSamplingRate)
+}
+
+// truncateLog shrinks the log at path in place to its last keepTail bytes,
+// starting from a full line. With rotate the whole log is saved gzipped next
+// to it and emptied instead, keeping at most maxRotated saved logs. Docker
+// opens json-file logs in append mode so its writes continue from the new
+// end, only lines written between the last copy and the truncation are lost.
+// Returns the bytes reclaimed.
+func truncateLog(path string, keepTail int64, rotate bool, maxRotated int) (int64, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := info.Size()
+	if size <= keepTail {
+		return 0, nil
+	}
+	if rotate {
+		return rotateLog(file, path, maxRotated)
+	}
+
+	tail := make([]byte, keepTail)
+	if _, err := file.ReadAt(tail, size-keepTail); err != nil && err != io.EOF {
+		return 0, err
+	}
+	// Drop the partial first line
+	from := size
+	if i := bytes.IndexByte(tail, '\n'); i >= 0 {
+		from = size - keepTail + int64(i) + 1
+	}
+
+	end, err := moveTail(file, from)
+	if err != nil {
+		return 0, fmt.Errorf("moving log tail failed: %s", err)
+	}
+	if err := file.Truncate(end - from); err != nil {
+		return 0, err
+	}
+	return from, nil
+}
+
+// moveTail copies file from the offset to its start, catching up with what
+// is appended meanwhile. It returns the offset it copied up to.
+func moveTail(file *os.File, from int64) (int64, error) {
+	buffer := make([]byte, 32<<10)
+	end := from
+	for pass := 0; pass < logCatchUpPasses; pass++ {
+		info, err := file.Stat()
+		if err != nil {
+			return 0, err
+		}
+		if info.Size() <= end {
+			break
+		}
+		for end < info.Size() {
+			n, err := file.ReadAt(buffer, end)
+			if n > 0 {
+				// Only bytes already read are overwritten as the start is
+				// always behind
+				if _, wErr := file.WriteAt(buffer[:n], end-from); wErr != nil {
+					return 0, wErr
+				}
+				end += int64(n)
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	return end, nil
+}
+
+// rotateLog saves the whole log gzipped next to it before emptying it and
+// removes the oldest saved logs beyond maxRotated. Returns the bytes
+// reclaimed.
+func rotateLog(file *os.File, path string, maxRotated int) (int64, error) {
+	end, saved, err := saveLog(file, rotatedLogPath(path))
+	if err != nil {
+		return 0, fmt.Errorf("saving log failed: %s", err)
+	}
+	if err := file.Truncate(0); err != nil {
+		return 0, err
+	}
+	return end - saved + pruneRotatedLogs(path, maxRotated), nil
+}
+
+// rotatedLogPath names the saved copy of the log after the current time, so
+// earlier ones are never overwritten
+func rotatedLogPath(path string) string {
+	return path + rotatedLogInfix + clock.Now().UTC().Format(rotatedLogTimeFormat) + ".gz"
+}
+
+// pruneRotatedLogs removes the oldest logs saved next to the log at path
+// beyond the newest max. Returns the bytes reclaimed.
+func pruneRotatedLogs(path string, max int) int64 {
+	rotated, err := filepath.Glob(path + rotatedLogInfix + "*.gz")
+	if err != nil || len(rotated) <= max {
+		return 0
+	}
+	// Their names sort by the time they were saved
+	sort.Strings(rotated)
+	var reclaimed int64
+	for _, old := range rotated[:len(rotated)-max] {
+		info, err := os.Stat(old)
+		if err == nil {
+			err = os.Remove(old)
+		}
+		if err != nil {
+			log.WithFields(log.Fields{"path": old, "error": err}).Error("Removing rotated log error")
+			continue
+		}
+		reclaimed += info.Size()
+	}
+	return reclaimed
+}
+
+// saveLog writes file gzipped to a new file at path, catching up with what
+// is appended meanwhile. It returns the offset it copied up to and the
+// compressed size.
+func saveLog(file *os.File, path string) (int64, int64, error) {
+	saved, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer saved.Close()
+
+	gz := gzip.NewWriter(saved)
+	var end int64
+	for pass := 0; pass < logCatchUpPasses; pass++ {
+		info, err := file.Stat()
+		if err != nil {
+			return 0, 0, err
+		}
+		if info.Size() <= end {
+			break
+		}
+		if _, err := io.Copy(gz, io.NewSectionReader(file, end, info.Size()-end)); err != nil {
+			return 0, 0, err
+		}
+		end = info.Size()
+	}
+	if err := gz.Close(); err != nil {
+		return 0, 0, err
+	}
+	info, err := saved.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	return end, info.Size(), nil
+}
@@ -0,0 +1,264 @@
+package gc
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func logLines(from, to int) string {
+	var lines []string
+	for i := from; i <= to; i++ {
+		lines = append(lines, fmt.Sprintf(`{"log":"line %03d\n"}`, i))
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// savedLog reads the copies truncateLog saved next to the log at path
+func savedLog(t *testing.T, path string) string {
+	matches, _ := filepath.Glob(path + rotatedLogInfix + "*.gz")
+	sort.Strings(matches)
+	var content []byte
+	for _, match := range matches {
+		saved, err := os.Open(match)
+		assert.Nil(t, err, "saved log should be readable")
+		gz, err := gzip.NewReader(saved)
+		assert.Nil(t, err, "saved log should be gzipped")
+		data, _ := ioutil.ReadAll(gz)
+		saved.Close()
+		content = append(content, data...)
+	}
+	return string(content)
+}
+
+func TestTruncateLogKeepsTail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-gc-logs")
+	assert.Nil(t, err, "creating temp dir should succeed")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "container-json.log")
+	content := logLines(1, 100)
+	ioutil.WriteFile(path, []byte(content), 0644)
+
+	reclaimed, err := truncateLog(path, 50, false, DefaultMaxRotatedLogs)
+	assert.Nil(t, err, "truncating should succeed")
+
+	data, _ := ioutil.ReadFile(path)
+	assert.Equal(t, logLines(99, 100), string(data), "only full lines of the tail are kept in the log")
+	assert.Equal(t, "", savedLog(t, path), "nothing is saved next to the log")
+	assert.Equal(t, int64(len(content)-len(logLines(99, 100))), reclaimed, "reclaimed bytes are the log less its tail")
+
+	reclaimed, err = truncateLog(path, 1000, false, DefaultMaxRotatedLogs)
+	assert.Nil(t, err, "truncating small log should succeed")
+	assert.Equal(t, int64(0), reclaimed, "logs smaller than the tail are untouched")
+}
+
+func TestTruncateLogRotates(t *testing.T) {
+	_, restore := withFakeScheduleClock(time.Date(2016, 3, 25, 12, 30, 0, 0, time.UTC))
+	defer restore()
+	dir, err := ioutil.TempDir("", "docker-gc-logs")
+	assert.Nil(t, err, "creating temp dir should succeed")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "container-json.log")
+	ioutil.WriteFile(path, []byte(logLines(1, 100)), 0644)
+	ioutil.WriteFile(path+".1.gz", []byte("docker rotation"), 0644)
+
+	_, err = truncateLog(path, 50, true, DefaultMaxRotatedLogs)
+	assert.Nil(t, err, "rotating should succeed")
+
+	_, err = os.Stat(path + ".docker-gc-20160325T123000.000.gz")
+	assert.Nil(t, err, "rotated log is named after the time")
+	assert.Equal(t, logLines(1, 100), savedLog(t, path), "rotated log has the whole log")
+	data, _ := ioutil.ReadFile(path)
+	assert.Equal(t, "", string(data), "rotated log is emptied")
+	docker, _ := ioutil.ReadFile(path + ".1.gz")
+	assert.Equal(t, "docker rotation", string(docker), "docker's own rotation is left alone")
+
+	ioutil.WriteFile(path, []byte(logLines(101, 200)), 0644)
+	_, err = truncateLog(path, 50, true, DefaultMaxRotatedLogs)
+	assert.NotNil(t, err, "existing rotated log must not be overwritten")
+	assert.Equal(t, logLines(1, 100), savedLog(t, path), "existing rotated log is kept")
+	data, _ = ioutil.ReadFile(path)
+	assert.Equal(t, logLines(101, 200), string(data), "log isn't truncated unless saved")
+}
+
+func TestTruncateLogKeepsNewestRotatedLogs(t *testing.T) {
+	fake, restore := withFakeScheduleClock(time.Date(2016, 3, 25, 12, 30, 0, 0, time.UTC))
+	defer restore()
+	dir, err := ioutil.TempDir("", "docker-gc-logs")
+	assert.Nil(t, err, "creating temp dir should succeed")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "container-json.log")
+	var sizes []int64
+	for i := 0; i < 3; i++ {
+		ioutil.WriteFile(path, []byte(logLines(100*i+1, 100*i+100)), 0644)
+		reclaimed, err := truncateLog(path, 50, true, 2)
+		assert.Nil(t, err, "rotating should succeed")
+		saved, _ := filepath.Glob(path + rotatedLogInfix + "*.gz")
+		sort.Strings(saved)
+		info, _ := os.Stat(saved[len(saved)-1])
+		sizes = append(sizes, info.Size())
+		if i == 2 {
+			assert.Equal(t, int64(len(logLines(201, 300)))-sizes[2]+sizes[0], reclaimed, "pruned rotated logs are reclaimed")
+		}
+		fake.Advance(time.Hour)
+	}
+
+	saved, _ := filepath.Glob(path + rotatedLogInfix + "*.gz")
+	sort.Strings(saved)
+	assert.Equal(t, []string{
+		path + ".docker-gc-20160325T133000.000.gz",
+		path + ".docker-gc-20160325T143000.000.gz",
+	}, saved, "only the newest rotated logs are kept")
+	assert.Equal(t, logLines(101, 300), savedLog(t, path), "oldest rotated log is removed")
+}
+
+func TestTruncateLogWhileAppending(t *testing.T) {
+	for _, rotate := range []bool{false, true} {
+		dir, err := ioutil.TempDir("", "docker-gc-logs")
+		assert.Nil(t, err, "creating temp dir should succeed")
+		defer os.RemoveAll(dir)
+
+		path := filepath.Join(dir, "container-json.log")
+		// Docker's json-file driver appends a line per write
+		writer, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		assert.Nil(t, err, "opening log should succeed")
+		defer writer.Close()
+		for i := 1; i <= 1000; i++ {
+			writer.WriteString(logLines(i, i))
+		}
+
+		stop, written := make(chan struct{}), make(chan int)
+		go func() {
+			i := 1000
+			for {
+				select {
+				case <-stop:
+					written <- i
+					return
+				default:
+				}
+				i++
+				writer.WriteString(logLines(i, i))
+			}
+		}()
+		_, err = truncateLog(path, 500, rotate, DefaultMaxRotatedLogs)
+		assert.Nil(t, err, "truncating should succeed")
+		close(stop)
+		last := <-written + 10
+		for i := last - 9; i <= last; i++ {
+			writer.WriteString(logLines(i, i))
+		}
+
+		data, _ := ioutil.ReadFile(path)
+		assert.False(t, strings.Contains(string(data), "\x00"), "log has no hole")
+		logged := strings.SplitAfter(string(data), "\n")
+		logged = logged[:len(logged)-1]
+		var numbers []int
+		for _, line := range logged {
+			var number int
+			fmt.Sscanf(line, `{"log":"line %d`, &number)
+			numbers = append(numbers, number)
+		}
+		assert.True(t, sort.IntsAreSorted(numbers), "log has its lines in order")
+		if assert.NotEmpty(t, numbers, "lines written after the truncation are in the log") {
+			assert.Equal(t, last, numbers[len(numbers)-1], "lines written after the truncation are appended")
+		}
+
+		if !rotate {
+			assert.Equal(t, "", savedLog(t, path), "nothing is saved next to the log")
+			if assert.NotEmpty(t, numbers) {
+				assert.True(t, numbers[0] > 1000-500/len(logLines(1, 1)), "only the tail is kept")
+			}
+			continue
+		}
+		rotated := savedLog(t, path)
+		rotatedLines := strings.SplitAfter(rotated, "\n")
+		rotatedLines = rotatedLines[:len(rotatedLines)-1]
+		assert.True(t, len(rotatedLines) >= 1000, "lines written before are rotated")
+		assert.Equal(t, logLines(1, len(rotatedLines)), rotated, "rotated log has every line in order")
+		if assert.NotEmpty(t, numbers) {
+			assert.True(t, numbers[0] > len(rotatedLines), "rotated lines aren't kept in the log")
+			assert.Equal(t, logLines(numbers[0], last), string(data), "log has every line since the truncation in order")
+		}
+	}
+}
+
+func TestMonitorDiskSpaceTruncatesLogs(t *testing.T) {
+	root, err := ioutil.TempDir("", "docker-gc-root")
+	assert.Nil(t, err, "creating temp dir should succeed")
+	defer os.RemoveAll(root)
+	outside, err := ioutil.TempDir("", "docker-gc-outside")
+	assert.Nil(t, err, "creating temp dir should succeed")
+	defer os.RemoveAll(outside)
+
+	paths := map[string]string{
+		"big":       filepath.Join(root, "big-json.log"),
+		"small":     filepath.Join(root, "small-json.log"),
+		"protected": filepath.Join(root, "protected-json.log"),
+		"outside":   filepath.Join(outside, "outside-json.log"),
+	}
+	ioutil.WriteFile(paths["big"], []byte(logLines(1, 100)), 0644)
+	ioutil.WriteFile(paths["small"], []byte(logLines(1, 2)), 0644)
+	ioutil.WriteFile(paths["protected"], []byte(logLines(1, 100)), 0644)
+	ioutil.WriteFile(paths["outside"], []byte(logLines(1, 100)), 0644)
+
+	responses := make(testResponseMap)
+	responses["/_ping"] = []response{{"GET", "default", "OK"}}
+	responses["/info"] = []response{{"GET", "default", string(mustMarshal(map[string]string{"DockerRootDir": root}))}}
+	responses["/images/json"] = []response{{"GET", "all=1", `[]`}}
+	responses["/containers/json"] = []response{{"GET", "default", `[{"Id": "big"}, {"Id": "small"}, {"Id": "protected"}, {"Id": "outside"}]`}}
+	for id, path := range paths {
+		inspect := map[string]interface{}{"Id": id, "Name": "/" + id, "LogPath": path}
+		if id == "protected" {
+			inspect["Config"] = map[string]interface{}{"Labels": map[string]string{KeepLogsLabel: "true"}}
+		}
+		responses["/containers/"+id+"/json"] = []response{{"GET", "default", string(mustMarshal(inspect))}}
+	}
+
+	hitsPerPath := map[string]int{}
+	server := testServer(responses, &hitsPerPath)
+	defer server.Close()
+
+	Client = nil
+	StartDockerClient(server.URL)
+
+	diskSpaceFetcher = &FakeDiskSpaceFetcher{}
+	defer func() { diskSpaceFetcher = nil }()
+
+	var reports []Report
+	reportHooks = nil
+	AddReportHook(func(report Report) { reports = append(reports, report) })
+	defer func() { reportHooks = nil }()
+
+	CleanAllWithDiskSpacePolicy(GCPolicy{
+		HighDiskSpaceThreshold: 99,
+		LowDiskSpaceThreshold:  95,
+		MaxLogSize:             100,
+		LogKeepTail:            50,
+	})
+
+	sizes := map[string]int{}
+	for id, path := range paths {
+		data, _ := ioutil.ReadFile(path)
+		sizes[id] = len(data)
+	}
+	assert.Equal(t, len(logLines(99, 100)), sizes["big"], "big log is truncated to its tail")
+	assert.Equal(t, "", savedLog(t, paths["big"]), "nothing is saved next to big log")
+	assert.Equal(t, len(logLines(1, 2)), sizes["small"], "small log is untouched")
+	assert.Equal(t, len(logLines(1, 100)), sizes["protected"], "protected log is untouched")
+	assert.Equal(t, len(logLines(1, 100)), sizes["outside"], "log outside of docker root is untouched")
+
+	assert.Equal(t, 1, len(reports), "one report per run")
+	assert.Equal(t, ResourceReport{Candidates: 1, Deleted: 1}, reports[0].Logs, "truncated logs are reported")
+}
@@ -0,0 +1,187 @@
+package gc
+
+import (
+	"net/http"
+	"pkg/statsd"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// Phases of a sweep timed in sweep.phase
+const (
+	phaseListing    = "listing"
+	phaseInspection = "inspection"
+	phaseHistory    = "history"
+	phaseDeletion   = "deletion"
+	phaseDiskStats  = "disk_stats"
+)
+
+// Outcomes of Docker API calls
+const (
+	outcomeSuccess  = "success"
+	outcomeConflict = "conflict"
+	outcomeNotFound = "not_found"
+	outcomeError    = "error"
+)
+
+// Results of deletions, a conflict is the daemon refusing to delete
+// something in use
+const (
+	resultSuccess  = "success"
+	resultFailure  = "failure"
+	resultConflict = "conflict"
+)
+
+// otherRepository tags the repositories past the limit
+const otherRepository = "other"
+
+var (
+	// StatsdRepositoryLimit caps how many distinct repositories image
+	// deletions are tagged with, the rest are tagged as other
+	StatsdRepositoryLimit = 50
+	repositoryTags        = map[string]bool{}
+	repositoryTagsLock    sync.Mutex
+)
+
+func policyTag(mode string) string {
+	return "policy:" + mode
+}
+
+// runTag tags with the run of the scheduler or the command taking the sweep
+// lock, the resources of scheduled TTL runs joined with +
+func runTag(name string) string {
+	return "run:" + strings.Replace(name, ",", "+", -1)
+}
+
+func resourceTag(dataType string) string {
+	switch dataType {
+	case Image, DanglingImage:
+		return "resource:image"
+	case Container, ContainerWithVolumes, CreatedContainer:
+		return "resource:container"
+	}
+	return "resource:" + dataType
+}
+
+// repositoryTag tags with the first StatsdRepositoryLimit distinct
+// repositories seen, the ones after them are tagged as other
+func repositoryTag(repository string) string {
+	repositoryTagsLock.Lock()
+	defer repositoryTagsLock.Unlock()
+	if !repositoryTags[repository] {
+		if len(repositoryTags) >= StatsdRepositoryLimit {
+			repository = otherRepository
+		} else {
+			repositoryTags[repository] = true
+		}
+	}
+	return "repository:" + repository
+}
+
+// repositoryOf returns the repository of an image tag or digest reference,
+// eg. registry:5000/app of registry:5000/app:v1, and none for untagged
+func repositoryOf(reference string) string {
+	if reference == "" || reference == untaggedTag {
+		return "none"
+	}
+	if at := strings.Index(reference, "@"); at >= 0 {
+		reference = reference[:at]
+	}
+	if colon := strings.LastIndex(reference, ":"); colon > strings.LastIndex(reference, "/") {
+		reference = reference[:colon]
+	}
+	return reference
+}
+
+// countDeletion counts the deletion in a run of the policy by its result,
+// images are tagged with their repository too
+func countDeletion(dataType, policy, repository string, err error) {
+	result := resultSuccess
+	if err != nil {
+		result = resultFailure
+		if dockerOutcome(err) == outcomeConflict {
+			result = resultConflict
+		}
+	}
+	tags := []string{resourceTag(dataType), policyTag(policy), "result:" + result}
+	if repository != "" {
+		tags = append(tags, repositoryTag(repository))
+	}
+	statsd.Count("deletions", 1, tags, StatsdSamplingRate)
+}
+
+// filesystemTags tags the metrics of a filesystem monitored in diskspace
+// mode, with its path when it's not the Docker root
+func filesystemTags(filesystem Filesystem) []string {
+	tags := []string{policyTag(DiskPolicy)}
+	if filesystem.Path != "" {
+		tags = append(tags, "path:"+filesystem.Path)
+	}
+	return tags
+}
+
+// gaugeDiskUsage submits the block and inode usage of the filesystem
+func gaugeDiskUsage(filesystem Filesystem, usage DiskUsage) {
+	tags := filesystemTags(filesystem)
+	statsd.TaggedGauge("disk.used_bytes", float64(usage.BytesUsed), tags, StatsdSamplingRate)
+	statsd.TaggedGauge("disk.used_percent", usage.BytesUsedPercent, tags, StatsdSamplingRate)
+	statsd.TaggedGauge("disk.inodes.used", float64(usage.InodesUsed), tags, StatsdSamplingRate)
+	statsd.TaggedGauge("disk.inodes.used_percent", usage.InodesUsedPercent, tags, StatsdSamplingRate)
+}
+
+// gaugeReclaimed submits the bytes the run reclaimed, measured only when the
+// disk usage is known
+func gaugeReclaimed(report *Report) {
+	tags := []string{policyTag(report.Mode)}
+	statsd.TaggedGauge("reclaimed.estimated_bytes", float64(report.EstimatedBytesReclaimed), tags, StatsdSamplingRate)
+	if report.DiskBefore != nil && report.DiskAfter != nil {
+		statsd.TaggedGauge("reclaimed.measured_bytes", float64(report.MeasuredBytesReclaimed), tags, StatsdSamplingRate)
+	}
+}
+
+// timePhase starts timing a phase of a sweep, the returned function submits
+// its duration
+func timePhase(phase string) func() {
+	started := time.Now()
+	return func() {
+		statsd.Timer("sweep.phase", time.Since(started), []string{"phase:" + phase}, StatsdSamplingRate)
+	}
+}
+
+// timeDockerCall starts timing a call to an endpoint of the Docker API about
+// a resource type, the returned function submits its latency and counts it
+// as an error unless it succeeded
+func timeDockerCall(endpoint, resource string) func(error) {
+	started := time.Now()
+	return func(err error) {
+		outcome := dockerOutcome(err)
+		tags := []string{"endpoint:" + endpoint, "resource:" + resource, "outcome:" + outcome}
+		statsd.Timer("docker.api.latency", time.Since(started), tags, StatsdSamplingRate)
+		if outcome != outcomeSuccess {
+			statsd.Count("docker.api.errors", 1, tags, StatsdSamplingRate)
+		}
+	}
+}
+
+func dockerOutcome(err error) string {
+	switch e := err.(type) {
+	case nil:
+		return outcomeSuccess
+	case *docker.NoSuchContainer:
+		return outcomeNotFound
+	case *docker.Error:
+		switch e.Status {
+		case http.StatusConflict:
+			return outcomeConflict
+		case http.StatusNotFound:
+			return outcomeNotFound
+		}
+	}
+	if err == docker.ErrNoSuchImage {
+		return outcomeNotFound
+	}
+	return outcomeError
+}
@@ -0,0 +1,132 @@
+package gc
+
+import (
+	"errors"
+	"os"
+	"pkg/statsd"
+	"testing"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	udp "github.com/n1koo/go-udp-testing"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDockerOutcome(t *testing.T) {
+	assert.Equal(t, outcomeSuccess, dockerOutcome(nil), "no error is success")
+	assert.Equal(t, outcomeConflict, dockerOutcome(&docker.Error{Status: 409}), "409 is conflict")
+	assert.Equal(t, outcomeNotFound, dockerOutcome(&docker.Error{Status: 404}), "404 is not found")
+	assert.Equal(t, outcomeNotFound, dockerOutcome(&docker.NoSuchContainer{ID: "abc"}), "missing container is not found")
+	assert.Equal(t, outcomeNotFound, dockerOutcome(docker.ErrNoSuchImage), "missing image is not found")
+	assert.Equal(t, outcomeError, dockerOutcome(&docker.Error{Status: 500}), "500 is error")
+	assert.Equal(t, outcomeError, dockerOutcome(errors.New("connection refused")), "other errors are errors")
+}
+
+func TestTimingMetrics(t *testing.T) {
+	hitsPerPath := map[string]int{}
+	server := testServer(generateTestData(1, 1, t), &hitsPerPath)
+	defer server.Close()
+
+	statsdAddress := "127.0.0.1:6668"
+	udp.SetAddr(statsdAddress)
+	statsd.Configure(statsdAddress, "test.dockergc.")
+	os.Unsetenv("TESTMODE")
+	defer os.Setenv("TESTMODE", "true")
+
+	StartDockerClient(server.URL)
+
+	udp.ShouldReceiveAll(t, []string{
+		"test.dockergc.sweep.duration:",
+		"|ms|#policy:date",
+		"|ms|#phase:listing",
+		"|ms|#phase:inspection",
+		"|ms|#phase:history",
+		"|ms|#phase:deletion",
+		"test.dockergc.docker.api.latency:",
+		"|ms|#endpoint:images.list,resource:image,outcome:success",
+		"|ms|#endpoint:containers.inspect,resource:container,outcome:success",
+		"|ms|#endpoint:images.remove,resource:image,outcome:success",
+		"|ms|#endpoint:containers.remove,resource:container,outcome:success",
+	}, func() {
+		CleanAll(DatePolicy, GCPolicy{TtlImages: 0 * time.Second, TtlContainers: 0 * time.Second})
+	})
+}
+
+func TestRepositoryOf(t *testing.T) {
+	assert.Equal(t, "app", repositoryOf("app:latest"), "tag is removed")
+	assert.Equal(t, "registry:5000/team/app", repositoryOf("registry:5000/team/app:v1"), "registry port is kept")
+	assert.Equal(t, "registry:5000/app", repositoryOf("registry:5000/app"), "untagged reference is the repository")
+	assert.Equal(t, "app", repositoryOf("app@sha256:abc"), "digest is removed")
+	assert.Equal(t, "none", repositoryOf("<none>:<none>"), "untagged image has no repository")
+	assert.Equal(t, "none", repositoryOf(""), "image without tags has no repository")
+}
+
+func TestRepositoryTagLimit(t *testing.T) {
+	defer func(limit int) {
+		StatsdRepositoryLimit = limit
+		repositoryTags = map[string]bool{}
+	}(StatsdRepositoryLimit)
+	StatsdRepositoryLimit = 2
+	repositoryTags = map[string]bool{}
+
+	assert.Equal(t, "repository:app", repositoryTag("app"), "repositories are tagged up to the limit")
+	assert.Equal(t, "repository:db", repositoryTag("db"), "repositories are tagged up to the limit")
+	assert.Equal(t, "repository:other", repositoryTag("cache"), "repositories past the limit are tagged as other")
+	assert.Equal(t, "repository:app", repositoryTag("app"), "repositories seen before the limit keep their tag")
+}
+
+func TestTaggedMetrics(t *testing.T) {
+	hitsPerPath := map[string]int{}
+	server := testServer(danglingTestData(), &hitsPerPath)
+	defer server.Close()
+
+	statsdAddress := "127.0.0.1:6669"
+	udp.SetAddr(statsdAddress)
+	statsd.Configure(statsdAddress, "test.dockergc.", "env:test")
+	os.Unsetenv("TESTMODE")
+	defer os.Setenv("TESTMODE", "true")
+
+	StartDockerClient(server.URL)
+
+	udp.ShouldReceiveAll(t, []string{
+		"test.dockergc.image.amount:3|g|#env:test,resource:image",
+		"test.dockergc.deletions:1|c|#env:test,resource:image,policy:date,result:success,repository:app",
+		"test.dockergc.image.deleted:1|c|#env:test,resource:image,policy:date,repository:app",
+		"test.dockergc.image.deleted:1|c|#env:test,resource:image,policy:date,repository:none",
+	}, func() {
+		CleanImages(0)
+	})
+
+	udp.ShouldReceiveAll(t, []string{
+		"test.dockergc.deletions:1|c|#env:test,resource:image,policy:disk,result:conflict,repository:app",
+		"test.dockergc.deletions:1|c|#env:test,resource:container,policy:date,result:failure",
+	}, func() {
+		countDeletion(Image, DiskPolicy, "app", &docker.Error{Status: 409})
+		countDeletion(Container, DatePolicy, "", errors.New("connection refused"))
+	})
+
+	report := newReport(DiskPolicy)
+	report.EstimatedBytesReclaimed = 2048
+	report.DiskBefore = &DiskUsage{BytesUsed: 4096}
+	report.DiskAfter = &DiskUsage{BytesUsed: 1024}
+	report.MeasuredBytesReclaimed = 3072
+	udp.ShouldReceiveAll(t, []string{
+		"test.dockergc.reclaimed.estimated_bytes:2048",
+		"test.dockergc.reclaimed.measured_bytes:3072",
+		"test.dockergc.disk.used_percent:85",
+		"|g|#env:test,policy:disk,path:/var/lib/docker",
+	}, func() {
+		gaugeReclaimed(report)
+		gaugeDiskUsage(Filesystem{Path: "/var/lib/docker"}, DiskUsage{BytesUsedPercent: 85})
+	})
+
+	daemon := &connection{policy: DiskPolicy, connected: true}
+	udp.ShouldReceiveAll(t, []string{
+		"test.dockergc.docker.connected:1|g|#env:test,policy:disk",
+	}, daemon.gauge)
+}
+
+func TestRunTag(t *testing.T) {
+	assert.Equal(t, "run:disk", runTag(DiskPolicy), "continuous mode runs are tagged with their policy")
+	assert.Equal(t, "run:images+containers", runTag("images,containers"), "resources of a schedule are joined with +")
+}
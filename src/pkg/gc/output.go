@@ -0,0 +1,111 @@
+package gc
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"pkg/helpers"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	TableOutput = "table"
+	JSONOutput  = "json"
+	CSVOutput   = "csv"
+)
+
+// WriteExplanation renders the explanation either as a human readable table
+// or as JSON
+func WriteExplanation(w io.Writer, explanation Explanation, format string) error {
+	switch format {
+	case JSONOutput:
+		return writeJSON(w, explanation)
+	case TableOutput:
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(tw, "%s %s %s\n", explanation.Type, explanation.ID, strings.Join(explanation.Names, ", "))
+		for _, verdict := range explanation.Verdicts {
+			fmt.Fprintf(tw, "  %s\t%s\t%s\n", verdict.Rule, keepOrDelete(verdict.Keep), verdict.Reason)
+		}
+		if len(explanation.Untag) > 0 {
+			fmt.Fprintf(tw, "  %s\tuntag\t%s\n", TagsRule, strings.Join(explanation.Untag, ", "))
+		}
+		if explanation.EvictionPosition > 0 {
+			fmt.Fprintf(tw, "  diskspace\tdelete\tbatch %d of %d, position %d in eviction order\n",
+				explanation.EvictionBatch, explanation.EvictionBatches, explanation.EvictionPosition)
+		}
+		fmt.Fprintf(tw, "decision: %s\n", keepOrDelete(!explanation.Delete))
+		return tw.Flush()
+	default:
+		return fmt.Errorf("%s is not valid output format", format)
+	}
+}
+
+// WriteInventory renders the inventory as a table, JSON or CSV
+func WriteInventory(w io.Writer, entries []InventoryEntry, format string) error {
+	header := []string{"TYPE", "ID", "NAMES", "CREATED", "FINISHED", "SIZE", "IN USE", "COLLECT", "UNTAG"}
+	row := func(entry InventoryEntry, size string) []string {
+		return []string{
+			entry.Type,
+			entry.ID,
+			strings.Join(entry.Names, ","),
+			formatTime(entry.Created),
+			formatTime(entry.FinishedAt),
+			size,
+			strconv.FormatBool(entry.InUse),
+			strconv.FormatBool(entry.Collect),
+			strings.Join(entry.Untag, ","),
+		}
+	}
+
+	switch format {
+	case JSONOutput:
+		if entries == nil {
+			entries = []InventoryEntry{}
+		}
+		return writeJSON(w, entries)
+	case CSVOutput:
+		cw := csv.NewWriter(w)
+		cw.Write(header)
+		for _, entry := range entries {
+			cw.Write(row(entry, strconv.FormatInt(entry.Size, 10)))
+		}
+		cw.Flush()
+		return cw.Error()
+	case TableOutput:
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, strings.Join(header, "\t"))
+		for _, entry := range entries {
+			fmt.Fprintln(tw, strings.Join(row(entry, helpers.FormatBytes(entry.Size)), "\t"))
+		}
+		return tw.Flush()
+	default:
+		return fmt.Errorf("%s is not valid output format", format)
+	}
+}
+
+func writeJSON(w io.Writer, data interface{}) error {
+	out, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(out))
+	return err
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+func keepOrDelete(keep bool) string {
+	if keep {
+		return "keep"
+	}
+	return "delete"
+}
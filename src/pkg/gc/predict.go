@@ -0,0 +1,99 @@
+package gc
+
+import (
+	"pkg/statsd"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// TriggerPredicted starts the cleanup when the high threshold is
+	// projected to be reached within the prediction horizon
+	TriggerPredicted = "predicted"
+
+	// DefaultPredictionWindow is how far back the fill rate is estimated from
+	DefaultPredictionWindow = 10 * time.Minute
+)
+
+type usageSample struct {
+	at        time.Time
+	bytesUsed uint64
+}
+
+// fillRateTracker keeps the disk usage samples of each monitored filesystem by
+// path, the Docker root is the empty path
+type fillRateTracker struct {
+	samples map[string][]usageSample
+	now     func() time.Time
+	lock    sync.Mutex
+}
+
+var fillRates = newFillRateTracker()
+
+func newFillRateTracker() *fillRateTracker {
+	return &fillRateTracker{samples: map[string][]usageSample{}, now: time.Now}
+}
+
+// sample records the usage of the filesystem and returns how many bytes per
+// second it filled up within the window, zero until there are two samples
+func (t *fillRateTracker) sample(path string, usage DiskUsage, window time.Duration) float64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := t.now()
+	samples := append(t.samples[path], usageSample{at: now, bytesUsed: usage.BytesUsed})
+	for len(samples) > 2 && now.Sub(samples[0].at) > window {
+		samples = samples[1:]
+	}
+	t.samples[path] = samples
+
+	first, last := samples[0], samples[len(samples)-1]
+	elapsed := last.at.Sub(first.at).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return (float64(last.bytesUsed) - float64(first.bytesUsed)) / elapsed
+}
+
+// timeToHighThreshold projects when the usage filling at the positive rate
+// reaches the high threshold
+func (p GCPolicy) timeToHighThreshold(usage DiskUsage, rate float64) time.Duration {
+	remaining := float64(usage.bytesFree() - p.HighDiskSpaceFree)
+	if p.HighDiskSpaceFree == 0 {
+		remaining = p.HighDiskSpaceThreshold/100*float64(usage.BytesTotal) - float64(usage.BytesUsed)
+	}
+	if remaining < 0 {
+		remaining = 0
+	}
+	return time.Duration(remaining / rate * float64(time.Second))
+}
+
+// predictTrigger samples the usage and tells whether the high threshold is
+// projected to be reached within the prediction horizon
+func predictTrigger(filesystem Filesystem, usage DiskUsage, policy GCPolicy) bool {
+	if policy.PredictionHorizon == 0 {
+		return false
+	}
+	window := policy.PredictionWindow
+	if window == 0 {
+		window = DefaultPredictionWindow
+	}
+
+	rate := fillRates.sample(filesystem.Path, usage, window)
+	if rate <= 0 || usage.BytesTotal == 0 {
+		return false
+	}
+	timeToFull := time.Duration(float64(usage.bytesFree()) / rate * float64(time.Second))
+	statsd.TaggedGauge("disk.time_to_full", timeToFull.Seconds(), filesystemTags(filesystem), StatsdSamplingRate)
+
+	timeToHigh := policy.timeToHighThreshold(usage, rate)
+	log.WithFields(filesystem.withPath(log.Fields{
+		"fillRate":            int64(rate),
+		"timeToHighThreshold": timeToHigh,
+		"timeToFull":          timeToFull,
+		"horizon":             policy.PredictionHorizon,
+	})).Debug("Projected disk usage")
+	return timeToHigh < policy.PredictionHorizon
+}
@@ -0,0 +1,92 @@
+package gc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// FakeFillingDiskSpaceFetcher has the used bytes set by the test, freeing a GiB
+// on every read after cleanup has started
+type FakeFillingDiskSpaceFetcher struct {
+	used     uint64
+	cleaning bool
+}
+
+func (d *FakeFillingDiskSpaceFetcher) GetDiskUsage() (DiskUsage, error) {
+	usage := DiskUsage{BytesUsed: d.used, BytesTotal: 100 << 30}
+	usage.BytesUsedPercent = 100 * float64(usage.BytesUsed) / float64(usage.BytesTotal)
+	if d.cleaning && d.used >= 1<<30 {
+		d.used -= 1 << 30
+	}
+	return usage, nil
+}
+
+func withFakeClock(start time.Time) (*time.Time, func()) {
+	clock := start
+	previous := fillRates
+	fillRates = newFillRateTracker()
+	fillRates.now = func() time.Time { return clock }
+	return &clock, func() { fillRates = previous }
+}
+
+func TestFillRateTracker(t *testing.T) {
+	clock, restore := withFakeClock(time.Now())
+	defer restore()
+
+	assert.Equal(t, 0.0, fillRates.sample("", DiskUsage{BytesUsed: 100}, time.Minute), "one sample has no rate")
+	*clock = clock.Add(10 * time.Second)
+	assert.Equal(t, 10.0, fillRates.sample("", DiskUsage{BytesUsed: 200}, time.Minute), "rate is bytes per second")
+	*clock = clock.Add(10 * time.Second)
+	assert.Equal(t, 0.0, fillRates.sample("/other", DiskUsage{BytesUsed: 200}, time.Minute), "filesystems have their own samples")
+
+	*clock = clock.Add(2 * time.Minute)
+	assert.Equal(t, 300.0/130, fillRates.sample("", DiskUsage{BytesUsed: 500}, time.Minute), "samples outside window are dropped")
+	assert.Equal(t, 2, len(fillRates.samples[""]), "at least two samples are kept")
+
+	policy := GCPolicy{HighDiskSpaceThreshold: 90}
+	assert.Equal(t, 10*time.Second, policy.timeToHighThreshold(DiskUsage{BytesUsed: 800, BytesTotal: 1000}, 10), "time to percentage threshold")
+	policy = GCPolicy{HighDiskSpaceFree: 100}
+	assert.Equal(t, 5*time.Second, policy.timeToHighThreshold(DiskUsage{BytesUsed: 850, BytesTotal: 1000}, 10), "time to free space threshold")
+}
+
+func TestPredictiveCleanup(t *testing.T) {
+	hitsPerPath := map[string]int{}
+	server := testServer(generateTestData(1, 1, t), &hitsPerPath)
+	defer server.Close()
+
+	Client = nil
+	StartDockerClient(server.URL)
+
+	clock, restore := withFakeClock(time.Now())
+	defer restore()
+
+	policy := GCPolicy{
+		HighDiskSpaceThreshold: 90,
+		LowDiskSpaceThreshold:  50,
+		TtlContainers:          1000 * time.Hour,
+		PredictionHorizon:      10 * time.Minute,
+	}
+	disk := &FakeFillingDiskSpaceFetcher{used: 50 << 30}
+	root := Filesystem{Resources: allResources}
+
+	report := newReport(DiskPolicy)
+	cleanFilesystem(disk, root, policy, report)
+	assert.Equal(t, 0, len(report.Triggers), "first sample can't predict")
+
+	*clock = clock.Add(1 * time.Minute)
+	disk.used = 60 << 30
+	report = newReport(DiskPolicy)
+	cleanFilesystem(disk, root, GCPolicy{HighDiskSpaceThreshold: 90, LowDiskSpaceThreshold: 50, TtlContainers: 1000 * time.Hour}, report)
+	assert.Equal(t, 0, len(report.Triggers), "cleanup is not started early without horizon")
+
+	// Filling 10GiB per minute reaches 90% in 2 minutes
+	*clock = clock.Add(1 * time.Minute)
+	disk.used = 70 << 30
+	disk.cleaning = true
+	report = newReport(DiskPolicy)
+	cleanFilesystem(disk, root, policy, report)
+	assert.Equal(t, []string{TriggerPredicted}, report.Triggers, "cleanup starts early when high threshold is within horizon")
+	assert.Equal(t, 5, report.Images.Deleted, "images are cleaned towards the low threshold")
+}
@@ -0,0 +1,154 @@
+package gc
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"pkg/helpers"
+	"pkg/statsd"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/fsouza/go-dockerclient"
+)
+
+// DiskBreakdown estimates what the used disk space consists of when cleanup
+// can't reach the low threshold. Image sizes include shared layers so the
+// numbers are upper bounds.
+type DiskBreakdown struct {
+	ImagesInUse     int64 `json:"imagesInUse"`
+	ContainerLayers int64 `json:"containerLayers"`
+	Volumes         int64 `json:"volumes"`
+	Logs            int64 `json:"logs"`
+	// Everything else on the filesystem, zero when the disk usage in bytes is
+	// not known
+	Other int64 `json:"other"`
+}
+
+// reportUnreclaimablePressure logs and emits metrics of what is using the disk
+// space docker-gc is not allowed to reclaim on the filesystem with the usage
+func reportUnreclaimablePressure(filesystem Filesystem, usage DiskUsage, policy GCPolicy) DiskBreakdown {
+	breakdown := getDiskBreakdown(filesystem, usage)
+	usedDiskSpace := usage.usedPercent()
+
+	log.WithFields(log.Fields{
+		"currentUsedDiskSpace":  usedDiskSpace,
+		"lowDiskSpaceThreshold": policy.lowThreshold(),
+		"imagesInUse":           helpers.FormatBytes(breakdown.ImagesInUse),
+		"containerLayers":       helpers.FormatBytes(breakdown.ContainerLayers),
+		"volumes":               helpers.FormatBytes(breakdown.Volumes),
+		"logs":                  helpers.FormatBytes(breakdown.Logs),
+		"other":                 helpers.FormatBytes(breakdown.Other),
+	}).Warn("Unreclaimable disk pressure, low disk space threshold can't be reached")
+
+	tags := filesystemTags(filesystem)
+	statsd.Count("disk.unreclaimable", 1, tags, StatsdSamplingRate)
+	statsd.TaggedGauge("disk.unreclaimable.images_in_use", float64(breakdown.ImagesInUse), append(tags, resourceTag(Image)), StatsdSamplingRate)
+	statsd.TaggedGauge("disk.unreclaimable.container_layers", float64(breakdown.ContainerLayers), append(tags, resourceTag(Container)), StatsdSamplingRate)
+	statsd.TaggedGauge("disk.unreclaimable.volumes", float64(breakdown.Volumes), append(tags, resourceTag("volume")), StatsdSamplingRate)
+	statsd.TaggedGauge("disk.unreclaimable.logs", float64(breakdown.Logs), append(tags, resourceTag(ResourceLogs)), StatsdSamplingRate)
+	statsd.TaggedGauge("disk.unreclaimable.other", float64(breakdown.Other), tags, StatsdSamplingRate)
+	statsd.Event("Unreclaimable disk pressure", fmt.Sprintf(
+		"Used disk space %.2f%% is above low threshold %s after cleanup. Images in use %s, container layers %s, volumes %s, logs %s, other %s",
+		usedDiskSpace, policy.lowThreshold(),
+		helpers.FormatBytes(breakdown.ImagesInUse), helpers.FormatBytes(breakdown.ContainerLayers),
+		helpers.FormatBytes(breakdown.Volumes), helpers.FormatBytes(breakdown.Logs), helpers.FormatBytes(breakdown.Other),
+	), tags)
+
+	return breakdown
+}
+
+// getDiskBreakdown attributes the usage of the filesystem, everything Docker
+// doesn't account for is other. Only what Docker stores on the filesystem is
+// counted, the Docker root's filesystem when it has no path.
+func getDiskBreakdown(filesystem Filesystem, usage DiskUsage) DiskBreakdown {
+	var breakdown DiskBreakdown
+
+	var root, layers string
+	finished := timeDockerCall("info", "system")
+	info, err := Client.Info()
+	finished(err)
+	if err != nil {
+		log.WithField("error", err).Warn("Getting docker info failed, counting all of Docker's data on the filesystem")
+	} else {
+		root = info.DockerRootDir
+		if info.Driver != "" {
+			// Container writable layers are stored with the image layers
+			layers = filepath.Join(root, info.Driver)
+		}
+	}
+	path := filesystem.Path
+	if path == "" {
+		path = root
+	}
+	device, deviceErr := fileDevice(path)
+	// Paths that can't be told apart are counted on the filesystem
+	stored := func(path string) bool {
+		if deviceErr != nil || path == "" {
+			return true
+		}
+		pathDevice, err := fileDevice(path)
+		return err != nil || pathDevice == device
+	}
+	layersStored := stored(layers)
+
+	images, err := listImages()
+	if err != nil {
+		log.WithField("error", err).Error("Listing images error")
+	}
+	for _, image := range images {
+		if layersStored && inUseVerdict(image).Keep {
+			breakdown.ImagesInUse += image.Size
+		}
+	}
+
+	finished = timeDockerCall("containers.list", Container)
+	containers, err := Client.ListContainers(docker.ListContainersOptions{All: true, Size: true})
+	finished(err)
+	if err != nil {
+		log.WithField("error", err).Error("Listing containers error")
+	}
+	for _, container := range containers {
+		if layersStored {
+			breakdown.ContainerLayers += container.SizeRw
+		}
+
+		finished := timeDockerCall("containers.inspect", Container)
+		data, cErr := Client.InspectContainer(container.ID)
+		finished(cErr)
+		if cErr != nil {
+			log.WithField("error", cErr).Error("Fetching container full data error")
+			continue
+		}
+		if data.LogPath != "" && stored(data.LogPath) {
+			if info, sErr := os.Stat(data.LogPath); sErr == nil {
+				breakdown.Logs += info.Size()
+			}
+		}
+	}
+
+	if volumes := filepath.Join(root, volumesResource); root != "" && stored(volumes) {
+		breakdown.Volumes = dirSize(volumes)
+	}
+
+	if usage.BytesTotal > 0 {
+		attributed := breakdown.ImagesInUse + breakdown.ContainerLayers + breakdown.Volumes + breakdown.Logs
+		if other := int64(usage.BytesUsed) - attributed; other > 0 {
+			breakdown.Other = other
+		}
+	}
+
+	return breakdown
+}
+
+// dirSize sums the size of the regular files under path, unreadable files are
+// skipped
+func dirSize(path string) int64 {
+	var size int64
+	filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
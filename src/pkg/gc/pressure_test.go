@@ -0,0 +1,128 @@
+package gc
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	logrustest "github.com/Sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiskBreakdown(t *testing.T) {
+	root, err := ioutil.TempDir("", "docker-gc-root")
+	assert.Nil(t, err, "creating temp dir should succeed")
+	defer os.RemoveAll(root)
+
+	os.MkdirAll(filepath.Join(root, "volumes", "data", "_data"), 0755)
+	ioutil.WriteFile(filepath.Join(root, "volumes", "data", "_data", "file"), make([]byte, 300), 0644)
+	logPath := filepath.Join(root, "container-json.log")
+	ioutil.WriteFile(logPath, make([]byte, 200), 0644)
+
+	responses := make(testResponseMap)
+	responses["/_ping"] = []response{{"GET", "default", "OK"}}
+	responses["/info"] = []response{{"GET", "default", string(mustMarshal(map[string]string{"DockerRootDir": root}))}}
+	responses["/images/json"] = []response{{"GET", "all=1", `[{"Id": "used", "Size": 1000}, {"Id": "unused", "Size": 5000}]`}}
+	responses["/images/used/history"] = []response{{"GET", "default", `[{"Id": "used"}]`}}
+	runningFilter := mustMarshal(filters{Status: []string{"running"}})
+	responses["/containers/json"] = []response{
+		{"GET", "default", `[{"Id": "running", "Image": "used", "SizeRw": 400}]`},
+		{"GET", fmt.Sprintf("filters=%s", string(runningFilter)), `[{"Id": "running", "Image": "used"}]`}}
+	responses["/containers/running/json"] = []response{{"GET", "default", string(mustMarshal(map[string]string{"Id": "running", "LogPath": logPath}))}}
+
+	hitsPerPath := map[string]int{}
+	server := testServer(responses, &hitsPerPath)
+	defer server.Close()
+
+	Client = nil
+	StartDockerClient(server.URL)
+
+	breakdown := getDiskBreakdown(Filesystem{}, DiskUsage{})
+	assert.Equal(t, int64(1000), breakdown.ImagesInUse, "only images in use are counted")
+	assert.Equal(t, int64(400), breakdown.ContainerLayers, "writable layers of containers are counted")
+	assert.Equal(t, int64(300), breakdown.Volumes, "files in volumes are counted")
+	assert.Equal(t, int64(200), breakdown.Logs, "container logs are counted")
+	assert.Equal(t, int64(0), breakdown.Other, "other usage is unknown without disk usage in bytes")
+
+	breakdown = getDiskBreakdown(Filesystem{}, DiskUsage{BytesUsed: 10000, BytesTotal: 20000})
+	assert.Equal(t, int64(10000-1900), breakdown.Other, "other usage is what the filesystem uses beyond Docker")
+}
+
+func TestDiskBreakdownOfOtherFilesystem(t *testing.T) {
+	root, err := ioutil.TempDir("", "docker-gc-root")
+	assert.Nil(t, err, "creating temp dir should succeed")
+	defer os.RemoveAll(root)
+	other := "/proc"
+	rootDevice, _ := fileDevice(root)
+	if otherDevice, err := fileDevice(other); err != nil || otherDevice == rootDevice {
+		t.Skip("needs the temp dir and " + other + " on different filesystems")
+	}
+
+	os.MkdirAll(filepath.Join(root, "overlay2"), 0755)
+	os.MkdirAll(filepath.Join(root, "volumes", "data", "_data"), 0755)
+	ioutil.WriteFile(filepath.Join(root, "volumes", "data", "_data", "file"), make([]byte, 300), 0644)
+	logPath := filepath.Join(root, "container-json.log")
+	ioutil.WriteFile(logPath, make([]byte, 200), 0644)
+
+	responses := make(testResponseMap)
+	responses["/_ping"] = []response{{"GET", "default", "OK"}}
+	responses["/info"] = []response{{"GET", "default", string(mustMarshal(map[string]string{"DockerRootDir": root, "Driver": "overlay2"}))}}
+	responses["/images/json"] = []response{{"GET", "all=1", `[{"Id": "used", "Size": 1000}]`}}
+	responses["/images/used/history"] = []response{{"GET", "default", `[{"Id": "used"}]`}}
+	runningFilter := mustMarshal(filters{Status: []string{"running"}})
+	responses["/containers/json"] = []response{
+		{"GET", "default", `[{"Id": "running", "Image": "used", "SizeRw": 400}]`},
+		{"GET", fmt.Sprintf("filters=%s", string(runningFilter)), `[{"Id": "running", "Image": "used"}]`}}
+	responses["/containers/running/json"] = []response{{"GET", "default", string(mustMarshal(map[string]string{"Id": "running", "LogPath": logPath}))}}
+
+	hitsPerPath := map[string]int{}
+	server := testServer(responses, &hitsPerPath)
+	defer server.Close()
+
+	Client = nil
+	StartDockerClient(server.URL)
+
+	breakdown := getDiskBreakdown(Filesystem{Path: other}, DiskUsage{BytesUsed: 10000, BytesTotal: 20000})
+	assert.Equal(t, DiskBreakdown{Other: 10000}, breakdown, "Docker's data on another filesystem isn't counted")
+
+	breakdown = getDiskBreakdown(Filesystem{Path: root}, DiskUsage{BytesUsed: 10000, BytesTotal: 20000})
+	assert.Equal(t, DiskBreakdown{ImagesInUse: 1000, ContainerLayers: 400, Volumes: 300, Logs: 200, Other: 10000 - 1900}, breakdown, "Docker's data on the filesystem is counted")
+}
+
+func TestMonitorDiskSpaceFallback(t *testing.T) {
+	_, hook := logrustest.NewNullLogger()
+	log.AddHook(hook)
+
+	hitsPerPath := map[string]int{}
+	server := testServer(generateTestData(1, 1, t), &hitsPerPath)
+	defer server.Close()
+
+	Client = nil
+	StartDockerClient(server.URL)
+
+	diskSpaceFetcher = &FakeDiskSpaceFetcher{}
+
+	// Regular policy keeps every image, fallback is allowed to delete all of them
+	policy := GCPolicy{
+		HighDiskSpaceThreshold: 99,
+		LowDiskSpaceThreshold:  95,
+		TtlImages:              100 * time.Hour,
+		TtlContainers:          1000 * time.Hour,
+		Fallback:               &GCPolicy{TtlImages: 0, TtlContainers: 1000 * time.Hour},
+	}
+	CleanAllWithDiskSpacePolicy(policy)
+
+	escalated := false
+	for _, entry := range hook.Entries {
+		if entry.Message == "Low disk space threshold not reached, escalating to fallback policy" {
+			escalated = true
+		}
+	}
+	assert.True(t, escalated, "We should escalate to the fallback policy")
+	assert.Equal(t, 1, hitsPerPath["/images/8dfafdbc3a401"], "Fallback policy deletes even the newest image")
+	assert.Equal(t, 0, hitsPerPath["/containers/5c76a2479c921"], "Fallback policy keeps the containers TTL")
+}
@@ -0,0 +1,243 @@
+package gc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"pkg/helpers"
+	"pkg/notify"
+	"pkg/statsd"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Report summarizes a single CleanAll or diskspace run
+type Report struct {
+	Mode       string         `json:"mode"`
+	Start      time.Time      `json:"start"`
+	End        time.Time      `json:"end"`
+	Duration   time.Duration  `json:"duration"`
+	Images     ResourceReport `json:"images"`
+	Containers ResourceReport `json:"containers"`
+	// Deleted counts the stale tags untagged with tag GC
+	Tags ResourceReport `json:"tags"`
+	// Deleted counts the truncated container logs
+	Logs ResourceReport `json:"logs"`
+	// Inventory is not known for build cache, only what the daemon pruned
+	BuildCache ResourceReport `json:"buildCache"`
+	// Estimated from the image sizes, shared layers make this an upper bound.
+	// Includes the truncated logs and the build cache pruned by the daemon.
+	EstimatedBytesReclaimed int64 `json:"estimatedBytesReclaimed"`
+	// Measured from the filesystem usage of the Docker root before and after
+	// the run, only available when the Docker root can be read
+	MeasuredBytesReclaimed int64      `json:"measuredBytesReclaimed"`
+	DiskBefore             *DiskUsage `json:"diskBefore,omitempty"`
+	DiskAfter              *DiskUsage `json:"diskAfter,omitempty"`
+	// Triggers has blocks and/or inodes when their high threshold started
+	// the cleanup in diskspace mode
+	Triggers []string `json:"triggers,omitempty"`
+	// DeletionCapReached when the run stopped deleting at the max deletions
+	// of its policy
+	DeletionCapReached bool   `json:"deletionCapReached,omitempty"`
+	Error              string `json:"error,omitempty"`
+
+	sizes        map[string]int64
+	states       map[string]string
+	repositories map[string]string
+	// Images still having a tag when they're removed
+	tagged map[string]bool
+	// Zero for no cap on deleted images and containers
+	maxDeletions int
+}
+
+// ResourceReport has the counts of a single resource type in a run
+type ResourceReport struct {
+	Inventory  int `json:"inventory"`
+	Candidates int `json:"candidates"`
+	Deleted    int `json:"deleted"`
+	Failed     int `json:"failed"`
+}
+
+// DiskUsage is the block and inode usage of the filesystem Docker stores its
+// data on
+type DiskUsage struct {
+	BytesUsed         uint64  `json:"bytesUsed"`
+	BytesTotal        uint64  `json:"bytesTotal"`
+	BytesUsedPercent  float64 `json:"bytesUsedPercent"`
+	InodesUsed        uint64  `json:"inodesUsed"`
+	InodesTotal       uint64  `json:"inodesTotal"`
+	InodesUsedPercent float64 `json:"inodesUsedPercent"`
+}
+
+// ReportHook receives the report of every finished run
+type ReportHook func(Report)
+
+var (
+	reportHooks     []ReportHook
+	reportHooksLock sync.Mutex
+)
+
+// AddReportHook registers a hook called synchronously after every run
+func AddReportHook(hook ReportHook) {
+	reportHooksLock.Lock()
+	defer reportHooksLock.Unlock()
+	reportHooks = append(reportHooks, hook)
+}
+
+// ReportFile returns a hook writing each report as JSON to path. The file is
+// replaced atomically so readers never see a partial report.
+func ReportFile(path string) ReportHook {
+	return func(report Report) {
+		if err := writeFileAtomic(path, report); err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+				"path":  path,
+			}).Error("Writing run report failed")
+		}
+	}
+}
+
+func newReport(mode string) *Report {
+	return &Report{
+		Mode:         mode,
+		Start:        time.Now(),
+		DiskBefore:   measureDiskUsage(),
+		sizes:        map[string]int64{},
+		states:       map[string]string{},
+		repositories: map[string]string{},
+		tagged:       map[string]bool{},
+	}
+}
+
+func (r *Report) record(id, dataType string, succeeded bool) {
+	resource := &r.Containers
+	switch dataType {
+	case Image, DanglingImage:
+		resource = &r.Images
+	case Tag:
+		resource = &r.Tags
+	}
+
+	resource.Candidates++
+	if !succeeded {
+		resource.Failed++
+		return
+	}
+	resource.Deleted++
+	r.EstimatedBytesReclaimed += r.sizes[id]
+}
+
+func (r *Report) recordLog(reclaimed int64, succeeded bool) {
+	r.Logs.Candidates++
+	if !succeeded {
+		r.Logs.Failed++
+		return
+	}
+	r.Logs.Deleted++
+	r.EstimatedBytesReclaimed += reclaimed
+}
+
+func publishReport(report *Report) {
+	report.End = time.Now()
+	report.Duration = report.End.Sub(report.Start)
+	statsd.Timer("sweep.duration", report.Duration, []string{policyTag(report.Mode)}, StatsdSamplingRate)
+	report.DiskAfter = measureDiskUsage()
+	if report.DiskBefore != nil && report.DiskAfter != nil {
+		report.MeasuredBytesReclaimed = int64(report.DiskBefore.BytesUsed) - int64(report.DiskAfter.BytesUsed)
+	}
+	gaugeReclaimed(report)
+
+	log.WithFields(log.Fields{
+		"mode":                    report.Mode,
+		"duration":                report.Duration,
+		"deletedContainers":       report.Containers.Deleted,
+		"failedContainers":        report.Containers.Failed,
+		"deletedImages":           report.Images.Deleted,
+		"failedImages":            report.Images.Failed,
+		"untaggedTags":            report.Tags.Deleted,
+		"truncatedLogs":           report.Logs.Deleted,
+		"deletedBuildCache":       report.BuildCache.Deleted,
+		"estimatedBytesReclaimed": report.EstimatedBytesReclaimed,
+		"measuredBytesReclaimed":  report.MeasuredBytesReclaimed,
+	}).Info("Run report")
+
+	if report.Error != "" {
+		notify.Notify(notify.RunFailed, "Cleanup run failed", map[string]interface{}{
+			"mode":  report.Mode,
+			"error": report.Error,
+		})
+	}
+
+	reportHooksLock.Lock()
+	hooks := reportHooks
+	reportHooksLock.Unlock()
+	for _, hook := range hooks {
+		hook(*report)
+	}
+}
+
+// Summary is the report on a single line, eg. for the status of the service
+func (r Report) Summary() string {
+	summary := fmt.Sprintf("Last %s policy run at %s deleted %d containers and %d images, reclaimed ~%s",
+		r.Mode, r.End.Format("2006-01-02 15:04:05"), r.Containers.Deleted, r.Images.Deleted,
+		helpers.FormatBytes(r.EstimatedBytesReclaimed))
+	if failed := r.Containers.Failed + r.Images.Failed; failed > 0 {
+		summary += fmt.Sprintf(", %d deletions failed", failed)
+	}
+	if r.Error != "" {
+		summary += ", failed: " + r.Error
+	}
+	return summary
+}
+
+// measureDiskUsage returns the usage of the filesystem of the Docker root
+// whatever the mode, nil when it can't tell the usage in bytes
+func measureDiskUsage() *DiskUsage {
+	usage, err := newDiskSpaceFetcher("").GetDiskUsage()
+	if err != nil {
+		log.WithField("error", err).Debug("Measuring disk usage for the report failed")
+		return nil
+	}
+	if usage.BytesTotal == 0 {
+		return nil
+	}
+	return &usage
+}
+
+func (r *Report) recordTriggers(triggers []string) {
+	for _, trigger := range triggers {
+		if !helpers.StringInSlice(trigger, r.Triggers) {
+			r.Triggers = append(r.Triggers, trigger)
+		}
+	}
+}
+
+func writeFileAtomic(path string, data interface{}) error {
+	out, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(out); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,160 @@
+package gc
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	logrustest "github.com/Sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+// FakeDiskUsageFetcher frees a GiB on every read
+type FakeDiskUsageFetcher struct {
+	FakeDiskSpaceFetcher
+	usage DiskUsage
+}
+
+func (d *FakeDiskUsageFetcher) GetDiskUsage() (DiskUsage, error) {
+	usage := d.usage
+	d.usage.BytesUsed -= 1 << 30
+	return usage, nil
+}
+
+func TestReportHook(t *testing.T) {
+	_, hook := logrustest.NewNullLogger()
+	log.AddHook(hook)
+
+	hitsPerPath := map[string]int{}
+	server := testServer(generateTestData(1, 1, t), &hitsPerPath)
+	defer server.Close()
+
+	Client = nil
+	StartDockerClient(server.URL)
+
+	var reports []Report
+	reportHooks = nil
+	AddReportHook(func(report Report) { reports = append(reports, report) })
+	defer func() { reportHooks = nil }()
+
+	CleanAll(DatePolicy, GCPolicy{TtlImages: 10 * time.Hour, TtlContainers: 1 * time.Minute})
+
+	assert.Equal(t, 1, len(reports), "one report per run")
+	report := reports[0]
+	assert.Equal(t, DatePolicy, report.Mode, "report has the mode of the run")
+	assert.Equal(t, ResourceReport{Inventory: 5, Candidates: 2, Deleted: 2}, report.Images, "image counts are reported")
+	assert.Equal(t, ResourceReport{Inventory: 5, Candidates: 3, Deleted: 3}, report.Containers, "container counts are reported")
+	assert.True(t, !report.End.Before(report.Start), "run ends after it starts")
+	assert.Nil(t, report.DiskBefore, "disk usage is not measured when the Docker root can't be read")
+	assert.Equal(t, "Run report", hook.LastEntry().Message, "report is logged")
+}
+
+func TestReportWithoutDockerInfo(t *testing.T) {
+	_, hook := logrustest.NewNullLogger()
+	log.AddHook(hook)
+
+	responses := generateTestData(1, 1, t)
+	delete(responses, "/info")
+	hitsPerPath := map[string]int{}
+	server := testServer(responses, &hitsPerPath)
+	defer server.Close()
+
+	Client = nil
+	StartDockerClient(server.URL)
+
+	CleanImages(10 * time.Hour)
+
+	for _, entry := range hook.Entries {
+		assert.NotEqual(t, log.ErrorLevel, entry.Level, "not measuring disk usage isn't an error: "+entry.Message)
+	}
+}
+
+func TestReportMeasuresDiskUsage(t *testing.T) {
+	hitsPerPath := map[string]int{}
+	server := testServer(generateTestData(1, 1, t), &hitsPerPath)
+	defer server.Close()
+
+	Client = nil
+	StartDockerClient(server.URL)
+
+	fetcher := &FakeDiskUsageFetcher{usage: DiskUsage{BytesUsed: 10 << 30, BytesTotal: 20 << 30}}
+	diskSpaceFetcher = fetcher
+	defer func() { diskSpaceFetcher = nil }()
+	defer func(fetcher func(string) DiskSpace) { newDiskSpaceFetcher = fetcher }(newDiskSpaceFetcher)
+	newDiskSpaceFetcher = func(string) DiskSpace { return fetcher }
+
+	dir, err := ioutil.TempDir("", "docker-gc-report")
+	assert.Nil(t, err, "creating temp dir should succeed")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "report.json")
+
+	reportHooks = nil
+	AddReportHook(ReportFile(path))
+	defer func() { reportHooks = nil }()
+
+	CleanAllWithDiskSpacePolicy(GCPolicy{HighDiskSpaceThreshold: 99, LowDiskSpaceThreshold: 95})
+
+	data, err := ioutil.ReadFile(path)
+	assert.Nil(t, err, "report file should be written")
+	var report Report
+	assert.Nil(t, json.Unmarshal(data, &report), "report file should be valid JSON")
+	assert.Equal(t, DiskPolicy, report.Mode, "report has the mode of the run")
+	assert.Equal(t, uint64(10<<30), report.DiskBefore.BytesUsed, "usage before the run is reported")
+	assert.True(t, report.DiskAfter.BytesUsed < report.DiskBefore.BytesUsed, "usage after the run is reported")
+	assert.Equal(t, int64(report.DiskBefore.BytesUsed-report.DiskAfter.BytesUsed), report.MeasuredBytesReclaimed, "reclaimed bytes are measured")
+
+	files, _ := ioutil.ReadDir(dir)
+	assert.Equal(t, 1, len(files), "no temporary files are left behind")
+}
+
+func TestReportMeasuresDiskUsageInEveryMode(t *testing.T) {
+	hitsPerPath := map[string]int{}
+	server := testServer(generateTestData(1, 1, t), &hitsPerPath)
+	defer server.Close()
+
+	Client = nil
+	StartDockerClient(server.URL)
+
+	defer func(fetcher func(string) DiskSpace) { newDiskSpaceFetcher = fetcher }(newDiskSpaceFetcher)
+	fetcher := &FakeDiskUsageFetcher{usage: DiskUsage{BytesUsed: 10 << 30, BytesTotal: 20 << 30}}
+	newDiskSpaceFetcher = func(path string) DiskSpace {
+		assert.Equal(t, "", path, "the filesystem of the Docker root is measured")
+		return fetcher
+	}
+
+	var reports []Report
+	reportHooks = nil
+	AddReportHook(func(report Report) { reports = append(reports, report) })
+	defer func() { reportHooks = nil }()
+
+	CleanAll(DatePolicy, GCPolicy{TtlImages: 10 * time.Hour, TtlContainers: 1 * time.Minute})
+	CleanImages(10 * time.Hour)
+	CleanDanglingImages(10 * time.Hour)
+	CleanContainers(1 * time.Minute)
+
+	assert.Equal(t, 4, len(reports), "every run is reported")
+	for _, report := range reports {
+		if assert.NotNil(t, report.DiskBefore, "usage before the run is reported") {
+			assert.NotNil(t, report.DiskAfter, "usage after the run is reported")
+			assert.Equal(t, int64(report.DiskBefore.BytesUsed-report.DiskAfter.BytesUsed), report.MeasuredBytesReclaimed, "reclaimed bytes are measured")
+		}
+	}
+}
+
+func TestReportSummary(t *testing.T) {
+	report := Report{
+		Mode:                    DiskPolicy,
+		End:                     time.Date(2016, 3, 25, 12, 0, 0, 0, time.UTC),
+		Images:                  ResourceReport{Deleted: 2, Failed: 1},
+		Containers:              ResourceReport{Deleted: 3},
+		EstimatedBytesReclaimed: 3 << 29,
+	}
+	assert.Equal(t, "Last disk policy run at 2016-03-25 12:00:00 deleted 3 containers and 2 images, reclaimed ~1.5GiB, 1 deletions failed", report.Summary(), "report is summarized")
+
+	report.Error = "Docker daemon not reachable"
+	assert.Contains(t, report.Summary(), "failed: Docker daemon not reachable", "summary has the error")
+}
@@ -0,0 +1,272 @@
+package gc
+
+import (
+	"fmt"
+	"pkg/helpers"
+	"pkg/statsd"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Resources cleaned in TTL mode, containers first so their images are freed
+var ttlResources = []string{ResourceContainers, ResourceImages, ResourceBuildCache}
+
+// Clock tells the time to schedules and maintenance windows
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// clock is replaced in tests to run schedules without sleeping
+var clock Clock = realClock{}
+
+// Schedule runs the TTL cleanup of its resources when the cron expression
+// matches
+type Schedule struct {
+	Resources []string
+	Cron      *CronSchedule
+}
+
+// MaintenanceWindow allows or forbids deleting its resources on the days of
+// week between the start and end time of day. A window ending before it
+// starts continues to the next day.
+type MaintenanceWindow struct {
+	Allow      bool
+	Resources  []string
+	days       uint64
+	start, end int
+	location   *time.Location
+	definition string
+}
+
+// ParseSchedules parses semicolon separated resources=cron definitions where
+// resources are joined with +, eg. images=0 2 * * *;containers+buildcache=@hourly
+func ParseSchedules(value string, location *time.Location) ([]Schedule, error) {
+	var schedules []Schedule
+	scheduled := map[string]bool{}
+	for _, definition := range strings.Split(value, ";") {
+		definition = strings.TrimSpace(definition)
+		if definition == "" {
+			continue
+		}
+
+		fields := strings.SplitN(definition, "=", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s is not valid schedule, use resources=cron expression", definition)
+		}
+		resources, err := parseTtlResources(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		for _, resource := range resources {
+			if scheduled[resource] {
+				return nil, fmt.Errorf("%s has more than one schedule", resource)
+			}
+			scheduled[resource] = true
+		}
+		cron, err := ParseCron(fields[1], location)
+		if err != nil {
+			return nil, err
+		}
+		schedules = append(schedules, Schedule{Resources: resources, Cron: cron})
+	}
+	return schedules, nil
+}
+
+// ParseMaintenanceWindows parses semicolon separated allow|deny resources days
+// start-end definitions where days are like the cron day of week, eg. deny
+// images mon-fri 09:00-18:00;allow buildcache * 22:00-06:00
+func ParseMaintenanceWindows(value string, location *time.Location) ([]MaintenanceWindow, error) {
+	var windows []MaintenanceWindow
+	for _, definition := range strings.Split(value, ";") {
+		definition = strings.TrimSpace(definition)
+		if definition == "" {
+			continue
+		}
+
+		fields := strings.Fields(definition)
+		if len(fields) != 4 || fields[0] != "allow" && fields[0] != "deny" {
+			return nil, fmt.Errorf("%s is not valid maintenance window, use allow|deny resources days start-end", definition)
+		}
+		window := MaintenanceWindow{Allow: fields[0] == "allow", location: location, definition: definition}
+		var err error
+		if window.Resources, err = parseTtlResources(fields[1]); err != nil {
+			return nil, err
+		}
+		if window.days, err = dayOfWeekField.parse(fields[2]); err != nil {
+			return nil, err
+		}
+		if window.days&(1<<7) != 0 {
+			window.days |= 1
+		}
+		times := strings.Split(fields[3], "-")
+		if len(times) != 2 {
+			return nil, fmt.Errorf("%s is not valid time range, use eg. 09:00-18:00", fields[3])
+		}
+		if window.start, err = parseTimeOfDay(times[0]); err != nil {
+			return nil, err
+		}
+		if window.end, err = parseTimeOfDay(times[1]); err != nil {
+			return nil, err
+		}
+		if window.start == window.end {
+			return nil, fmt.Errorf("%s is empty time range", fields[3])
+		}
+		windows = append(windows, window)
+	}
+	return windows, nil
+}
+
+func parseTtlResources(value string) ([]string, error) {
+	var resources []string
+	for _, resource := range strings.Split(strings.TrimSpace(value), "+") {
+		if !helpers.StringInSlice(resource, ttlResources) {
+			return nil, fmt.Errorf("%s is not valid resource, use one of %s", resource, strings.Join(ttlResources, ", "))
+		}
+		resources = append(resources, resource)
+	}
+	return resources, nil
+}
+
+// parseTimeOfDay returns the minutes from midnight of HH:MM, 24:00 included
+func parseTimeOfDay(value string) (int, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) == 2 {
+		hour, hourErr := strconv.Atoi(parts[0])
+		minute, minuteErr := strconv.Atoi(parts[1])
+		if hourErr == nil && minuteErr == nil && hour >= 0 && minute >= 0 && minute < 60 &&
+			(hour < 24 || hour == 24 && minute == 0) {
+			return hour*60 + minute, nil
+		}
+	}
+	return 0, fmt.Errorf("%s is not valid time of day, use HH:MM", value)
+}
+
+func (w MaintenanceWindow) contains(t time.Time) bool {
+	t = t.In(w.location)
+	minute := t.Hour()*60 + t.Minute()
+	today := w.days&(1<<uint(t.Weekday())) != 0
+	if w.start < w.end {
+		return today && minute >= w.start && minute < w.end
+	}
+	yesterday := w.days&(1<<uint((t.Weekday()+6)%7)) != 0
+	return today && minute >= w.start || yesterday && minute < w.end
+}
+
+func (w MaintenanceWindow) String() string {
+	return w.definition
+}
+
+// deletionAllowed tells if the maintenance windows allow deleting the resource
+// now. Deny windows forbid it while they're open and allow windows of the
+// resource forbid it while none of them is open.
+func (p GCPolicy) deletionAllowed(resource string) bool {
+	now := clock.Now()
+	restricted, allowed := false, false
+	for _, window := range p.MaintenanceWindows {
+		if !helpers.StringInSlice(resource, window.Resources) {
+			continue
+		}
+		open := window.contains(now)
+		if !window.Allow {
+			if open {
+				return false
+			}
+			continue
+		}
+		restricted = true
+		allowed = allowed || open
+	}
+	return allowed || !restricted
+}
+
+// cleanResourcesBasedOnAge removes the resources past their TTL the
+// maintenance windows allow deleting now
+func cleanResourcesBasedOnAge(resources []string, policy GCPolicy, report *Report) (int, int) {
+	var removedContainers int
+	var removedImages int
+	for _, resource := range ttlResources {
+		if sweepPreempted() {
+			break
+		}
+		if !helpers.StringInSlice(resource, resources) {
+			continue
+		}
+		if !policy.deletionAllowed(resource) {
+			log.WithField("resource", resource).Info("Maintenance windows don't allow deleting " + resource + " now, skipping")
+			continue
+		}
+		switch resource {
+		case ResourceContainers:
+			removedContainers = removeContainersBasedOnAge(policy, report)
+		case ResourceImages:
+			removedImages = removeImagesBasedOnAge(policy, report)
+		case ResourceBuildCache:
+			if policy.PruneBuildCache {
+				pruneBuildCache(policy, report)
+			}
+		}
+	}
+	return removedContainers, removedImages
+}
+
+// ScheduledTtlGC runs the TTL cleanup of each schedule when its cron
+// expression matches and of the resources without a schedule every interval
+func ScheduledTtlGC(scheduler *Scheduler, intervalInSeconds uint64, schedules []Schedule, policy GCPolicy) {
+	unscheduled := ttlResources
+	for _, schedule := range schedules {
+		var remaining []string
+		for _, resource := range unscheduled {
+			if !helpers.StringInSlice(resource, schedule.Resources) {
+				remaining = append(remaining, resource)
+			}
+		}
+		unscheduled = remaining
+
+		resources := schedule.Resources
+		scheduler.Schedule(strings.Join(resources, ","), scheduleNext(schedule), func() { cleanScheduled(resources, policy) })
+	}
+	if len(unscheduled) > 0 {
+		scheduler.Every(time.Duration(intervalInSeconds)*time.Second, strings.Join(unscheduled, ","), func() { cleanScheduled(unscheduled, policy) })
+	}
+	log.WithFields(log.Fields{
+		"schedules":   len(schedules),
+		"unscheduled": strings.Join(unscheduled, ","),
+		"interval":    intervalInSeconds,
+	}).Info("Continous run started in timebased mode with schedules")
+}
+
+// scheduleNext returns the next run of the schedule and logs it
+func scheduleNext(schedule Schedule) func(time.Time) time.Time {
+	return func(now time.Time) time.Time {
+		next := schedule.Cron.Next(now)
+		if next.IsZero() {
+			log.WithField("schedule", schedule.Cron.String()).Error("Schedule never matches, not running it")
+			return next
+		}
+		log.WithFields(log.Fields{
+			"resources": strings.Join(schedule.Resources, ","),
+			"schedule":  schedule.Cron.String(),
+			"nextRun":   next.Format(time.RFC3339),
+		}).Info("Next scheduled run")
+		return next
+	}
+}
+
+func cleanScheduled(resources []string, policy GCPolicy) {
+	report := newReport(DatePolicy)
+	report.maxDeletions = policy.MaxDeletions
+	defer publishReport(report)
+
+	log.WithField("resources", strings.Join(resources, ",")).Info("Cleaning scheduled resources")
+	statsd.Count("clean.start", 1, []string{policyTag(report.Mode)}, StatsdSamplingRate)
+	cleanResourcesBasedOnAge(resources, policy, report)
+}
@@ -0,0 +1,141 @@
+package gc
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeClock fires the channels of After when the test advances it past them
+type fakeClock struct {
+	now     time.Time
+	waiters map[chan time.Time]time.Time
+	lock    sync.Mutex
+}
+
+func withFakeScheduleClock(start time.Time) (*fakeClock, func()) {
+	fake := &fakeClock{now: start, waiters: map[chan time.Time]time.Time{}}
+	previous := clock
+	clock = fake
+	return fake, func() { clock = previous }
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	waiter := make(chan time.Time, 1)
+	c.waiters[waiter] = c.now.Add(d)
+	return waiter
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(d)
+	for waiter, at := range c.waiters {
+		if !at.After(c.now) {
+			waiter <- c.now
+			delete(c.waiters, waiter)
+		}
+	}
+}
+
+// waitForWaiters waits until the given amount of goroutines are waiting on
+// the clock
+func (c *fakeClock) waitForWaiters(t *testing.T, count int) {
+	for i := 0; i < 1000; i++ {
+		c.lock.Lock()
+		waiting := len(c.waiters)
+		c.lock.Unlock()
+		if waiting >= count {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("clock was not waited on")
+}
+
+func TestParseSchedules(t *testing.T) {
+	schedules, err := ParseSchedules("images=0 2 * * *; containers+buildcache=@hourly", time.UTC)
+	assert.Nil(t, err, "parsing schedules should succeed")
+	assert.Equal(t, 2, len(schedules), "schedules are separated with semicolon")
+	assert.Equal(t, []string{ResourceImages}, schedules[0].Resources, "schedule has its resources")
+	assert.Equal(t, "0 2 * * *", schedules[0].Cron.String(), "schedule has its cron expression")
+	assert.Equal(t, []string{ResourceContainers, ResourceBuildCache}, schedules[1].Resources, "resources are joined with +")
+
+	for _, value := range []string{"images", "logs=@daily", "images=@daily;images+containers=@hourly", "images=* *"} {
+		_, err := ParseSchedules(value, time.UTC)
+		assert.NotNil(t, err, value+" should not parse")
+	}
+}
+
+func TestMaintenanceWindows(t *testing.T) {
+	windows, err := ParseMaintenanceWindows("deny images mon-fri 09:00-18:00; allow buildcache * 22:00-06:00", time.UTC)
+	assert.Nil(t, err, "parsing maintenance windows should succeed")
+	policy := GCPolicy{MaintenanceWindows: windows}
+
+	fake, restore := withFakeScheduleClock(time.Date(2016, 3, 25, 10, 0, 0, 0, time.UTC)) // Friday
+	defer restore()
+	assert.False(t, policy.deletionAllowed(ResourceImages), "images are not deleted during business hours")
+	assert.True(t, policy.deletionAllowed(ResourceContainers), "containers have no windows")
+	assert.False(t, policy.deletionAllowed(ResourceBuildCache), "build cache is deleted only in its allow window")
+
+	fake.Advance(15 * time.Hour) // Saturday 01:00
+	assert.True(t, policy.deletionAllowed(ResourceImages), "images are deleted on weekends")
+	assert.True(t, policy.deletionAllowed(ResourceBuildCache), "allow window continues past midnight")
+
+	helsinki, err := time.LoadLocation("Europe/Helsinki")
+	if err == nil {
+		windows, _ = ParseMaintenanceWindows("deny images * 09:00-18:00", helsinki)
+		policy = GCPolicy{MaintenanceWindows: windows}
+		fake.Advance(7 * time.Hour) // Saturday 08:00 UTC is 10:00 in Helsinki
+		assert.False(t, policy.deletionAllowed(ResourceImages), "windows are in their time zone")
+	}
+
+	for _, value := range []string{"deny images", "maybe images * 09:00-18:00", "deny logs * 09:00-18:00", "deny images * 09:00-25:00", "deny images * 09:00-09:00"} {
+		_, err := ParseMaintenanceWindows(value, time.UTC)
+		assert.NotNil(t, err, value+" should not parse")
+	}
+}
+
+func TestScheduledTtlGC(t *testing.T) {
+	hitsPerPath := map[string]int{}
+	server := testServer(generateTestData(1, 1, t), &hitsPerPath)
+	defer server.Close()
+
+	Client = nil
+	StartDockerClient(server.URL)
+
+	fake, restore := withFakeScheduleClock(time.Date(2016, 3, 25, 1, 59, 0, 0, time.UTC))
+	defer restore()
+	scheduler, _ := NewScheduler(QueueMissedRuns, 0)
+	defer scheduler.Stop()
+
+	schedules, _ := ParseSchedules("images=0 2 * * *", time.UTC)
+	ScheduledTtlGC(scheduler, 60, schedules, GCPolicy{TtlContainers: time.Second, TtlImages: time.Second})
+	fake.waitForWaiters(t, 2)
+
+	fake.Advance(30 * time.Second)
+	fake.waitForWaiters(t, 2)
+	assert.Equal(t, 0, hitsPerPath["/containers/3176a2479c921"], "nothing is cleaned before the first run")
+
+	fake.Advance(30 * time.Second)
+	fake.waitForWaiters(t, 2)
+	scheduler.waitIdle()
+	assert.Equal(t, 1, hitsPerPath["/containers/3176a2479c921"], "unscheduled containers are cleaned every interval")
+	assert.Equal(t, 1, hitsPerPath["/images/3176a2479c921"], "images are cleaned on their schedule")
+
+	fake.Advance(time.Minute)
+	fake.waitForWaiters(t, 2)
+	scheduler.waitIdle()
+	assert.Equal(t, 2, hitsPerPath["/containers/3176a2479c921"], "containers are cleaned again after interval")
+	assert.Equal(t, 1, hitsPerPath["/images/3176a2479c921"], "images wait for the next day")
+}
@@ -0,0 +1,297 @@
+package gc
+
+import (
+	"fmt"
+	"pkg/statsd"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// What to do with a run that is due while another sweep is still running
+const (
+	SkipMissedRuns  = "skip"
+	QueueMissedRuns = "queue"
+)
+
+// Scheduler runs the sweeps of the continuous modes, at most one at a time and
+// holding the sweep lock when it is configured. Sweeps due while the Docker
+// daemon is down are skipped.
+type Scheduler struct {
+	missedRuns string
+	// A sweep running longer is reported as timed out, the following runs
+	// still wait for it to finish, zero never reports
+	timeout time.Duration
+	clock   Clock
+	runs    chan scheduledRun
+	idle    chan chan struct{}
+	// Asks for the start time of the running sweep, zero when idle
+	probes chan chan time.Time
+	stop   chan struct{}
+	// Closed once stopped and the running sweep has finished
+	stopped chan struct{}
+	once    sync.Once
+	paused  int32
+}
+
+type scheduledRun struct {
+	name string
+	job  func()
+	// Triggered runs are queued rather than skipped or paused. When set, done
+	// gets whether the run ran and is closed once it has finished or was
+	// dropped.
+	triggered bool
+	done      chan bool
+}
+
+// NewScheduler returns a running scheduler without any runs scheduled
+func NewScheduler(missedRuns string, timeout time.Duration) (*Scheduler, error) {
+	if missedRuns != SkipMissedRuns && missedRuns != QueueMissedRuns {
+		return nil, fmt.Errorf("%s is not valid for missed runs, use %s or %s", missedRuns, SkipMissedRuns, QueueMissedRuns)
+	}
+	s := &Scheduler{
+		missedRuns: missedRuns,
+		timeout:    timeout,
+		clock:      clock,
+		runs:       make(chan scheduledRun),
+		idle:       make(chan chan struct{}),
+		probes:     make(chan chan time.Time),
+		stop:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+	}
+	go s.dispatch()
+	return s, nil
+}
+
+// Every runs the job every interval, the first time after one interval
+func (s *Scheduler) Every(interval time.Duration, name string, job func()) {
+	s.Schedule(name, func(now time.Time) time.Time { return now.Add(interval) }, job)
+}
+
+// Schedule runs the job at the times next returns for the time of the
+// previous run, until next returns zero time
+func (s *Scheduler) Schedule(name string, next func(now time.Time) time.Time, job func()) {
+	s.schedule(name, next, job, false)
+}
+
+// ScheduleAfterRun is Schedule calling next only once the previous run has
+// finished or was skipped, so the next time can depend on what it did
+func (s *Scheduler) ScheduleAfterRun(name string, next func(now time.Time) time.Time, job func()) {
+	s.schedule(name, next, job, true)
+}
+
+func (s *Scheduler) schedule(name string, next func(now time.Time) time.Time, job func(), afterRun bool) {
+	go func() {
+		for {
+			now := s.clock.Now()
+			at := next(now)
+			if at.IsZero() {
+				return
+			}
+			select {
+			case <-s.stop:
+				return
+			case <-s.clock.After(at.Sub(now)):
+			}
+			var done chan bool
+			if afterRun {
+				done = make(chan bool, 1)
+			}
+			select {
+			case <-s.stop:
+				return
+			case s.runs <- scheduledRun{name: name, job: job, done: done}:
+			}
+			if done != nil {
+				select {
+				case <-s.stop:
+					return
+				case <-done:
+				}
+			}
+		}
+	}()
+}
+
+// Trigger runs the job now, or after the running sweep when there is one. The
+// returned channel receives true when the job has finished, it's closed
+// without it when the job didn't run because the Docker daemon is down or the
+// scheduler was stopped.
+func (s *Scheduler) Trigger(name string, job func()) <-chan bool {
+	done := make(chan bool, 1)
+	select {
+	case <-s.stop:
+		close(done)
+	case s.runs <- scheduledRun{name: name, job: job, triggered: true, done: done}:
+	}
+	return done
+}
+
+// Pause skips the scheduled runs until Resume, triggered runs still run
+func (s *Scheduler) Pause() {
+	atomic.StoreInt32(&s.paused, 1)
+}
+
+func (s *Scheduler) Resume() {
+	atomic.StoreInt32(&s.paused, 0)
+}
+
+func (s *Scheduler) Paused() bool {
+	return atomic.LoadInt32(&s.paused) == 1
+}
+
+// Watchdog calls ping every half timeout while the sweeps are healthy, that
+// is the scheduler is responsive and no sweep has been running for longer
+// than timeout
+func (s *Scheduler) Watchdog(timeout time.Duration, ping func()) {
+	go func() {
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-s.clock.After(timeout / 2):
+			}
+			reply := make(chan time.Time, 1)
+			select {
+			case <-s.stop:
+				return
+			case s.probes <- reply:
+			}
+			started := <-reply
+			if running := s.clock.Now().Sub(started); started.IsZero() || running < timeout {
+				ping()
+			} else {
+				log.WithField("running", running).Warn("Sweep running longer than watchdog timeout, not pinging watchdog")
+			}
+		}
+	}()
+}
+
+// waitIdle waits until the runs already due have finished or the scheduler
+// is stopped
+func (s *Scheduler) waitIdle() {
+	idle := make(chan struct{})
+	select {
+	case s.idle <- idle:
+		<-idle
+	case <-s.stop:
+	}
+}
+
+// Stop stops running the scheduled jobs and waits for a sweep already running
+// to finish
+func (s *Scheduler) Stop() {
+	s.once.Do(func() { close(s.stop) })
+	<-s.stopped
+}
+
+// dispatch starts the runs as they're due unless a sweep is running, then
+// they're skipped or queued once per name
+func (s *Scheduler) dispatch() {
+	defer close(s.stopped)
+	var queue []scheduledRun
+	var running *scheduledRun
+	var started time.Time
+	var done chan struct{}
+	var timeout <-chan time.Time
+	var idle []chan struct{}
+
+	start := func(run scheduledRun) {
+		running, started = &run, s.clock.Now()
+		done = make(chan struct{})
+		timeout = nil
+		if s.timeout > 0 {
+			timeout = s.clock.After(s.timeout)
+		}
+		go func(done chan struct{}) {
+			defer close(done)
+			if run.done != nil {
+				defer close(run.done)
+			}
+			if !dockerAvailable() {
+				statsd.Count("scheduler.unavailable", 1, []string{runTag(run.name)}, StatsdSamplingRate)
+				return
+			}
+			unlock := lockSweep(run.name, false)
+			defer unlock()
+			run.job()
+			if run.done != nil {
+				run.done <- true
+			}
+		}(done)
+	}
+	next := func() {
+		running, started, done, timeout = nil, time.Time{}, nil, nil
+		if len(queue) > 0 {
+			start(queue[0])
+			queue = queue[1:]
+			return
+		}
+		for _, waiter := range idle {
+			close(waiter)
+		}
+		idle = nil
+	}
+
+	for {
+		select {
+		case <-s.stop:
+			for _, run := range queue {
+				dropRun(run)
+			}
+			if done != nil {
+				<-done
+			}
+			return
+		case run := <-s.runs:
+			if !run.triggered && s.Paused() {
+				log.WithField("run", run.name).Debug("Scheduled runs paused, skipping run")
+				dropRun(run)
+			} else if running == nil {
+				start(run)
+			} else if run.triggered || s.missedRuns == QueueMissedRuns && !isQueued(queue, run.name) {
+				log.WithFields(log.Fields{"run": run.name, "running": running.name}).Warn("Previous sweep still running, queueing run")
+				statsd.Count("scheduler.queued", 1, []string{runTag(run.name)}, StatsdSamplingRate)
+				queue = append(queue, run)
+			} else {
+				log.WithFields(log.Fields{"run": run.name, "running": running.name}).Warn("Previous sweep still running, skipping run")
+				statsd.Count("scheduler.skipped", 1, []string{runTag(run.name)}, StatsdSamplingRate)
+				dropRun(run)
+			}
+		case waiter := <-s.idle:
+			if running == nil {
+				close(waiter)
+			} else {
+				idle = append(idle, waiter)
+			}
+		case reply := <-s.probes:
+			reply <- started
+		case <-done:
+			next()
+		case <-timeout:
+			// Starting another sweep would delete alongside the wedged one, so
+			// the following runs keep being skipped or queued until it finishes
+			log.WithFields(log.Fields{"run": running.name, "timeout": s.timeout}).Error("Sweep timed out, still waiting for it to finish")
+			statsd.Count("scheduler.timeout", 1, []string{runTag(running.name)}, StatsdSamplingRate)
+			timeout = nil
+		}
+	}
+}
+
+// dropRun tells whoever waits for the run that it didn't run
+func dropRun(run scheduledRun) {
+	if run.done != nil {
+		close(run.done)
+	}
+}
+
+func isQueued(queue []scheduledRun, name string) bool {
+	for _, run := range queue {
+		if run.name == name {
+			return true
+		}
+	}
+	return false
+}
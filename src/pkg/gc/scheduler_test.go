@@ -0,0 +1,219 @@
+package gc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// blockingJob counts its runs and blocks each one until released
+type blockingJob struct {
+	runs    chan int
+	release chan struct{}
+	count   int
+}
+
+func newBlockingJob() *blockingJob {
+	return &blockingJob{runs: make(chan int, 10), release: make(chan struct{})}
+}
+
+func (j *blockingJob) run() {
+	j.count++
+	j.runs <- j.count
+	<-j.release
+}
+
+func TestNewScheduler(t *testing.T) {
+	_, err := NewScheduler("sometimes", 0)
+	assert.NotNil(t, err, "missed runs must be skip or queue")
+}
+
+func TestSchedulerSkipsMissedRuns(t *testing.T) {
+	fake, restore := withFakeScheduleClock(time.Date(2016, 3, 25, 0, 0, 0, 0, time.UTC))
+	defer restore()
+	scheduler, _ := NewScheduler(SkipMissedRuns, 0)
+	defer scheduler.Stop()
+
+	slow, other := newBlockingJob(), newBlockingJob()
+	scheduler.Every(time.Minute, "slow", slow.run)
+	scheduler.Every(time.Minute, "other", other.run)
+	fake.waitForWaiters(t, 2)
+
+	fake.Advance(time.Minute)
+	fake.waitForWaiters(t, 2)
+	fake.Advance(time.Minute)
+	fake.waitForWaiters(t, 2)
+	close(slow.release)
+	close(other.release)
+	scheduler.waitIdle()
+
+	assert.Equal(t, 1, slow.count+other.count, "only one sweep runs, the runs due meanwhile are skipped")
+}
+
+func TestSchedulerQueuesMissedRuns(t *testing.T) {
+	fake, restore := withFakeScheduleClock(time.Date(2016, 3, 25, 0, 0, 0, 0, time.UTC))
+	defer restore()
+	scheduler, _ := NewScheduler(QueueMissedRuns, 0)
+	defer scheduler.Stop()
+
+	slow, other := newBlockingJob(), newBlockingJob()
+	scheduler.Every(time.Minute, "slow", slow.run)
+	scheduler.Every(time.Minute, "other", other.run)
+	fake.waitForWaiters(t, 2)
+
+	fake.Advance(time.Minute)
+	fake.waitForWaiters(t, 2)
+	fake.Advance(time.Minute)
+	fake.waitForWaiters(t, 2)
+	close(slow.release)
+	close(other.release)
+	scheduler.waitIdle()
+
+	assert.Equal(t, 3, slow.count+other.count, "missed runs are queued once per job")
+	assert.True(t, slow.count > 0 && other.count > 0, "both jobs run")
+}
+
+func TestSchedulerWaitsForTimedOutRun(t *testing.T) {
+	fake, restore := withFakeScheduleClock(time.Date(2016, 3, 25, 0, 0, 0, 0, time.UTC))
+	defer restore()
+	scheduler, _ := NewScheduler(SkipMissedRuns, 90*time.Second)
+
+	wedged := newBlockingJob()
+	scheduler.Every(time.Minute, "wedged", wedged.run)
+	fake.waitForWaiters(t, 1)
+
+	fake.Advance(time.Minute)
+	<-wedged.runs
+	// The loop and the timeout of the run
+	fake.waitForWaiters(t, 2)
+	fake.Advance(time.Minute)
+	fake.waitForWaiters(t, 2)
+	fake.Advance(time.Minute)
+	fake.waitForWaiters(t, 1)
+	select {
+	case <-wedged.runs:
+		t.Fatal("run due after the timeout must wait for the timed out run")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		scheduler.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		t.Fatal("Stop must wait for the running sweep")
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(wedged.release)
+	<-stopped
+	fake.Advance(time.Hour)
+	assert.Equal(t, 1, wedged.count, "stopped scheduler doesn't run jobs")
+}
+
+func TestSchedulerSchedulesAfterRun(t *testing.T) {
+	start := time.Date(2016, 3, 25, 0, 0, 0, 0, time.UTC)
+	fake, restore := withFakeScheduleClock(start)
+	defer restore()
+	scheduler, _ := NewScheduler(SkipMissedRuns, 0)
+	defer scheduler.Stop()
+
+	job := newBlockingJob()
+	nexts := make(chan time.Time, 10)
+	scheduler.ScheduleAfterRun("after", func(now time.Time) time.Time {
+		nexts <- now
+		return now.Add(time.Minute)
+	}, job.run)
+	<-nexts
+	fake.waitForWaiters(t, 1)
+
+	fake.Advance(time.Minute)
+	<-job.runs
+	fake.Advance(30 * time.Second)
+	select {
+	case <-nexts:
+		t.Fatal("next run is scheduled before the run finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(job.release)
+	assert.Equal(t, start.Add(90*time.Second), <-nexts, "next run is scheduled from when the run finished")
+
+	scheduler.Pause()
+	fake.waitForWaiters(t, 1)
+	fake.Advance(time.Minute)
+	assert.Equal(t, start.Add(150*time.Second), <-nexts, "next run is scheduled when the run is skipped")
+	assert.Equal(t, 1, job.count, "paused run is skipped")
+}
+
+func TestSchedulerTriggersAndPauses(t *testing.T) {
+	fake, restore := withFakeScheduleClock(time.Date(2016, 3, 25, 0, 0, 0, 0, time.UTC))
+	defer restore()
+	scheduler, _ := NewScheduler(SkipMissedRuns, 0)
+	defer scheduler.Stop()
+
+	scheduled, triggered := newBlockingJob(), newBlockingJob()
+	close(triggered.release)
+	scheduler.Every(time.Minute, "scheduled", scheduled.run)
+	fake.waitForWaiters(t, 1)
+
+	fake.Advance(time.Minute)
+	<-scheduled.runs
+	done := scheduler.Trigger("api", triggered.run)
+	close(scheduled.release)
+	assert.True(t, <-done, "triggered run tells it ran")
+	assert.Equal(t, 1, triggered.count, "triggered run is queued after the running sweep")
+
+	scheduler.Pause()
+	assert.True(t, scheduler.Paused(), "scheduler is paused")
+	fake.waitForWaiters(t, 1)
+	fake.Advance(time.Minute)
+	fake.waitForWaiters(t, 1)
+	<-scheduler.Trigger("api", triggered.run)
+	scheduler.waitIdle()
+	assert.Equal(t, 1, scheduled.count, "scheduled runs are skipped while paused")
+	assert.Equal(t, 2, triggered.count, "triggered runs run while paused")
+
+	scheduler.Resume()
+	fake.Advance(time.Minute)
+	fake.waitForWaiters(t, 1)
+	scheduler.waitIdle()
+	assert.Equal(t, 2, scheduled.count, "scheduled runs run after resume")
+}
+
+func TestSchedulerWatchdog(t *testing.T) {
+	fake, restore := withFakeScheduleClock(time.Date(2016, 3, 25, 0, 0, 0, 0, time.UTC))
+	defer restore()
+	scheduler, _ := NewScheduler(SkipMissedRuns, 0)
+	defer scheduler.Stop()
+
+	pings := make(chan struct{}, 10)
+	pinged := func() bool {
+		fake.waitForWaiters(t, 1)
+		select {
+		case <-pings:
+			return true
+		default:
+			return false
+		}
+	}
+	scheduler.Watchdog(time.Minute, func() { pings <- struct{}{} })
+	fake.waitForWaiters(t, 1)
+
+	fake.Advance(30 * time.Second)
+	assert.True(t, pinged(), "idle scheduler pings watchdog")
+
+	slow := newBlockingJob()
+	scheduler.Trigger("slow", slow.run)
+	<-slow.runs
+	fake.Advance(30 * time.Second)
+	assert.True(t, pinged(), "sweep running shorter than timeout pings watchdog")
+	fake.Advance(30 * time.Second)
+	assert.False(t, pinged(), "sweep running longer than timeout doesn't ping watchdog")
+
+	close(slow.release)
+	scheduler.waitIdle()
+	fake.Advance(30 * time.Second)
+	assert.True(t, pinged(), "finished sweep pings watchdog again")
+}
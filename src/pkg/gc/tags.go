@@ -0,0 +1,221 @@
+package gc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"pkg/helpers"
+	"pkg/statsd"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/fsouza/go-dockerclient"
+)
+
+const (
+	TagsRule = "tags"
+	Tag      = "tag"
+
+	untaggedTag = "<none>:<none>"
+)
+
+// TagState remembers when each tag was first seen on an image since the daemon
+// doesn't keep track of when an image was tagged
+type TagState struct {
+	// First seen time by tag@imageID, a tag moved to another image is new
+	FirstSeen map[string]time.Time `json:"firstSeen"`
+
+	path string
+	lock sync.Mutex
+}
+
+// tagState is in memory until LoadTagState gives it a file
+var tagState = &TagState{FirstSeen: map[string]time.Time{}}
+
+// LoadTagState reads the tag first seen times from path and keeps them there
+// after each cleanup. A missing file is an empty state.
+func LoadTagState(path string) error {
+	state := &TagState{FirstSeen: map[string]time.Time{}, path: path}
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, state); err != nil {
+			return fmt.Errorf("%s is not valid tag state: %s", path, err)
+		}
+	}
+	tagState = state
+	return nil
+}
+
+// firstSeen returns when the tag was first seen on the image, now if it hasn't
+// been recorded yet
+func (s *TagState) firstSeen(tag, id string) time.Time {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	seen, ok := s.FirstSeen[tag+"@"+id]
+	if !ok {
+		return time.Now()
+	}
+	return seen
+}
+
+// record remembers now as the first seen time of the tags of the images seen
+// for the first time. Only a sweep records them so listing or explaining the
+// images doesn't start the tag TTLs.
+func (s *TagState) record(images []ImageInfo) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	for _, image := range images {
+		for _, tag := range image.RepoTags {
+			if tag == untaggedTag {
+				continue
+			}
+			key := tag + "@" + image.ID
+			if _, ok := s.FirstSeen[key]; !ok {
+				s.FirstSeen[key] = now
+			}
+		}
+	}
+}
+
+// save forgets the tags not on any of the images and writes the state to its
+// file
+func (s *TagState) save(images []ImageInfo) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	present := map[string]bool{}
+	for _, image := range images {
+		for _, tag := range image.RepoTags {
+			present[tag+"@"+image.ID] = true
+		}
+	}
+	for key := range s.FirstSeen {
+		if !present[key] {
+			delete(s.FirstSeen, key)
+		}
+	}
+
+	if s.path == "" {
+		return nil
+	}
+	return writeFileAtomic(s.path, s)
+}
+
+// evaluateTags splits the tags of the image to the ones kept, because they are
+// protected or younger than the images TTL, and the stale ones
+func evaluateTags(image ImageInfo, policy GCPolicy) ([]string, []string, []string) {
+	var protected, kept, stale []string
+	for _, tag := range image.RepoTags {
+		if tag == untaggedTag {
+			continue
+		}
+		if isProtectedTag(tag, policy.ProtectedTags) {
+			protected = append(protected, tag)
+		} else if time.Since(tagState.firstSeen(tag, image.ID)) > policy.TtlImages {
+			stale = append(stale, tag)
+		} else {
+			kept = append(kept, tag)
+		}
+	}
+	return protected, kept, stale
+}
+
+// tagsVerdict keeps the image while any of its tags is kept and returns the
+// stale tags untagged from it then
+func tagsVerdict(image ImageInfo, policy GCPolicy) (Verdict, []string) {
+	protected, kept, stale := evaluateTags(image, policy)
+	var reasons []string
+	if len(protected) > 0 {
+		reasons = append(reasons, "protected tags "+strings.Join(protected, ", "))
+	}
+	if len(kept) > 0 {
+		reasons = append(reasons, fmt.Sprintf("tags %s first seen within ttl %v", strings.Join(kept, ", "), policy.TtlImages))
+	}
+	if len(reasons) > 0 {
+		if len(stale) > 0 {
+			reasons = append(reasons, "stale tags "+strings.Join(stale, ", ")+" are untagged")
+		}
+		return Verdict{Rule: TagsRule, Keep: true, Reason: strings.Join(reasons, ", ")}, stale
+	}
+	if len(stale) > 0 {
+		return Verdict{Rule: TagsRule, Reason: "all tags " + strings.Join(stale, ", ") + " are stale"}, nil
+	}
+	return Verdict{Rule: TagsRule, Reason: "image has no tags"}, nil
+}
+
+// untagStaleTags removes the stale tags of the images that have other tags
+// keeping them. Images with only stale tags are left for the image cleanup.
+// Returns the images with their remaining tags.
+func untagStaleTags(images []ImageInfo, policy GCPolicy, report *Report) []ImageInfo {
+	defer timePhase(phaseDeletion)()
+	tagState.record(images)
+	for i, image := range images {
+		if sweepPreempted() {
+			break
+		}
+		stale := evaluateImage(image, policy, report.Mode).untag
+		if len(stale) == 0 {
+			continue
+		}
+
+		var remaining []string
+		for _, tag := range image.RepoTags {
+			if tag != untaggedTag && !helpers.StringInSlice(tag, stale) {
+				remaining = append(remaining, tag)
+			}
+		}
+		for _, tag := range stale {
+			log.WithFields(log.Fields{
+				"type":      Tag,
+				"id":        image.ID,
+				"remaining": remaining,
+			}).Info("Trying to untag image: ", tag)
+			succeeded := removeTag(tag, report.Mode)
+			report.record(tag, Tag, succeeded)
+			if !succeeded {
+				remaining = append(remaining, tag)
+			}
+		}
+		images[i].RepoTags = remaining
+	}
+
+	if err := tagState.save(images); err != nil {
+		log.WithField("error", err).Error("Saving tag state failed")
+	}
+	return images
+}
+
+func removeTag(tag, mode string) bool {
+	// Removing a tag of an image with other tags only untags it
+	finished := timeDockerCall("images.remove", Tag)
+	err := Client.RemoveImageExtended(tag, docker.RemoveImageOptions{NoPrune: true})
+	finished(err)
+	countDeletion(Tag, mode, repositoryOf(tag), err)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+			"tag":   tag,
+		}).Error("Image untag error")
+		return false
+	}
+	statsd.Count("image.untagged", 1, []string{resourceTag(Tag), policyTag(mode), repositoryTag(repositoryOf(tag))}, StatsdSamplingRate)
+	return true
+}
+
+// isProtectedTag matches the tag against patterns where * matches any
+// characters, eg. *:production
+func isProtectedTag(tag string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if helpers.MatchGlob(pattern, tag) {
+			return true
+		}
+	}
+	return false
+}
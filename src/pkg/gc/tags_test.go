@@ -0,0 +1,93 @@
+package gc
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTagGC(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-gc-tags")
+	assert.Nil(t, err, "creating temp dir should succeed")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tags.json")
+
+	old := time.Now().Add(-48 * time.Hour)
+	ioutil.WriteFile(path, mustMarshal(TagState{FirstSeen: map[string]time.Time{
+		"app:sha@multi":        old,
+		"app:production@multi": old,
+		"old:1@stale":          old,
+		"gone:1@removed":       old,
+	}}), 0644)
+	assert.Nil(t, LoadTagState(path), "loading tag state should succeed")
+	defer func() { tagState = &TagState{FirstSeen: map[string]time.Time{}} }()
+
+	images := []map[string]interface{}{
+		{"Id": "multi", "RepoTags": []string{"app:sha", "app:production"}, "Created": old.Unix()},
+		{"Id": "stale", "RepoTags": []string{"old:1"}, "Created": old.Unix()},
+		{"Id": "fresh", "RepoTags": []string{"new:1"}, "Created": old.Unix()},
+	}
+	responses := make(testResponseMap)
+	responses["/_ping"] = []response{{"GET", "default", "OK"}}
+	responses["/images/json"] = []response{{"GET", "all=1", string(mustMarshal(images))}}
+	responses["/containers/json"] = []response{{"GET", "default", "[]"}}
+	responses["/images/app:sha"] = []response{{"DELETE", "force=", "OK"}}
+	responses["/images/stale"] = []response{{"DELETE", "default", "OK"}}
+
+	hitsPerPath := map[string]int{}
+	server := testServer(responses, &hitsPerPath)
+	defer server.Close()
+
+	Client = nil
+	StartDockerClient(server.URL)
+
+	var reports []Report
+	reportHooks = nil
+	AddReportHook(func(report Report) { reports = append(reports, report) })
+	defer func() { reportHooks = nil }()
+
+	policy := GCPolicy{TtlImages: 1 * time.Hour, TagGC: true, ProtectedTags: []string{"*:production"}}
+	_, cleanedImages := CleanAll(DatePolicy, policy)
+
+	assert.Equal(t, 1, hitsPerPath["/images/app:sha"], "stale tag is untagged")
+	assert.Equal(t, 0, hitsPerPath["/images/multi"], "image with protected tag is kept")
+	assert.Equal(t, 1, hitsPerPath["/images/stale"], "image with only stale tags is removed")
+	assert.Equal(t, 0, hitsPerPath["/images/fresh"], "image with tag first seen now is kept")
+	assert.Equal(t, 1, cleanedImages, "one image is removed")
+	assert.Equal(t, ResourceReport{Candidates: 1, Deleted: 1}, reports[0].Tags, "untagged tags are reported")
+
+	var saved TagState
+	data, _ := ioutil.ReadFile(path)
+	assert.Nil(t, json.Unmarshal(data, &saved), "tag state should be saved")
+	assert.Equal(t, 3, len(saved.FirstSeen), "tags no longer present are forgotten")
+	assert.Equal(t, old.Unix(), saved.FirstSeen["app:production@multi"].Unix(), "first seen time is kept")
+}
+
+func TestTagsVerdict(t *testing.T) {
+	defer func() { tagState = &TagState{FirstSeen: map[string]time.Time{}} }()
+	tagState = &TagState{FirstSeen: map[string]time.Time{"app:sha@id": time.Now().Add(-2 * time.Hour)}}
+
+	policy := GCPolicy{TtlImages: 1 * time.Hour, TagGC: true, ProtectedTags: []string{"registry/*:production"}}
+	verdict, untag := tagsVerdict(ImageInfo{ID: "id", RepoTags: []string{"app:sha"}}, policy)
+	assert.Equal(t, Verdict{Rule: TagsRule, Reason: "all tags app:sha are stale"}, verdict, "stale tag doesn't keep image")
+	assert.Nil(t, untag, "image with only stale tags isn't untagged")
+
+	verdict, untag = tagsVerdict(ImageInfo{ID: "id", RepoTags: []string{"app:sha", "registry/app:production"}}, policy)
+	assert.True(t, verdict.Keep, "protected tag keeps image")
+	assert.Equal(t, "protected tags registry/app:production, stale tags app:sha are untagged", verdict.Reason, "reason lists the tags")
+	assert.Equal(t, []string{"app:sha"}, untag, "stale tag of kept image is untagged")
+
+	verdict, _ = tagsVerdict(ImageInfo{ID: "id", RepoTags: []string{untaggedTag}}, policy)
+	assert.Equal(t, Verdict{Rule: TagsRule, Reason: "image has no tags"}, verdict, "untagged image has no tags")
+}
+
+func TestLoadTagStateMissingFile(t *testing.T) {
+	defer func() { tagState = &TagState{FirstSeen: map[string]time.Time{}} }()
+	assert.Nil(t, LoadTagState("/nonexistent/tags.json"), "missing tag state is empty")
+	assert.Equal(t, 0, len(tagState.FirstSeen), "missing tag state is empty")
+}
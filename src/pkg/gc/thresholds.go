@@ -0,0 +1,159 @@
+package gc
+
+import (
+	"fmt"
+	"math"
+	"pkg/helpers"
+	"strconv"
+	"strings"
+)
+
+// Usage that can trigger the cleanup in diskspace mode
+const (
+	TriggerBlocks = "blocks"
+	TriggerInodes = "inodes"
+)
+
+// freeSuffix marks a threshold of free space in bytes, eg. 20GiB free
+const freeSuffix = " free"
+
+// ParseThreshold parses a used disk space percentage with optional decimals
+// and % sign, eg. 85.5%, or free space in bytes, eg. 20GiB free. Returns the
+// percentage or the free bytes, the other one is zero.
+func ParseThreshold(value string) (float64, int64, error) {
+	value = strings.TrimSpace(value)
+	if strings.HasSuffix(value, freeSuffix) {
+		free, err := helpers.ParseBytes(strings.TrimSpace(strings.TrimSuffix(value, freeSuffix)))
+		if err != nil {
+			return 0, 0, err
+		}
+		if free <= 0 {
+			return 0, 0, fmt.Errorf("%s is not valid threshold, free space must be positive", value)
+		}
+		return 0, free, nil
+	}
+
+	percent, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+	if err != nil || percent < 0 || percent > 100 {
+		return 0, 0, fmt.Errorf("%s is not valid threshold, use a percentage between 0-100 or free space like 20GiB free", value)
+	}
+	return percent, 0, nil
+}
+
+// ValidateThresholds checks that high and low threshold are in the same unit
+// and cleanup stops before it would start again
+func ValidateThresholds(highPercent float64, highFree int64, lowPercent float64, lowFree int64) error {
+	if (highFree > 0) != (lowFree > 0) {
+		return fmt.Errorf("high threshold %s and low threshold %s must both be percentages or free space",
+			FormatThreshold(highPercent, highFree), FormatThreshold(lowPercent, lowFree))
+	}
+	if highFree > lowFree || lowPercent > highPercent {
+		return fmt.Errorf("low threshold %s must leave more free space than high threshold %s",
+			FormatThreshold(lowPercent, lowFree), FormatThreshold(highPercent, highFree))
+	}
+	return nil
+}
+
+// ValidateInodeThresholds checks that the inode thresholds are percentages set
+// together, cleanup stopping before it would start again. Unset they are the
+// disk space thresholds.
+func ValidateInodeThresholds(highPercent, lowPercent float64) error {
+	if highPercent < 0 || highPercent > 100 || lowPercent < 0 || lowPercent > 100 {
+		return fmt.Errorf("inode thresholds %v%% and %v%% must be percentages between 0 and 100", highPercent, lowPercent)
+	}
+	if (highPercent > 0) != (lowPercent > 0) {
+		return fmt.Errorf("high inode threshold %v%% and low inode threshold %v%% must be set together", highPercent, lowPercent)
+	}
+	if lowPercent > highPercent {
+		return fmt.Errorf("low inode threshold %v%% must be below high inode threshold %v%%", lowPercent, highPercent)
+	}
+	return nil
+}
+
+// FormatThreshold formats a threshold the way ParseThreshold parses it
+func FormatThreshold(percent float64, free int64) string {
+	if free > 0 {
+		return helpers.FormatBytes(free) + freeSuffix
+	}
+	return strconv.FormatFloat(percent, 'f', -1, 64) + "%"
+}
+
+func (p GCPolicy) highThreshold() string {
+	return FormatThreshold(p.HighDiskSpaceThreshold, p.HighDiskSpaceFree)
+}
+
+func (p GCPolicy) lowThreshold() string {
+	return FormatThreshold(p.LowDiskSpaceThreshold, p.LowDiskSpaceFree)
+}
+
+func (p GCPolicy) inodeThresholds() (float64, float64) {
+	if p.HighInodeThreshold == 0 && p.HighDiskSpaceFree == 0 {
+		return p.HighDiskSpaceThreshold, p.LowDiskSpaceThreshold
+	}
+	if p.HighInodeThreshold == 0 {
+		// Free space has no inode equivalent, only a full inode table
+		// triggers cleanup
+		return 100, 100
+	}
+	return p.HighInodeThreshold, p.LowInodeThreshold
+}
+
+// triggers returns the usages that have reached their high threshold
+func (p GCPolicy) triggers(usage DiskUsage) []string {
+	var triggers []string
+	if p.HighDiskSpaceFree > 0 && usage.bytesFree() <= p.HighDiskSpaceFree ||
+		p.HighDiskSpaceFree == 0 && usage.BytesUsedPercent >= p.HighDiskSpaceThreshold {
+		triggers = append(triggers, TriggerBlocks)
+	}
+	if high, _ := p.inodeThresholds(); usage.InodesUsedPercent >= high {
+		triggers = append(triggers, TriggerInodes)
+	}
+	return triggers
+}
+
+// lowReached tells if both usages are at most their low threshold
+func (p GCPolicy) lowReached(usage DiskUsage) bool {
+	_, low := p.inodeThresholds()
+	if usage.InodesUsedPercent > low {
+		return false
+	}
+	if p.LowDiskSpaceFree > 0 {
+		return usage.bytesFree() >= p.LowDiskSpaceFree
+	}
+	return usage.BytesUsedPercent <= p.LowDiskSpaceThreshold
+}
+
+// pressure tells how close the usage is to the high threshold from the low
+// threshold, 0 at or below low and 1 at or above high
+func (p GCPolicy) pressure(usage DiskUsage) float64 {
+	blocks := between(usage.BytesUsedPercent, p.LowDiskSpaceThreshold, p.HighDiskSpaceThreshold)
+	if p.HighDiskSpaceFree > 0 {
+		// Less free space is more pressure
+		blocks = between(-float64(usage.bytesFree()), -float64(p.LowDiskSpaceFree), -float64(p.HighDiskSpaceFree))
+	}
+	high, low := p.inodeThresholds()
+	return math.Max(blocks, between(usage.InodesUsedPercent, low, high))
+}
+
+// between returns where value is from low to high between 0 and 1
+func between(value, low, high float64) float64 {
+	if value >= high {
+		return 1
+	}
+	if value <= low {
+		return 0
+	}
+	return (value - low) / (high - low)
+}
+
+func (u DiskUsage) bytesFree() int64 {
+	return int64(u.BytesTotal) - int64(u.BytesUsed)
+}
+
+// usedPercent is the higher of block and inode usage
+func (u DiskUsage) usedPercent() float64 {
+	if u.InodesUsedPercent > u.BytesUsedPercent {
+		return u.InodesUsedPercent
+	}
+	return u.BytesUsedPercent
+}
@@ -0,0 +1,69 @@
+package gc
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseThreshold(t *testing.T) {
+	expectations := []struct {
+		value   string
+		percent float64
+		free    int64
+	}{
+		{"85", 85, 0},
+		{"85.5%", 85.5, 0},
+		{"0", 0, 0},
+		{"20GiB free", 0, 20 << 30},
+		{" 512MiB free", 0, 512 << 20},
+	}
+	for _, e := range expectations {
+		percent, free, err := ParseThreshold(e.value)
+		assert.Nil(t, err, e.value+" should parse")
+		assert.Equal(t, e.percent, percent, e.value+" percentage")
+		assert.Equal(t, e.free, free, e.value+" free space")
+	}
+	assert.Equal(t, "85.5%", FormatThreshold(85.5, 0), "percentage formats with decimals")
+	assert.Equal(t, "20.0GiB free", FormatThreshold(0, 20<<30), "free space formats with unit")
+
+	for _, value := range []string{"101", "-1", "half", "20GiB", "0B free", "lots free"} {
+		_, _, err := ParseThreshold(value)
+		assert.NotNil(t, err, value+" should not parse")
+	}
+}
+
+func TestValidateThresholds(t *testing.T) {
+	assert.Nil(t, ValidateThresholds(85.5, 0, 85.25, 0), "low percentage below high is valid")
+	assert.Nil(t, ValidateThresholds(0, 10<<30, 0, 20<<30), "low free space above high is valid")
+	assert.NotNil(t, ValidateThresholds(50, 0, 60, 0), "low percentage above high is not valid")
+	assert.NotNil(t, ValidateThresholds(0, 20<<30, 0, 10<<30), "low free space below high is not valid")
+	assert.NotNil(t, ValidateThresholds(85, 0, 0, 10<<30), "mixed units are not valid")
+}
+
+func TestValidateInodeThresholds(t *testing.T) {
+	assert.Nil(t, ValidateInodeThresholds(0, 0), "unset inode thresholds are valid")
+	assert.Nil(t, ValidateInodeThresholds(90, 80), "low inode threshold below high is valid")
+	assert.NotNil(t, ValidateInodeThresholds(90, 0), "high inode threshold without low is not valid")
+	assert.NotNil(t, ValidateInodeThresholds(0, 80), "low inode threshold without high is not valid")
+	assert.NotNil(t, ValidateInodeThresholds(80, 90), "low inode threshold above high is not valid")
+	assert.NotNil(t, ValidateInodeThresholds(101, 90), "inode thresholds above 100% are not valid")
+	assert.NotNil(t, ValidateInodeThresholds(90, -1), "negative inode thresholds are not valid")
+}
+
+func TestFreeSpaceThresholds(t *testing.T) {
+	policy := GCPolicy{HighDiskSpaceFree: 20 << 30, LowDiskSpaceFree: 40 << 30}
+	usage := DiskUsage{BytesUsed: 3990 << 30, BytesTotal: 4000 << 30, BytesUsedPercent: 99.75, InodesUsedPercent: 99}
+	assert.Equal(t, []string{TriggerBlocks}, policy.triggers(usage), "free space below high threshold triggers cleanup")
+
+	usage.BytesUsed = 3970 << 30
+	assert.Equal(t, 0, len(policy.triggers(usage)), "free space above high threshold doesn't trigger cleanup")
+	assert.False(t, policy.lowReached(usage), "free space below low threshold keeps cleaning")
+
+	usage.BytesUsed = 3960 << 30
+	assert.True(t, policy.lowReached(usage), "free space at low threshold stops cleaning")
+
+	policy = GCPolicy{HighDiskSpaceThreshold: 85.5, LowDiskSpaceThreshold: 85.25}
+	assert.Equal(t, 0, len(policy.triggers(DiskUsage{BytesUsedPercent: 85.4})), "sub-percent usage below threshold doesn't trigger")
+	assert.Equal(t, []string{TriggerBlocks}, policy.triggers(DiskUsage{BytesUsedPercent: 85.5}), "sub-percent usage at threshold triggers")
+}
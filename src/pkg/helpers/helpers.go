@@ -1,8 +1,12 @@
 package helpers
 
 import (
+	"fmt"
 	"math"
+	"regexp"
 	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/cznic/sortutil"
 )
@@ -30,8 +34,76 @@ func SortDataMapReverse(dataMap map[int64][]string) []int64 {
 	return keys
 }
 
+// PercentUsed returns the used percentage with sub-percent precision
 func PercentUsed(free, total uint64) (percent float64) {
-	return math.Floor(100 * (1 - float64(free)/float64(total)))
+	// Some filesystems, eg. btrfs, report no inodes at all
+	if total == 0 || free > total {
+		return 0
+	}
+	return 100 * float64(total-free) / float64(total)
+}
+
+// FormatBytes formats a byte count with binary units, eg. 1.5GiB
+func FormatBytes(bytes int64) string {
+	const unit = 1024
+	if bytes < unit && bytes > -unit {
+		return fmt.Sprintf("%dB", bytes)
+	}
+	value := float64(bytes)
+	suffixes := []string{"KiB", "MiB", "GiB", "TiB", "PiB"}
+	i := -1
+	for math.Abs(value) >= unit && i < len(suffixes)-1 {
+		value /= unit
+		i++
+	}
+	return fmt.Sprintf("%.1f%s", value, suffixes[i])
+}
+
+var byteUnits = map[string]float64{
+	"":    1,
+	"b":   1,
+	"k":   1 << 10,
+	"kb":  1e3,
+	"kib": 1 << 10,
+	"m":   1 << 20,
+	"mb":  1e6,
+	"mib": 1 << 20,
+	"g":   1 << 30,
+	"gb":  1e9,
+	"gib": 1 << 30,
+	"t":   1 << 40,
+	"tb":  1e12,
+	"tib": 1 << 40,
+}
+
+// ParseBytes parses a byte count with an optional decimal (KB, MB, ..) or
+// binary (KiB, MiB, ..) unit, eg. 1.5GiB
+func ParseBytes(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	i := strings.IndexFunc(value, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i == -1 {
+		i = len(value)
+	}
+
+	number, err := strconv.ParseFloat(value[:i], 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s is not valid byte count", value)
+	}
+	unit, ok := byteUnits[strings.ToLower(strings.TrimSpace(value[i:]))]
+	if !ok {
+		return 0, fmt.Errorf("%s has unknown unit", value)
+	}
+	return int64(number * unit), nil
+}
+
+// MatchGlob matches value against pattern where * matches any characters,
+// including slashes unlike path.Match
+func MatchGlob(pattern, value string) bool {
+	expression := "^" + strings.Replace(regexp.QuoteMeta(pattern), `\*`, ".*", -1) + "$"
+	matched, _ := regexp.MatchString(expression, value)
+	return matched
 }
 
 func getKeysFromMap(dataMap map[int64][]string) []int64 {
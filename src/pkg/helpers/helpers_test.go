@@ -10,6 +10,8 @@ func TestPercentUsed(t *testing.T) {
 		{20, 100, 80},
 		{0, 99, 100},
 		{11, 11, 0},
+		{1, 8, 87.5},
+		{1, 1000, 99.9},
 	}
 
 	for _, e := range expectations {
@@ -19,3 +21,68 @@ func TestPercentUsed(t *testing.T) {
 		}
 	}
 }
+
+func TestFormatBytes(t *testing.T) {
+	expectations := []struct {
+		bytes     int64
+		formatted string
+	}{
+		{0, "0B"},
+		{1023, "1023B"},
+		{1024, "1.0KiB"},
+		{1536 * 1024 * 1024, "1.5GiB"},
+	}
+
+	for _, e := range expectations {
+		formatted := FormatBytes(e.bytes)
+		if formatted != e.formatted {
+			t.Errorf("Expected %s, got: %s", e.formatted, formatted)
+		}
+	}
+}
+
+func TestParseBytes(t *testing.T) {
+	expectations := []struct {
+		value string
+		bytes int64
+	}{
+		{"100", 100},
+		{"10KiB", 10 * 1024},
+		{"1.5GiB", 1536 * 1024 * 1024},
+		{"20 GB", 20 * 1000 * 1000 * 1000},
+		{"1m", 1024 * 1024},
+	}
+
+	for _, e := range expectations {
+		bytes, err := ParseBytes(e.value)
+		if err != nil || bytes != e.bytes {
+			t.Errorf("Expected %d, got: %d (%v)", e.bytes, bytes, err)
+		}
+	}
+
+	for _, value := range []string{"", "GiB", "10 parsecs"} {
+		if _, err := ParseBytes(value); err == nil {
+			t.Errorf("Expected %s to fail parsing", value)
+		}
+	}
+}
+
+func TestMatchGlob(t *testing.T) {
+	expectations := []struct {
+		pattern string
+		value   string
+		match   bool
+	}{
+		{"*:production", "registry/app:production", true},
+		{"ci-*", "ci-build-1", true},
+		{"ci-*", "app-ci-1", false},
+		{"app.1", "app21", false},
+		{"app", "app", true},
+	}
+
+	for _, e := range expectations {
+		if MatchGlob(e.pattern, e.value) != e.match {
+			t.Errorf("Expected %s matching %s to be %v", e.pattern, e.value, e.match)
+		}
+	}
+}
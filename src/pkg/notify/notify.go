@@ -0,0 +1,226 @@
+// Package notify contains a singleton webhook notifier for use in all other
+// packages. It can be configured once at application startup, and imported by
+// any package that wishes to send notifications. Notifications are delivered
+// in the background so sending never blocks the caller.
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+type Event string
+
+const (
+	HighThresholdReached   Event = "high_threshold_reached"
+	LowThresholdNotReached Event = "low_threshold_not_reached"
+	RunFailed              Event = "run_failed"
+	DeletionCapReached     Event = "deletion_cap_reached"
+
+	// DefaultTemplate posts the whole notification as JSON
+	DefaultTemplate = "{{json .}}"
+	queueSize       = 100
+)
+
+// AllEvents are the events sent when no events are explicitly configured
+var AllEvents = []Event{HighThresholdReached, LowThresholdNotReached, RunFailed, DeletionCapReached}
+
+// Notification is the data the body template is executed with
+type Notification struct {
+	Event   Event                  `json:"event"`
+	Message string                 `json:"message"`
+	Host    string                 `json:"host"`
+	Time    time.Time              `json:"time"`
+	Fields  map[string]interface{} `json:"fields,omitempty"`
+}
+
+// Webhook configures where and how notifications are sent
+type Webhook struct {
+	URL      string
+	Headers  map[string]string
+	Template string
+	Timeout  time.Duration
+	Retries  int
+	// Delay before the first retry, doubled for each following one
+	RetryBackoff time.Duration
+	Events       []Event
+}
+
+type sender struct {
+	webhook  Webhook
+	template *template.Template
+	client   *http.Client
+	queue    chan Notification
+	events   map[Event]bool
+	host     string
+	wg       sync.WaitGroup
+}
+
+var (
+	current     *sender
+	currentLock sync.Mutex
+)
+
+// Configure should be called once, before any notifications are sent, with
+// the webhook to deliver them to
+func Configure(webhook Webhook) error {
+	if webhook.Template == "" {
+		webhook.Template = DefaultTemplate
+	}
+	if len(webhook.Events) == 0 {
+		webhook.Events = AllEvents
+	}
+
+	tmpl, err := template.New("body").Funcs(template.FuncMap{"json": toJSON}).Parse(webhook.Template)
+	if err != nil {
+		return err
+	}
+
+	host, _ := os.Hostname()
+	s := &sender{
+		webhook:  webhook,
+		template: tmpl,
+		client:   &http.Client{Timeout: webhook.Timeout},
+		queue:    make(chan Notification, queueSize),
+		events:   map[Event]bool{},
+		host:     host,
+	}
+	for _, event := range webhook.Events {
+		s.events[event] = true
+	}
+
+	s.wg.Add(1)
+	go s.run()
+
+	currentLock.Lock()
+	previous := current
+	current = s
+	currentLock.Unlock()
+	if previous != nil {
+		previous.close()
+	}
+	return nil
+}
+
+// Notify queues a notification for delivery if notifications are configured
+// and the event is enabled. When the queue is full the notification is
+// dropped.
+func Notify(event Event, message string, fields map[string]interface{}) {
+	currentLock.Lock()
+	defer currentLock.Unlock()
+	if current == nil || !current.events[event] {
+		return
+	}
+
+	notification := Notification{Event: event, Message: message, Host: current.host, Time: time.Now(), Fields: fields}
+	select {
+	case current.queue <- notification:
+	default:
+		logrus.WithField("event", event).Warn("Notification queue full, dropping notification")
+	}
+}
+
+// Close stops the notifier after delivering the queued notifications
+func Close() {
+	currentLock.Lock()
+	s := current
+	current = nil
+	currentLock.Unlock()
+	if s != nil {
+		s.close()
+	}
+}
+
+// ParseEvents parses a comma separated list of event names
+func ParseEvents(value string) ([]Event, error) {
+	var events []Event
+	for _, name := range strings.Split(value, ",") {
+		if name == "" {
+			continue
+		}
+		event := Event(name)
+		valid := false
+		for _, known := range AllEvents {
+			if event == known {
+				valid = true
+			}
+		}
+		if !valid {
+			return nil, fmt.Errorf("%s is not valid event", name)
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+func (s *sender) close() {
+	close(s.queue)
+	s.wg.Wait()
+}
+
+func (s *sender) run() {
+	defer s.wg.Done()
+	for notification := range s.queue {
+		if err := s.deliver(notification); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err,
+				"event": notification.Event,
+			}).Error("Sending notification failed")
+		}
+	}
+}
+
+func (s *sender) deliver(notification Notification) error {
+	var body bytes.Buffer
+	if err := s.template.Execute(&body, notification); err != nil {
+		return err
+	}
+
+	backoff := s.webhook.RetryBackoff
+	var err error
+	for attempt := 0; attempt <= s.webhook.Retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		if err = s.post(body.Bytes()); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (s *sender) post(body []byte) error {
+	req, err := http.NewRequest("POST", s.webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range s.webhook.Headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+	return nil
+}
+
+func toJSON(data interface{}) (string, error) {
+	out, err := json.Marshal(data)
+	return string(out), err
+}
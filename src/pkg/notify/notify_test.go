@@ -0,0 +1,105 @@
+package notify
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNotifyPostsJSON(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- r
+		bodies <- body
+	}))
+	defer server.Close()
+
+	err := Configure(Webhook{URL: server.URL, Headers: map[string]string{"X-Token": "secret"}, Timeout: time.Second})
+	assert.Nil(t, err, "configuring webhook should succeed")
+	defer Close()
+
+	Notify(HighThresholdReached, "disk is full", map[string]interface{}{"usedDiskSpace": 90})
+
+	select {
+	case r := <-received:
+		assert.Equal(t, "secret", r.Header.Get("X-Token"), "configured headers are sent")
+		var notification Notification
+		assert.Nil(t, json.Unmarshal(<-bodies, &notification), "default body is JSON")
+		assert.Equal(t, HighThresholdReached, notification.Event, "event is sent")
+		assert.Equal(t, "disk is full", notification.Message, "message is sent")
+		assert.Equal(t, float64(90), notification.Fields["usedDiskSpace"], "fields are sent")
+	case <-time.After(time.Second):
+		t.Fatal("notification was not delivered")
+	}
+}
+
+func TestNotifyTemplateAndEvents(t *testing.T) {
+	bodies := make(chan string, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies <- string(body)
+	}))
+	defer server.Close()
+
+	err := Configure(Webhook{URL: server.URL, Template: `{"text": {{json .Message}}}`, Events: []Event{RunFailed}})
+	assert.Nil(t, err, "configuring webhook should succeed")
+
+	Notify(HighThresholdReached, "not enabled", nil)
+	Notify(RunFailed, `listing "images" failed`, nil)
+	Close()
+
+	assert.Equal(t, 1, len(bodies), "only enabled events are sent")
+	assert.Equal(t, `{"text": "listing \"images\" failed"}`, <-bodies, "body is rendered from the template")
+}
+
+func TestNotifyRetries(t *testing.T) {
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&hits, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	Configure(Webhook{URL: server.URL, Retries: 2, RetryBackoff: time.Millisecond})
+	Notify(RunFailed, "failed", nil)
+	Close()
+
+	assert.Equal(t, int32(3), atomic.LoadInt32(&hits), "failed deliveries are retried")
+}
+
+func TestNotifyNeverBlocks(t *testing.T) {
+	unblock := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+	}))
+	defer server.Close()
+
+	Configure(Webhook{URL: server.URL})
+
+	start := time.Now()
+	for i := 0; i < 2*queueSize; i++ {
+		Notify(RunFailed, "failed", nil)
+	}
+	assert.True(t, time.Since(start) < time.Second, "notifying should not wait for delivery")
+
+	close(unblock)
+	Close()
+}
+
+func TestParseEvents(t *testing.T) {
+	events, err := ParseEvents("high_threshold_reached,run_failed")
+	assert.Nil(t, err, "parsing valid events should succeed")
+	assert.Equal(t, []Event{HighThresholdReached, RunFailed}, events, "events are parsed in order")
+
+	_, err = ParseEvents("disk_on_fire")
+	assert.NotNil(t, err, "unknown events are rejected")
+}
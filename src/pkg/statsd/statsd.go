@@ -20,10 +20,11 @@ var (
 var errNotConfigured = errors.New("statsd is not configured")
 
 // Configure should be called once, before any metrics are submitted, with the
-// statsd endpoint to submit to
-func Configure(endpoint, namespace string) (err error) {
+// statsd endpoint to submit to and the tags added to every metric
+func Configure(endpoint, namespace string, tags ...string) (err error) {
 	Statsd, err = dogstatsd.New(endpoint, &dogstatsd.Context{
 		Namespace: namespace,
+		Tags:      tags,
 	})
 
 	if err != nil {
@@ -76,11 +77,17 @@ func Timer(m string, n time.Duration, ts []string, r float64) {
 
 // Gauge submits a Gauge metric to the global Statsd instance, if configured.
 func Gauge(metric string, n int) {
+	TaggedGauge(metric, float64(n), []string{}, 1)
+}
+
+// TaggedGauge submits a Gauge metric with tags to the global Statsd instance,
+// if configured. See go-dogstatsd for more documentation on Gauge.
+func TaggedGauge(m string, n float64, ts []string, r float64) {
 	if Statsd == nil {
 		puke(errNotConfigured)
 		return
 	}
-	if err := Statsd.Gauge(metric, float64(n), []string{}, 1); err != nil {
+	if err := Statsd.Gauge(m, n, ts, r); err != nil {
 		puke(err)
 	}
 }
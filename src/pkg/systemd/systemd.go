@@ -0,0 +1,74 @@
+// Package systemd implements the sd_notify protocol for running docker-gc as
+// a Type=notify service, optionally with WatchdogSec. Notifications are
+// datagrams to the unix socket systemd passes in NOTIFY_SOCKET, so it needs
+// no libsystemd. Without NOTIFY_SOCKET every function is a no-op.
+package systemd
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Notify sends the newline separated variable assignments, eg. READY=1, to
+// systemd
+func Notify(state ...string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// Abstract namespace sockets start with @ in the variable
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(strings.Join(state, "\n")))
+	return err
+}
+
+// Ready tells systemd docker-gc has started
+func Ready() {
+	notify("READY=1")
+}
+
+// Status sets the status line systemctl status shows
+func Status(status string) {
+	// A newline would end the assignment
+	notify("STATUS=" + strings.Replace(status, "\n", " ", -1))
+}
+
+// Watchdog tells systemd docker-gc is alive, it's restarted when these stop
+// coming for WatchdogSec
+func Watchdog() {
+	notify("WATCHDOG=1")
+}
+
+// WatchdogTimeout returns the WatchdogSec of the service, zero when the
+// watchdog isn't enabled for this process
+func WatchdogTimeout() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+func notify(state string) {
+	if err := Notify(state); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"state": state,
+			"error": err,
+		}).Warn("Notifying systemd failed")
+	}
+}
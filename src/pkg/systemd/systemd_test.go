@@ -0,0 +1,65 @@
+package systemd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// listen stands in for systemd, returning the socket notifications arrive at
+func listen(t *testing.T) *net.UnixConn {
+	path := fmt.Sprintf("/tmp/docker-gc-notify-%d.sock", time.Now().UnixNano())
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("NOTIFY_SOCKET", path)
+	return conn
+}
+
+func receive(t *testing.T, conn *net.UnixConn) string {
+	buffer := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buffer[:n])
+}
+
+func TestNotify(t *testing.T) {
+	conn := listen(t)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+	defer os.Remove(conn.LocalAddr().String())
+	defer conn.Close()
+
+	Ready()
+	assert.Equal(t, "READY=1", receive(t, conn), "ready is sent")
+	Status("Deleted 2 images\nand 1 container")
+	assert.Equal(t, "STATUS=Deleted 2 images and 1 container", receive(t, conn), "status is sent on a single line")
+	Watchdog()
+	assert.Equal(t, "WATCHDOG=1", receive(t, conn), "watchdog ping is sent")
+	Notify("READY=1", "STATUS=Started")
+	assert.Equal(t, "READY=1\nSTATUS=Started", receive(t, conn), "assignments are sent newline separated")
+
+	os.Unsetenv("NOTIFY_SOCKET")
+	assert.Nil(t, Notify("READY=1"), "notifying without systemd is a no-op")
+}
+
+func TestWatchdogTimeout(t *testing.T) {
+	defer os.Unsetenv("WATCHDOG_USEC")
+	defer os.Unsetenv("WATCHDOG_PID")
+
+	assert.Equal(t, time.Duration(0), WatchdogTimeout(), "watchdog is disabled by default")
+	os.Setenv("WATCHDOG_USEC", "30000000")
+	assert.Equal(t, 30*time.Second, WatchdogTimeout(), "watchdog timeout is read")
+	os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	assert.Equal(t, 30*time.Second, WatchdogTimeout(), "watchdog is enabled for this process")
+	os.Setenv("WATCHDOG_PID", "1")
+	assert.Equal(t, time.Duration(0), WatchdogTimeout(), "watchdog of another process is ignored")
+}